@@ -0,0 +1,75 @@
+package analytics
+
+import (
+	"math"
+	"sort"
+)
+
+// correlationMinSamples is the number of pairs required for a correlation
+const correlationMinSamples = 3
+
+// Pearson returns the Pearson correlation coefficient of paired samples.
+// ok is false if there are fewer than three pairs or either sample is constant.
+func Pearson(xs, ys []float64) (r float64, ok bool) {
+	n := min(len(xs), len(ys))
+	if n < correlationMinSamples {
+		return 0, false
+	}
+
+	var meanX, meanY float64
+	for i := 0; i < n; i++ {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+	meanX /= float64(n)
+	meanY /= float64(n)
+
+	var sxx, syy, sxy float64
+	for i := 0; i < n; i++ {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		sxx += dx * dx
+		syy += dy * dy
+		sxy += dx * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return 0, false
+	}
+
+	r = sxy / math.Sqrt(sxx*syy)
+	return math.Max(-1, math.Min(1, r)), true
+}
+
+// Spearman returns the Spearman rank correlation coefficient of paired
+// samples: the Pearson correlation of their ranks, with ties given the
+// average of the ranks they span. ok is false under the same conditions as Pearson.
+func Spearman(xs, ys []float64) (rho float64, ok bool) {
+	n := min(len(xs), len(ys))
+	if n < correlationMinSamples {
+		return 0, false
+	}
+	return Pearson(ranks(xs[:n]), ranks(ys[:n]))
+}
+
+// ranks returns the 1-based fractional ranks of values
+func ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return values[order[i]] < values[order[j]] })
+
+	result := make([]float64, len(values))
+	for i := 0; i < len(order); {
+		j := i + 1
+		for j < len(order) && values[order[j]] == values[order[i]] {
+			j++
+		}
+		// Positions i..j-1 are tied; ranks are 1-based
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			result[order[k]] = rank
+		}
+		i = j
+	}
+	return result
+}
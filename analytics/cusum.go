@@ -0,0 +1,216 @@
+package analytics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Default CUSUM parameters, in standard deviations of the baseline
+const (
+	DefaultCUSUMDrift     = 0.5 // k: shifts smaller than this are ignored
+	DefaultCUSUMThreshold = 5.0 // h: decision threshold on the cumulative sum
+)
+
+func init() {
+	RegisterDetector("cusum", func(cfg DetectorConfig) Detector {
+		return NewCUSUMDetector(cfg.WindowSize, DefaultCUSUMDrift, cfg.Threshold)
+	})
+}
+
+// LevelShift describes a sustained change in the level of a stream
+type LevelShift struct {
+	// Magnitude is the estimated shift of the mean (new mean - old mean)
+	Magnitude float64
+
+	// OldMean and NewMean are the baseline before and the estimated level after the shift
+	OldMean float64
+	NewMean float64
+
+	// ChangeTime is the estimated time the shift started
+	ChangeTime time.Time
+
+	// DetectedAt is the time of the sample that triggered detection
+	DetectedAt time.Time
+
+	// Statistic is the cumulative sum that crossed the threshold
+	Statistic float64
+}
+
+// CUSUMDetector detects sustained level shifts with a two-sided tabular CUSUM.
+//
+// A baseline mean and standard deviation are learned from the first warmup
+// samples. Each sample's standardized deviation from the baseline, minus the
+// drift allowance k, is accumulated separately for upward and downward
+// shifts; a sum exceeding h signals a shift. The change time is estimated as
+// the last time the triggering sum was zero. After a shift the baseline
+// moves to the new level and accumulation restarts.
+//
+// Unlike the z-score, CUSUM does not adapt its baseline between shifts, so a
+// device that quietly steps from 40% to 60% is caught even though each
+// individual sample looks unremarkable.
+type CUSUMDetector struct {
+	warmup    int
+	drift     float64
+	threshold float64
+
+	// Baseline learned with Welford's algorithm during warm-up
+	mean  float64
+	m2    float64
+	count int
+
+	// Cumulative sums and bookkeeping for change time/magnitude estimates
+	upper, lower           float64
+	upperStart, lowerStart time.Time
+	upperN, lowerN         int
+
+	mu sync.RWMutex
+}
+
+// NewCUSUMDetector creates a new CUSUM level shift detector
+func NewCUSUMDetector(warmup int, drift, threshold float64) *CUSUMDetector {
+	if warmup <= 1 {
+		warmup = DefaultWindowSize
+	}
+	if drift <= 0 {
+		drift = DefaultCUSUMDrift
+	}
+	if threshold <= 0 {
+		threshold = DefaultCUSUMThreshold
+	}
+	return &CUSUMDetector{
+		warmup:    warmup,
+		drift:     drift,
+		threshold: threshold,
+	}
+}
+
+// stddev returns the baseline standard deviation (must hold lock)
+func (cd *CUSUMDetector) stddev() float64 {
+	if cd.count < 2 {
+		return 0
+	}
+	return math.Sqrt(cd.m2 / float64(cd.count-1))
+}
+
+// ready reports whether the baseline has been learned (must hold lock)
+func (cd *CUSUMDetector) ready() bool {
+	return cd.count >= cd.warmup && cd.stddev() > 0
+}
+
+// Observe adds a value observed at t and returns the detected level shift, if any
+func (cd *CUSUMDetector) Observe(t time.Time, value float64) (LevelShift, bool) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	if !cd.ready() {
+		cd.count++
+		delta := value - cd.mean
+		cd.mean += delta / float64(cd.count)
+		cd.m2 += delta * (value - cd.mean)
+		return LevelShift{}, false
+	}
+
+	sigma := cd.stddev()
+	z := (value - cd.mean) / sigma
+
+	if cd.upper == 0 {
+		cd.upperStart = t
+		cd.upperN = 0
+	}
+	if cd.lower == 0 {
+		cd.lowerStart = t
+		cd.lowerN = 0
+	}
+	cd.upper = math.Max(0, cd.upper+z-cd.drift)
+	cd.lower = math.Max(0, cd.lower-z-cd.drift)
+	if cd.upper > 0 {
+		cd.upperN++
+	}
+	if cd.lower > 0 {
+		cd.lowerN++
+	}
+
+	var shift LevelShift
+	switch {
+	case cd.upper > cd.threshold:
+		shift = cd.shift(sigma, cd.upper, cd.upperN, cd.upperStart, t, 1)
+	case cd.lower > cd.threshold:
+		shift = cd.shift(sigma, cd.lower, cd.lowerN, cd.lowerStart, t, -1)
+	default:
+		return LevelShift{}, false
+	}
+
+	// Re-baseline on the new level and restart accumulation
+	cd.mean = shift.NewMean
+	cd.upper, cd.lower = 0, 0
+	return shift, true
+}
+
+// shift builds the level shift estimate for a triggered sum (must hold lock).
+// The new level is estimated as baseline ± σ·(k + S/n), with n the number of
+// samples accumulated since the sum was last zero.
+func (cd *CUSUMDetector) shift(sigma, sum float64, n int, start, detected time.Time, sign float64) LevelShift {
+	if n < 1 {
+		n = 1
+	}
+	magnitude := sign * sigma * (cd.drift + sum/float64(n))
+	return LevelShift{
+		Magnitude:  magnitude,
+		OldMean:    cd.mean,
+		NewMean:    cd.mean + magnitude,
+		ChangeTime: start,
+		DetectedAt: detected,
+		Statistic:  sum,
+	}
+}
+
+// Add adds a value observed now; the score is the larger cumulative sum
+func (cd *CUSUMDetector) Add(value float64) (isAnomaly bool, score float64) {
+	return cd.AddAt(time.Now(), value)
+}
+
+// AddAt adds a value observed at t; the score is the larger cumulative sum
+func (cd *CUSUMDetector) AddAt(t time.Time, value float64) (isAnomaly bool, score float64) {
+	shift, detected := cd.Observe(t, value)
+	if detected {
+		return true, shift.Statistic
+	}
+
+	cd.mu.RLock()
+	defer cd.mu.RUnlock()
+	return false, math.Max(cd.upper, cd.lower)
+}
+
+// IsAnomaly checks whether adding value would signal a level shift
+func (cd *CUSUMDetector) IsAnomaly(value float64) (bool, float64) {
+	cd.mu.RLock()
+	defer cd.mu.RUnlock()
+
+	if !cd.ready() {
+		return false, 0
+	}
+	z := (value - cd.mean) / cd.stddev()
+	score := math.Max(
+		math.Max(0, cd.upper+z-cd.drift),
+		math.Max(0, cd.lower-z-cd.drift),
+	)
+	return score > cd.threshold, score
+}
+
+// Stats returns the baseline mean and standard deviation
+func (cd *CUSUMDetector) Stats() (mean, stddev float64) {
+	cd.mu.RLock()
+	defer cd.mu.RUnlock()
+	return cd.mean, cd.stddev()
+}
+
+// Reset clears the baseline and cumulative sums
+func (cd *CUSUMDetector) Reset() {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	cd.mean, cd.m2, cd.count = 0, 0, 0
+	cd.upper, cd.lower = 0, 0
+	cd.upperN, cd.lowerN = 0, 0
+	cd.upperStart, cd.lowerStart = time.Time{}, time.Time{}
+}
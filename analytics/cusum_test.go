@@ -0,0 +1,174 @@
+package analytics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// naiveCUSUM is the reference for CUSUMDetector: the baseline is recomputed
+// from the stored warm-up samples and each sum keeps the samples it has
+// accumulated since it was last zero
+type naiveCUSUM struct {
+	warmup           int
+	drift, threshold float64
+
+	baseline     []float64
+	mean         float64
+	upper, lower float64
+	upperRun     []time.Time
+	lowerRun     []time.Time
+}
+
+func (n *naiveCUSUM) stddev() float64 {
+	if len(n.baseline) < 2 {
+		return 0
+	}
+	mean := naiveWindowMean(n.baseline)
+	m2 := 0.0
+	for _, v := range n.baseline {
+		m2 += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(m2 / float64(len(n.baseline)-1))
+}
+
+func (n *naiveCUSUM) observe(t time.Time, value float64) (shift LevelShift, detected bool, score float64) {
+	if len(n.baseline) < n.warmup || n.stddev() == 0 {
+		n.baseline = append(n.baseline, value)
+		n.mean = naiveWindowMean(n.baseline)
+		return LevelShift{}, false, 0
+	}
+
+	sigma := n.stddev()
+	z := (value - n.mean) / sigma
+	n.upper = math.Max(0, n.upper+z-n.drift)
+	n.lower = math.Max(0, n.lower-z-n.drift)
+	n.upperRun = extendRun(n.upperRun, n.upper, t)
+	n.lowerRun = extendRun(n.lowerRun, n.lower, t)
+
+	sign, sum, run := 1.0, n.upper, n.upperRun
+	if n.upper <= n.threshold {
+		sign, sum, run = -1, n.lower, n.lowerRun
+	}
+	if sum <= n.threshold {
+		return LevelShift{}, false, math.Max(n.upper, n.lower)
+	}
+
+	magnitude := sign * sigma * (n.drift + sum/float64(len(run)))
+	shift = LevelShift{
+		Magnitude:  magnitude,
+		OldMean:    n.mean,
+		NewMean:    n.mean + magnitude,
+		ChangeTime: run[0],
+		DetectedAt: t,
+		Statistic:  sum,
+	}
+	n.mean += magnitude
+	n.upper, n.lower = 0, 0
+	n.upperRun, n.lowerRun = nil, nil
+	return shift, true, sum
+}
+
+// extendRun returns the times of the samples a sum has accumulated since it
+// was last zero, including t if the sum is positive
+func extendRun(run []time.Time, sum float64, t time.Time) []time.Time {
+	if sum == 0 {
+		return nil
+	}
+	return append(run, t)
+}
+
+func naiveWindowMean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func TestCUSUMDetectorMatchesNaive(t *testing.T) {
+	tests := []struct {
+		name   string
+		warmup int
+		drift  float64
+		levels []float64 // mean of each block of 500 samples
+		noise  float64
+	}{
+		{"stable", 50, 0.5, []float64{40}, 2},
+		{"step up", 50, 0.5, []float64{40, 60}, 2},
+		{"step down and back", 30, 0.5, []float64{100, 90, 100}, 3},
+		{"small shifts", 100, 0.25, []float64{0, 1, 2, 1, 0}, 1},
+		{"constant warm-up", 20, 0.5, []float64{5, 5.5}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := NewCUSUMDetector(tt.warmup, tt.drift, 0)
+			ref := &naiveCUSUM{warmup: tt.warmup, drift: tt.drift, threshold: DefaultCUSUMThreshold}
+			rng := rand.New(rand.NewSource(50))
+			detections := 0
+
+			for i := 0; i < 500*len(tt.levels); i++ {
+				ts := testEpoch.Add(time.Duration(i) * time.Second)
+				value := tt.levels[i/500] + tt.noise*rng.NormFloat64()
+				if tt.noise == 0 && i == 10 {
+					value += 0.1 // the baseline needs some spread to become ready
+				}
+
+				wouldDetect, _ := cd.IsAnomaly(value)
+				detected, score := cd.AddAt(ts, value)
+				wantShift, wantDetected, wantScore := ref.observe(ts, value)
+
+				if detected != wantDetected || wouldDetect != wantDetected || !closeTo(score, wantScore, 1e-9) {
+					t.Fatalf("sample %d: detected %v (predicted %v), score %v, want %v, %v",
+						i, detected, wouldDetect, score, wantDetected, wantScore)
+				}
+				if !detected {
+					continue
+				}
+				detections++
+
+				mean, _ := cd.Stats()
+				if !closeTo(mean, wantShift.NewMean, 1e-9) {
+					t.Fatalf("sample %d: baseline mean = %v, want %v", i, mean, wantShift.NewMean)
+				}
+			}
+
+			if want := len(tt.levels) - 1; tt.noise > 0 && detections < want {
+				t.Fatalf("%d shifts detected, want at least %d", detections, want)
+			}
+		})
+	}
+}
+
+func TestCUSUMObserveEstimates(t *testing.T) {
+	cd := NewCUSUMDetector(50, 0.5, 0)
+	ref := &naiveCUSUM{warmup: 50, drift: 0.5, threshold: DefaultCUSUMThreshold}
+	rng := rand.New(rand.NewSource(51))
+
+	for i := 0; i < 1000; i++ {
+		ts := testEpoch.Add(time.Duration(i) * time.Second)
+		value := 40 + 2*rng.NormFloat64()
+		if i >= 600 {
+			value += 20
+		}
+
+		shift, detected := cd.Observe(ts, value)
+		want, wantDetected, _ := ref.observe(ts, value)
+		if detected != wantDetected {
+			t.Fatalf("sample %d: detected %v, want %v", i, detected, wantDetected)
+		}
+		if !detected {
+			continue
+		}
+		if !shift.ChangeTime.Equal(want.ChangeTime) || !shift.DetectedAt.Equal(want.DetectedAt) ||
+			!closeTo(shift.Magnitude, want.Magnitude, 1e-9) || !closeTo(shift.OldMean, want.OldMean, 1e-9) ||
+			!closeTo(shift.Statistic, want.Statistic, 1e-9) {
+			t.Fatalf("sample %d: shift = %+v, want %+v", i, shift, want)
+		}
+		if i >= 600 && shift.ChangeTime.Before(testEpoch.Add(595*time.Second)) {
+			t.Fatalf("sample %d: change time %v, want near the step at 600s", i, shift.ChangeTime.Sub(testEpoch))
+		}
+	}
+}
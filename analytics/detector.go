@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultDetector is the name of the detector used when none is configured
+const DefaultDetector = "zscore"
+
+// Detector detects anomalies in a stream of values
+type Detector interface {
+	// Add adds a value and returns whether it's an anomaly and its score
+	Add(value float64) (isAnomaly bool, score float64)
+
+	// IsAnomaly checks if a value is an anomaly without adding it
+	IsAnomaly(value float64) (isAnomaly bool, score float64)
+
+	// Stats returns the current baseline center and spread
+	// (mean and standard deviation for the z-score detector)
+	Stats() (center, spread float64)
+
+	// Reset clears all accumulated state
+	Reset()
+}
+
+// TimedDetector is implemented by detectors that weight samples by their
+// timestamp rather than by arrival order
+type TimedDetector interface {
+	Detector
+
+	// AddAt adds a value observed at t and returns whether it's an anomaly
+	AddAt(t time.Time, value float64) (isAnomaly bool, score float64)
+}
+
+// DetectorConfig holds parameters passed to detector factories.
+// Zero values select the detector's own defaults.
+type DetectorConfig struct {
+	WindowSize int           // samples in the window, or the sample limit of time-based windows
+	WindowSpan time.Duration // time span of time-based windows (0 for count-based windows)
+	Threshold  float64
+	HalfLife   time.Duration
+}
+
+// DetectorFactory creates a detector from configuration
+type DetectorFactory func(cfg DetectorConfig) Detector
+
+var (
+	detectors   = make(map[string]DetectorFactory)
+	detectorsMu sync.RWMutex
+)
+
+// RegisterDetector makes a detector available by name.
+// Registering the same name twice replaces the previous factory.
+func RegisterDetector(name string, factory DetectorFactory) {
+	detectorsMu.Lock()
+	defer detectorsMu.Unlock()
+	detectors[name] = factory
+}
+
+// NewDetector creates a registered detector by name
+func NewDetector(name string, cfg DetectorConfig) (Detector, error) {
+	detectorsMu.RLock()
+	factory, ok := detectors[name]
+	detectorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown detector %q", name)
+	}
+	return factory(cfg), nil
+}
+
+// HasDetector reports whether a detector is registered under name
+func HasDetector(name string) bool {
+	detectorsMu.RLock()
+	defer detectorsMu.RUnlock()
+	_, ok := detectors[name]
+	return ok
+}
+
+// DetectorNames returns the names of all registered detectors in sorted order
+func DetectorNames() []string {
+	detectorsMu.RLock()
+	defer detectorsMu.RUnlock()
+
+	names := make([]string, 0, len(detectors))
+	for name := range detectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,161 @@
+package analytics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEWMAHalfLife is the half-life used when none is configured
+	DefaultEWMAHalfLife = 30 * time.Second
+
+	// DefaultEWMAThreshold is the anomaly threshold in standard deviations
+	DefaultEWMAThreshold = 3.0
+
+	// ewmaMinSamples is the number of samples required before scoring
+	ewmaMinSamples = 2
+)
+
+func init() {
+	RegisterDetector("ewma", func(cfg DetectorConfig) Detector {
+		return NewEWMA(cfg.HalfLife, cfg.Threshold)
+	})
+}
+
+// EWMA maintains an exponentially weighted moving average and variance.
+// Sample weights decay with elapsed time rather than sample count, so the
+// half-life means the same thing at any ingest rate. No window is stored:
+// each update is O(1) in time and memory.
+//
+// EWMA can be used as a smoother (Value) or as an anomaly detector that
+// scores each value in standard deviations from the weighted mean.
+type EWMA struct {
+	halfLife  time.Duration
+	threshold float64
+
+	mean     float64
+	variance float64
+	count    int
+
+	// Timestamp of the last sample and typical spacing between samples,
+	// used for samples arriving with identical or out-of-order timestamps
+	last     time.Time
+	interval time.Duration
+
+	mu sync.RWMutex
+}
+
+// NewEWMA creates a new EWMA with the given half-life and anomaly threshold
+func NewEWMA(halfLife time.Duration, threshold float64) *EWMA {
+	if halfLife <= 0 {
+		halfLife = DefaultEWMAHalfLife
+	}
+	if threshold <= 0 {
+		threshold = DefaultEWMAThreshold
+	}
+	return &EWMA{
+		halfLife:  halfLife,
+		threshold: threshold,
+		interval:  halfLife / DefaultWindowSize,
+	}
+}
+
+// Add adds a value observed now and returns whether it's an anomaly
+func (e *EWMA) Add(value float64) (isAnomaly bool, score float64) {
+	return e.AddAt(time.Now(), value)
+}
+
+// AddAt adds a value observed at t and returns whether it's an anomaly.
+// The value is scored against the state before it is incorporated.
+func (e *EWMA) AddAt(t time.Time, value float64) (isAnomaly bool, score float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	score = e.score(value)
+	isAnomaly = math.Abs(score) > e.threshold
+
+	if e.count == 0 {
+		e.mean = value
+		e.variance = 0
+		e.last = t
+		e.count = 1
+		return isAnomaly, score
+	}
+
+	dt := t.Sub(e.last)
+	if dt > 0 {
+		e.interval = (e.interval + dt) / 2
+		e.last = t
+	} else {
+		dt = e.interval
+	}
+
+	alpha := 1 - math.Exp(-math.Ln2*dt.Seconds()/e.halfLife.Seconds())
+	diff := value - e.mean
+	incr := alpha * diff
+	e.mean += incr
+	e.variance = (1 - alpha) * (e.variance + diff*incr)
+	e.count++
+
+	return isAnomaly, score
+}
+
+// score computes the deviation of value in standard deviations (must hold lock)
+func (e *EWMA) score(value float64) float64 {
+	if e.count < ewmaMinSamples || e.variance <= 0 {
+		return 0
+	}
+	return (value - e.mean) / math.Sqrt(e.variance)
+}
+
+// IsAnomaly checks if a value is an anomaly without adding it
+func (e *EWMA) IsAnomaly(value float64) (bool, float64) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	score := e.score(value)
+	return math.Abs(score) > e.threshold, score
+}
+
+// Value returns the current weighted mean (the smoothed value)
+func (e *EWMA) Value() float64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.mean
+}
+
+// Stats returns the current weighted mean and standard deviation
+func (e *EWMA) Stats() (mean, stddev float64) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.mean, math.Sqrt(e.variance)
+}
+
+// Count returns the number of values added
+func (e *EWMA) Count() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.count
+}
+
+// HalfLife returns the configured half-life
+func (e *EWMA) HalfLife() time.Duration {
+	return e.halfLife
+}
+
+// Threshold returns the configured threshold
+func (e *EWMA) Threshold() float64 {
+	return e.threshold
+}
+
+// Reset clears all accumulated state
+func (e *EWMA) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mean = 0
+	e.variance = 0
+	e.count = 0
+	e.last = time.Time{}
+	e.interval = e.halfLife / DefaultWindowSize
+}
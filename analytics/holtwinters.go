@@ -0,0 +1,231 @@
+package analytics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Default Holt-Winters smoothing parameters
+const (
+	DefaultHWAlpha = 0.3  // level
+	DefaultHWBeta  = 0.05 // trend
+	DefaultHWGamma = 0.1  // season
+)
+
+// hwErrorMemory bounds the number of samples in the running estimate
+// of the one-step forecast error variance
+const hwErrorMemory = 100
+
+// HoltWintersConfig holds Holt-Winters parameters. Zero smoothing factors
+// select the defaults; a zero SeasonPeriod disables seasonality (Holt's
+// linear trend method).
+type HoltWintersConfig struct {
+	Alpha float64
+	Beta  float64
+	Gamma float64
+
+	// SeasonPeriod is the length of one seasonal cycle, e.g. 24h
+	SeasonPeriod time.Duration
+
+	// SeasonBuckets is the number of seasonal slots per cycle
+	SeasonBuckets int
+}
+
+// HoltWinters is an additive Holt-Winters (level/trend/season) forecaster.
+//
+// Level and trend are updated per sample. The seasonal component is indexed
+// by the sample's position within the seasonal period in wall-clock time,
+// so a daily cycle is learned correctly regardless of the ingest rate and
+// costs SeasonBuckets values of memory rather than one value per sample.
+// Seasonal offsets start at zero and are learned progressively.
+type HoltWinters struct {
+	cfg HoltWintersConfig
+
+	level  float64
+	trend  float64
+	season []float64
+	count  int
+
+	// Running mean of squared one-step forecast errors
+	mse float64
+
+	// Timestamp of the last sample and typical spacing between samples,
+	// used to convert between sample steps and time
+	last     time.Time
+	interval time.Duration
+
+	mu sync.RWMutex
+}
+
+// NewHoltWinters creates a new Holt-Winters forecaster
+func NewHoltWinters(cfg HoltWintersConfig) *HoltWinters {
+	if cfg.Alpha <= 0 || cfg.Alpha > 1 {
+		cfg.Alpha = DefaultHWAlpha
+	}
+	if cfg.Beta <= 0 || cfg.Beta > 1 {
+		cfg.Beta = DefaultHWBeta
+	}
+	if cfg.Gamma <= 0 || cfg.Gamma > 1 {
+		cfg.Gamma = DefaultHWGamma
+	}
+	if cfg.SeasonPeriod <= 0 || cfg.SeasonBuckets <= 0 {
+		cfg.SeasonPeriod = 0
+		cfg.SeasonBuckets = 0
+	}
+
+	return &HoltWinters{
+		cfg:    cfg,
+		season: make([]float64, cfg.SeasonBuckets),
+	}
+}
+
+// bucket returns the seasonal slot of time t, or -1 without seasonality
+func (hw *HoltWinters) bucket(t time.Time) int {
+	if hw.cfg.SeasonBuckets == 0 {
+		return -1
+	}
+	offset := t.UnixNano() % int64(hw.cfg.SeasonPeriod)
+	if offset < 0 {
+		offset += int64(hw.cfg.SeasonPeriod)
+	}
+	return int(offset * int64(hw.cfg.SeasonBuckets) / int64(hw.cfg.SeasonPeriod))
+}
+
+// seasonal returns the seasonal offset for time t (must hold lock)
+func (hw *HoltWinters) seasonal(t time.Time) float64 {
+	if b := hw.bucket(t); b >= 0 {
+		return hw.season[b]
+	}
+	return 0
+}
+
+// AddAt adds a value observed at t and returns the one-step-ahead forecast
+// error made for it (0 for the first sample)
+func (hw *HoltWinters) AddAt(t time.Time, value float64) float64 {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	if hw.count == 0 {
+		hw.level = value
+		hw.trend = 0
+		hw.last = t
+		hw.count = 1
+		return 0
+	}
+
+	if dt := t.Sub(hw.last); dt > 0 {
+		if hw.interval == 0 {
+			hw.interval = dt
+		} else {
+			hw.interval = (hw.interval + dt) / 2
+		}
+		hw.last = t
+	}
+
+	season := hw.seasonal(t)
+	forecastErr := value - (hw.level + hw.trend + season)
+
+	prevLevel := hw.level
+	hw.level = hw.cfg.Alpha*(value-season) + (1-hw.cfg.Alpha)*(hw.level+hw.trend)
+	hw.trend = hw.cfg.Beta*(hw.level-prevLevel) + (1-hw.cfg.Beta)*hw.trend
+	if b := hw.bucket(t); b >= 0 {
+		hw.season[b] = hw.cfg.Gamma*(value-hw.level) + (1-hw.cfg.Gamma)*hw.season[b]
+	}
+	hw.count++
+
+	n := float64(hw.count - 1)
+	if n > hwErrorMemory {
+		n = hwErrorMemory
+	}
+	hw.mse += (forecastErr*forecastErr - hw.mse) / n
+
+	return forecastErr
+}
+
+// Add adds a value observed now
+func (hw *HoltWinters) Add(value float64) float64 {
+	return hw.AddAt(time.Now(), value)
+}
+
+// Forecast returns the predicted value h samples ahead
+func (hw *HoltWinters) Forecast(h int) float64 {
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	return hw.forecast(h)
+}
+
+// forecast computes the h-step forecast (must hold lock)
+func (hw *HoltWinters) forecast(h int) float64 {
+	if hw.count == 0 {
+		return 0
+	}
+	if h < 1 {
+		h = 1
+	}
+	t := hw.last.Add(time.Duration(h) * hw.interval)
+	return hw.level + float64(h)*hw.trend + hw.seasonal(t)
+}
+
+// ForecastInterval returns the forecast at time t with a prediction interval.
+// The h-step error variance follows the additive Holt model:
+// σ²·[1 + Σ_{j=1}^{h-1} α²(1 + jβ)²], with σ² the one-step error variance.
+func (hw *HoltWinters) ForecastInterval(t time.Time, confidence float64) (point, lower, upper float64) {
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	if hw.count == 0 {
+		return 0, 0, 0
+	}
+
+	h := hw.steps(t)
+	point = hw.level + h*hw.trend + hw.seasonal(t)
+
+	// Closed form of the sum for n = h-1 terms
+	n, a, b := h-1, hw.cfg.Alpha, hw.cfg.Beta
+	sum := n + b*n*(n+1) + b*b*n*(n+1)*(2*n+1)/6
+	variance := 1 + a*a*sum
+	margin := normalQuantile(confidence) * math.Sqrt(hw.mse*variance)
+	return point, point - margin, point + margin
+}
+
+// steps converts the distance from the last sample to t into samples (must hold lock)
+func (hw *HoltWinters) steps(t time.Time) float64 {
+	if hw.interval <= 0 {
+		return 1
+	}
+	return math.Max(1, float64(t.Sub(hw.last))/float64(hw.interval))
+}
+
+// LastUpdate returns the timestamp of the most recent sample
+func (hw *HoltWinters) LastUpdate() time.Time {
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	return hw.last
+}
+
+// Interval returns the observed typical spacing between samples
+func (hw *HoltWinters) Interval() time.Duration {
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	return hw.interval
+}
+
+// Count returns the number of values added
+func (hw *HoltWinters) Count() int {
+	hw.mu.RLock()
+	defer hw.mu.RUnlock()
+	return hw.count
+}
+
+// Reset clears all accumulated state
+func (hw *HoltWinters) Reset() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.level = 0
+	hw.trend = 0
+	hw.season = make([]float64, hw.cfg.SeasonBuckets)
+	hw.count = 0
+	hw.mse = 0
+	hw.last = time.Time{}
+	hw.interval = 0
+}
@@ -0,0 +1,143 @@
+package analytics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// naiveHoltWinters is the reference for HoltWinters: the textbook additive
+// recursion with seasonal offsets looked up by the time of day of a sample
+type naiveHoltWinters struct {
+	alpha, beta, gamma float64
+	period             time.Duration
+	buckets            int
+
+	level, trend float64
+	season       map[int]float64
+	errors       []float64
+}
+
+func (n *naiveHoltWinters) slot(t time.Time) int {
+	if n.buckets == 0 {
+		return -1
+	}
+	since := t.Sub(time.Unix(0, 0)) % n.period
+	if since < 0 {
+		since += n.period
+	}
+	return int(since / (n.period / time.Duration(n.buckets)))
+}
+
+func (n *naiveHoltWinters) add(t time.Time, value float64, first bool) float64 {
+	if first {
+		n.level = value
+		return 0
+	}
+	slot := n.slot(t)
+	season := n.season[slot]
+	err := value - (n.level + n.trend + season)
+	prev := n.level
+	n.level = n.alpha*(value-season) + (1-n.alpha)*(n.level+n.trend)
+	n.trend = n.beta*(n.level-prev) + (1-n.beta)*n.trend
+	if slot >= 0 {
+		n.season[slot] = n.gamma*(value-n.level) + (1-n.gamma)*season
+	}
+	n.errors = append(n.errors, err)
+	return err
+}
+
+// mse is the mean squared one-step error, over at most the last
+// hwErrorMemory errors once that many have been seen
+func (n *naiveHoltWinters) mse() float64 {
+	if len(n.errors) <= hwErrorMemory {
+		sum := 0.0
+		for _, e := range n.errors {
+			sum += e * e
+		}
+		return sum / float64(len(n.errors))
+	}
+	return math.NaN()
+}
+
+// variance is the h-step error variance factor, summed term by term
+func (n *naiveHoltWinters) variance(h int) float64 {
+	v := 1.0
+	for j := 1; j < h; j++ {
+		v += n.alpha * n.alpha * (1 + float64(j)*n.beta) * (1 + float64(j)*n.beta)
+	}
+	return v
+}
+
+func TestHoltWintersMatchesNaive(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  HoltWintersConfig
+		next func(rng *rand.Rand, i int, t time.Time) float64
+	}{
+		{"level", HoltWintersConfig{}, func(rng *rand.Rand, i int, t time.Time) float64 {
+			return 100 + rng.NormFloat64()
+		}},
+		{"trend", HoltWintersConfig{Alpha: 0.5, Beta: 0.2}, func(rng *rand.Rand, i int, t time.Time) float64 {
+			return 0.5*float64(i) + rng.NormFloat64()
+		}},
+		{"hourly season", HoltWintersConfig{SeasonPeriod: time.Hour, SeasonBuckets: 12}, func(rng *rand.Rand, i int, t time.Time) float64 {
+			return 50 + 10*math.Sin(2*math.Pi*float64(t.Minute())/60) + rng.NormFloat64()
+		}},
+		{"level shift", HoltWintersConfig{Alpha: 0.8, Beta: 0.9, Gamma: 0.5, SeasonPeriod: 10 * time.Minute, SeasonBuckets: 5}, func(rng *rand.Rand, i int, t time.Time) float64 {
+			if i > 300 {
+				return 500 + rng.NormFloat64()
+			}
+			return rng.NormFloat64()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hw := NewHoltWinters(tt.cfg)
+			cfg := hw.cfg
+			ref := &naiveHoltWinters{
+				alpha: cfg.Alpha, beta: cfg.Beta, gamma: cfg.Gamma,
+				period: cfg.SeasonPeriod, buckets: cfg.SeasonBuckets,
+				season: map[int]float64{},
+			}
+			rng := rand.New(rand.NewSource(40))
+			step := 30 * time.Second
+
+			for i := 0; i < 2000; i++ {
+				ts := testEpoch.Add(time.Duration(i) * step)
+				value := tt.next(rng, i, ts)
+				got := hw.AddAt(ts, value)
+				want := ref.add(ts, value, i == 0)
+				if !closeTo(got, want, 1e-9) {
+					t.Fatalf("sample %d: forecast error = %v, want %v", i, got, want)
+				}
+				if i == 0 {
+					continue
+				}
+
+				if got, want := hw.Forecast(1), ref.level+ref.trend+ref.season[ref.slot(ts.Add(step))]; !closeTo(got, want, 1e-9) {
+					t.Fatalf("sample %d: forecast = %v, want %v", i, got, want)
+				}
+				if mse := ref.mse(); !math.IsNaN(mse) && !closeTo(hw.mse, mse, 1e-9) {
+					t.Fatalf("sample %d: mse = %v, want %v", i, hw.mse, mse)
+				}
+
+				for _, h := range []int{1, 2, 5, 40} {
+					at := ts.Add(time.Duration(h) * step)
+					point, lower, upper := hw.ForecastInterval(at, 0.95)
+					wantPoint := ref.level + float64(h)*ref.trend + ref.season[ref.slot(at)]
+					margin := normalQuantile(0.95) * math.Sqrt(hw.mse*ref.variance(h))
+					if !closeTo(point, wantPoint, 1e-9) || !closeTo(lower, wantPoint-margin, 1e-9) || !closeTo(upper, wantPoint+margin, 1e-9) {
+						t.Fatalf("sample %d, %d steps: interval = (%v, %v, %v), want (%v, %v, %v)",
+							i, h, lower, point, upper, wantPoint-margin, wantPoint, wantPoint+margin)
+					}
+				}
+			}
+			if hw.Interval() != step {
+				t.Fatalf("interval = %v, want %v", hw.Interval(), step)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package analytics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// horizonBuckets is the number of time buckets a horizon is split into
+const horizonBuckets = 60
+
+// moments holds the count, mean and sum of squared deviations of values
+type moments struct {
+	n    int
+	mean float64
+	m2   float64
+}
+
+// add adds a value with Welford's method
+func (m *moments) add(value float64) {
+	m.n++
+	delta := value - m.mean
+	m.mean += delta / float64(m.n)
+	m.m2 += delta * (value - m.mean)
+}
+
+// merge adds the moments of another set of values (Chan et al.)
+func (m *moments) merge(o moments) {
+	if o.n == 0 {
+		return
+	}
+	n := m.n + o.n
+	delta := o.mean - m.mean
+	m.mean += delta * float64(o.n) / float64(n)
+	m.m2 += o.m2 + delta*delta*float64(m.n)*float64(o.n)/float64(n)
+	m.n = n
+}
+
+// stddev returns the population standard deviation
+func (m *moments) stddev() float64 {
+	if m.n < 2 {
+		return 0
+	}
+	return math.Sqrt(m.m2 / float64(m.n))
+}
+
+// horizonBucket holds the moments of the values of one time bucket
+type horizonBucket struct {
+	num int64 // bucket number, the time divided by the bucket width
+	moments
+}
+
+// HorizonStats tracks the mean and standard deviation of the values observed
+// within a time span of the newest one and scores values against them. The
+// span is split into 60 buckets that keep only the moments of their values,
+// so memory is constant and every value of the span counts however high the
+// ingest rate is. Buckets expire whole, so the horizon covers between 59/60
+// of the span and the whole span.
+type HorizonStats struct {
+	width     time.Duration
+	threshold float64
+
+	// Ring of buckets indexed by bucket number, and the moments of the live ones
+	buckets []horizonBucket
+	newest  int64
+	total   moments
+
+	mu sync.RWMutex
+}
+
+// NewHorizonStats creates statistics over the values observed within span
+// of the newest one, flagging values more than threshold standard deviations
+// from the mean
+func NewHorizonStats(span time.Duration, threshold float64) *HorizonStats {
+	if threshold <= 0 {
+		threshold = DefaultZScoreThreshold
+	}
+	width := span / horizonBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &HorizonStats{
+		width:     width,
+		threshold: threshold,
+		buckets:   make([]horizonBucket, horizonBuckets),
+	}
+}
+
+// AddAt adds a value observed at t and returns whether it's an anomaly
+// against the values before it, and its z-score. Values older than the
+// horizon of the newest one are scored but not added.
+func (hs *HorizonStats) AddAt(t time.Time, value float64) (isAnomaly bool, zscore float64) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	isAnomaly, zscore = hs.score(value)
+
+	num := t.UnixNano() / int64(hs.width)
+	if num > hs.newest {
+		hs.newest = num
+		hs.recompute()
+	}
+	if !hs.live(num) {
+		return isAnomaly, zscore
+	}
+
+	bucket := &hs.buckets[hs.slot(num)]
+	if bucket.num != num {
+		*bucket = horizonBucket{num: num}
+	}
+	bucket.add(value)
+	hs.total.add(value)
+	return isAnomaly, zscore
+}
+
+// slot returns the ring index of a bucket number
+func (hs *HorizonStats) slot(num int64) int {
+	i := int(num % horizonBuckets)
+	if i < 0 {
+		i += horizonBuckets
+	}
+	return i
+}
+
+// live reports whether a bucket number is within the horizon (must hold lock)
+func (hs *HorizonStats) live(num int64) bool {
+	return num > hs.newest-horizonBuckets && num <= hs.newest
+}
+
+// recompute sums the moments of the live buckets, after the horizon moved (must hold lock)
+func (hs *HorizonStats) recompute() {
+	hs.total = moments{}
+	for _, bucket := range hs.buckets {
+		if bucket.n > 0 && hs.live(bucket.num) {
+			hs.total.merge(bucket.moments)
+		}
+	}
+}
+
+// score returns the z-score of a value and whether it's an anomaly (must hold lock)
+func (hs *HorizonStats) score(value float64) (bool, float64) {
+	stddev := hs.total.stddev()
+	if stddev == 0 {
+		return false, 0
+	}
+	zscore := (value - hs.total.mean) / stddev
+	return math.Abs(zscore) > hs.threshold, zscore
+}
+
+// IsAnomaly checks if a value is an anomaly without adding it
+func (hs *HorizonStats) IsAnomaly(value float64) (bool, float64) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	return hs.score(value)
+}
+
+// Stats returns the current mean and standard deviation
+func (hs *HorizonStats) Stats() (mean, stddev float64) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	return hs.total.mean, hs.total.stddev()
+}
+
+// Count returns the number of values within the horizon
+func (hs *HorizonStats) Count() int {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	return hs.total.n
+}
+
+// Covered returns the time span covered by the values within the horizon,
+// from the start of the oldest bucket holding values to the end of the newest
+func (hs *HorizonStats) Covered() time.Duration {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	oldest := hs.newest + 1
+	for _, bucket := range hs.buckets {
+		if bucket.n > 0 && hs.live(bucket.num) && bucket.num < oldest {
+			oldest = bucket.num
+		}
+	}
+	return time.Duration(hs.newest+1-oldest) * hs.width
+}
@@ -0,0 +1,15 @@
+package analytics
+
+import "math"
+
+// DefaultConfidence is the coverage of prediction intervals when none is given
+const DefaultConfidence = 0.95
+
+// normalQuantile returns the two-sided standard normal critical value for a
+// confidence level, e.g. 1.96 for 0.95
+func normalQuantile(confidence float64) float64 {
+	if confidence <= 0 || confidence >= 1 {
+		confidence = DefaultConfidence
+	}
+	return math.Sqrt2 * math.Erfinv(confidence)
+}
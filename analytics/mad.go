@@ -0,0 +1,141 @@
+package analytics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMADThreshold is the customary cut-off for modified z-scores (Iglewicz & Hoaglin)
+	DefaultMADThreshold = 3.5
+
+	// madScale converts MAD to a consistent estimate of the standard deviation
+	// for normally distributed data (0.6745 ≈ Φ⁻¹(0.75))
+	madScale = 0.6745
+
+	// meanADScale is used instead when more than half the window is identical
+	// and MAD collapses to zero (√(π/2) ≈ 1.2533)
+	meanADScale = 1.253314
+)
+
+func init() {
+	RegisterDetector("mad", func(cfg DetectorConfig) Detector {
+		return NewTimedMADDetector(cfg.WindowSpan, cfg.WindowSize, cfg.Threshold)
+	})
+}
+
+// MADDetector detects anomalies using the modified z-score, based on the
+// median and median absolute deviation of a sliding window. Unlike the
+// z-score it is not inflated by the outliers it is trying to catch.
+// The window is kept sorted as values enter and leave it, so scoring a
+// value is O(log n) and adding one costs a binary search and a memmove.
+type MADDetector struct {
+	window    slidingWindow
+	threshold float64
+	mu        sync.RWMutex
+}
+
+// NewMADDetector creates a new median/MAD anomaly detector
+func NewMADDetector(windowSize int, threshold float64) *MADDetector {
+	if threshold <= 0 {
+		threshold = DefaultMADThreshold
+	}
+	md := &MADDetector{
+		window:    newSlidingWindow(windowSize),
+		threshold: threshold,
+	}
+	md.window.keepOrder()
+	return md
+}
+
+// NewTimedMADDetector creates a new median/MAD anomaly detector over the values
+// observed within span of the newest one, holding at most maxSize values.
+// A zero span falls back to a window of the last maxSize values.
+func NewTimedMADDetector(span time.Duration, maxSize int, threshold float64) *MADDetector {
+	if threshold <= 0 {
+		threshold = DefaultMADThreshold
+	}
+	md := &MADDetector{
+		window:    newTimeWindow(span, maxSize),
+		threshold: threshold,
+	}
+	md.window.keepOrder()
+	return md
+}
+
+// Add adds a value observed now and returns whether it's an anomaly
+func (md *MADDetector) Add(value float64) (isAnomaly bool, score float64) {
+	return md.AddAt(time.Now(), value)
+}
+
+// AddAt adds a value observed at t and returns whether it's an anomaly
+func (md *MADDetector) AddAt(t time.Time, value float64) (isAnomaly bool, score float64) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	// Calculate score before adding the new value
+	score = modifiedZScore(md.window.order, value)
+	isAnomaly = math.Abs(score) > md.threshold
+
+	md.window.pushAt(t, value)
+
+	return isAnomaly, score
+}
+
+// IsAnomaly checks if a value is an anomaly without adding it
+func (md *MADDetector) IsAnomaly(value float64) (bool, float64) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	score := modifiedZScore(md.window.order, value)
+	return math.Abs(score) > md.threshold, score
+}
+
+// Stats returns the current median and MAD scaled to a standard deviation estimate
+func (md *MADDetector) Stats() (median, spread float64) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	median, mad := md.window.order.medianAbsDeviation()
+	return median, mad / madScale
+}
+
+// Count returns the number of values in the window
+func (md *MADDetector) Count() int {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return md.window.len()
+}
+
+// Threshold returns the configured threshold
+func (md *MADDetector) Threshold() float64 {
+	return md.threshold
+}
+
+// Reset clears all values from the window
+func (md *MADDetector) Reset() {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.window.reset()
+}
+
+// modifiedZScore computes the modified z-score of value against the sorted
+// values of a window: 0.6745 * (value - median) / MAD. When MAD is zero the
+// mean absolute deviation is used instead; if that is zero too the score is 0.
+func modifiedZScore(sorted *sortedValues, value float64) float64 {
+	if sorted.len() < 2 {
+		return 0
+	}
+
+	median, mad := sorted.medianAbsDeviation()
+	if mad != 0 {
+		return madScale * (value - median) / mad
+	}
+
+	meanAD := sorted.meanAbsDeviation(median)
+	if meanAD == 0 {
+		return 0
+	}
+	return (value - median) / (meanAD * meanADScale)
+}
@@ -0,0 +1,125 @@
+package analytics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// naiveMedian returns the median of values by sorting a copy
+func naiveMedian(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// naiveMAD returns the median and the median absolute deviation of values
+func naiveMAD(values []float64) (median, mad float64) {
+	median = naiveMedian(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	return median, naiveMedian(deviations)
+}
+
+// naiveModifiedZScore is modifiedZScore recomputed from an unsorted window
+func naiveModifiedZScore(values []float64, value float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	median, mad := naiveMAD(values)
+	if mad != 0 {
+		return madScale * (value - median) / mad
+	}
+	meanAD := 0.0
+	for _, v := range values {
+		meanAD += math.Abs(v - median)
+	}
+	meanAD /= float64(len(values))
+	if meanAD == 0 {
+		return 0
+	}
+	return (value - median) / (meanAD * meanADScale)
+}
+
+func TestSortedValuesMatchesNaive(t *testing.T) {
+	tests := []struct {
+		name   string
+		levels int // values are drawn from this many integers, 0 for continuous
+		limit  int
+	}{
+		{"continuous", 0, 64},
+		{"few distinct values", 3, 64},
+		{"mostly identical", 1, 15},
+		{"small", 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(tt.limit + tt.levels)))
+			var s sortedValues
+			var ref []float64
+
+			for i := 0; i < 5000; i++ {
+				if len(ref) > 0 && (len(ref) >= tt.limit || rng.Intn(3) == 0) {
+					j := rng.Intn(len(ref))
+					s.remove(ref[j])
+					ref = append(ref[:j], ref[j+1:]...)
+				} else {
+					v := rng.NormFloat64() * 10
+					if tt.levels > 0 {
+						v = float64(rng.Intn(tt.levels))
+					}
+					s.insert(v)
+					ref = append(ref, v)
+				}
+
+				if !sort.Float64sAreSorted(s.values) || s.len() != len(ref) {
+					t.Fatalf("step %d: values %v not a sorted copy of %v", i, s.values, ref)
+				}
+				median, mad := s.medianAbsDeviation()
+				wantMedian, wantMAD := naiveMAD(ref)
+				if median != wantMedian || mad != wantMAD {
+					t.Fatalf("step %d: medianAbsDeviation = (%v, %v), want (%v, %v)", i, median, mad, wantMedian, wantMAD)
+				}
+			}
+		})
+	}
+}
+
+func TestMADDetectorMatchesNaive(t *testing.T) {
+	for _, tt := range windowCases {
+		t.Run(tt.name, func(t *testing.T) {
+			md := NewTimedMADDetector(tt.span, tt.size, 0)
+			ref := &naiveWindow{span: tt.span, limit: tt.size}
+
+			for i, s := range tt.samples {
+				_, score := md.AddAt(s.t, s.value)
+				want := naiveModifiedZScore(ref.values, s.value)
+				if !closeTo(score, want, 1e-9) {
+					t.Fatalf("sample %d: score = %v, want %v", i, score, want)
+				}
+				ref.push(s.t, s.value)
+
+				if md.Count() != len(ref.values) {
+					t.Fatalf("sample %d: count = %d, want %d", i, md.Count(), len(ref.values))
+				}
+			}
+
+			median, spread := md.Stats()
+			wantMedian, wantMAD := naiveMAD(ref.values)
+			if median != wantMedian || !closeTo(spread, wantMAD/madScale, 1e-12) {
+				t.Fatalf("stats = (%v, %v), want (%v, %v)", median, spread, wantMedian, wantMAD/madScale)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package analytics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// quantileAccuracy is the relative error of quantile estimates
+	quantileAccuracy = 0.01
+
+	// quantileMinValue is the smallest magnitude told apart from zero
+	quantileMinValue = 1e-9
+
+	// quantileSlices is the number of sub-histograms a sketch window is split
+	// into; the oldest is dropped as a whole when the window moves on
+	quantileSlices = 4
+
+	// quantileMaxBuckets bounds the buckets of each sign of a histogram,
+	// 16 KiB of counts covering magnitudes over a range of about 10^17
+	quantileMaxBuckets = 2048
+)
+
+var (
+	quantileGamma    = (1 + quantileAccuracy) / (1 - quantileAccuracy)
+	quantileLogGamma = math.Log(quantileGamma)
+)
+
+// bucketStore holds the counts of a contiguous range of at most
+// quantileMaxBuckets bucket indexes, growing the range on demand. Beyond
+// that the lowest buckets are collapsed into one, so only estimates of the
+// smallest magnitudes lose accuracy.
+type bucketStore struct {
+	counts []int64
+	offset int // bucket index of counts[0]
+}
+
+// add adds n to the count of bucket index
+func (s *bucketStore) add(index int, n int64) {
+	if len(s.counts) == 0 {
+		s.counts = append(s.counts[:0], 0)
+		s.offset = index
+	}
+	if index < s.offset {
+		// Indexes below the bounded range are counted in its lowest bucket
+		if grow := min(s.offset-index, quantileMaxBuckets-len(s.counts)); grow > 0 {
+			grown := make([]int64, len(s.counts)+grow)
+			copy(grown[grow:], s.counts)
+			s.counts, s.offset = grown, s.offset-grow
+		}
+		index = max(index, s.offset)
+	}
+	if shift := index - s.offset + 1 - quantileMaxBuckets; shift > 0 {
+		s.collapse(shift)
+	}
+	for index-s.offset >= len(s.counts) {
+		s.counts = append(s.counts, 0)
+	}
+	s.counts[index-s.offset] += n
+}
+
+// collapse raises the lowest bucket index by shift, adding the counts of the
+// buckets below it to the new lowest bucket
+func (s *bucketStore) collapse(shift int) {
+	var merged int64
+	for i := 0; i < shift && i < len(s.counts); i++ {
+		merged += s.counts[i]
+	}
+	if shift < len(s.counts) {
+		s.counts = s.counts[:copy(s.counts, s.counts[shift:])]
+	} else {
+		s.counts = s.counts[:1]
+		s.counts[0] = 0
+	}
+	s.counts[0] += merged
+	s.offset += shift
+}
+
+// addStore adds (sign 1) or subtracts (sign -1) the counts of another store
+func (s *bucketStore) addStore(other *bucketStore, sign int64) {
+	for i, n := range other.counts {
+		if n != 0 {
+			s.add(other.offset+i, sign*n)
+		}
+	}
+}
+
+// reset clears the counts, keeping the buffer; the next count sets the range
+func (s *bucketStore) reset() {
+	s.counts = s.counts[:0]
+}
+
+// QuantileHistogram estimates quantiles from log-spaced buckets: a value v is
+// counted in bucket ⌈log_γ |v|⌉, so every estimate is within 1% of a value of
+// the requested rank. Histograms of several streams merge exactly by adding
+// their counts, which is how group quantiles are computed. Unlike a t-digest
+// or P² estimator, it bounds the relative error of every quantile, merges
+// without loss and supports the removals of a sliding window; at most
+// quantileMaxBuckets buckets per sign bound its memory, beyond which the
+// smallest magnitudes are collapsed.
+//
+// QuantileHistogram is not safe for concurrent use.
+type QuantileHistogram struct {
+	positive bucketStore
+	negative bucketStore
+	zero     int64
+	count    int64
+}
+
+// quantileIndex returns the bucket index of a magnitude
+func quantileIndex(magnitude float64) int {
+	return int(math.Ceil(math.Log(magnitude) / quantileLogGamma))
+}
+
+// quantileValue returns the representative magnitude of a bucket index,
+// the value with equal relative error to both bucket bounds
+func quantileValue(index int) float64 {
+	return 2 * math.Pow(quantileGamma, float64(index)) / (quantileGamma + 1)
+}
+
+// Add adds a value to the histogram
+func (h *QuantileHistogram) Add(value float64) {
+	h.add(value, 1)
+}
+
+// add adds (n 1) or removes (n -1) a value
+func (h *QuantileHistogram) add(value float64, n int64) {
+	switch {
+	case math.IsNaN(value):
+		return
+	case value > quantileMinValue:
+		h.positive.add(quantileIndex(math.Min(value, math.MaxFloat64)), n)
+	case value < -quantileMinValue:
+		h.negative.add(quantileIndex(math.Min(-value, math.MaxFloat64)), n)
+	default:
+		h.zero += n
+	}
+	h.count += n
+}
+
+// Merge adds the counts of another histogram
+func (h *QuantileHistogram) Merge(other *QuantileHistogram) {
+	h.combine(other, 1)
+}
+
+// combine adds (sign 1) or subtracts (sign -1) the counts of another histogram
+func (h *QuantileHistogram) combine(other *QuantileHistogram, sign int64) {
+	h.positive.addStore(&other.positive, sign)
+	h.negative.addStore(&other.negative, sign)
+	h.zero += sign * other.zero
+	h.count += sign * other.count
+}
+
+// Count returns the number of values in the histogram
+func (h *QuantileHistogram) Count() int {
+	return int(h.count)
+}
+
+// Quantile returns the estimate of quantile p (0 <= p <= 1), or 0 if the
+// histogram is empty
+func (h *QuantileHistogram) Quantile(p float64) float64 {
+	if h.count <= 0 {
+		return 0
+	}
+	p = math.Max(0, math.Min(1, p))
+	rank := int64(p * float64(h.count-1))
+
+	// Negative values from the largest magnitude, then zeros, then positive
+	// values from the smallest magnitude
+	seen := int64(0)
+	for i := len(h.negative.counts) - 1; i >= 0; i-- {
+		if seen += h.negative.counts[i]; seen > rank {
+			return -quantileValue(h.negative.offset + i)
+		}
+	}
+	if seen += h.zero; seen > rank {
+		return 0
+	}
+	for i, n := range h.positive.counts {
+		if seen += n; seen > rank {
+			return quantileValue(h.positive.offset + i)
+		}
+	}
+	return 0
+}
+
+// reset clears the histogram, keeping its buffers
+func (h *QuantileHistogram) reset() {
+	h.positive.reset()
+	h.negative.reset()
+	h.zero, h.count = 0, 0
+}
+
+// QuantileSketch estimates quantiles of the recent values of a stream, either
+// the last N samples or the samples of the last time span. The window is
+// split into slices of a quarter each; when the newest slice is full (N/4
+// samples, or span/4 of time) the oldest slice is dropped, so estimates cover
+// between three quarters of the window and the whole window. Memory grows
+// with the range of the values up to quantileMaxBuckets per histogram, not
+// with the number of samples, and adding a value is O(1).
+type QuantileSketch struct {
+	// Slices of the window, slices[head] the newest, and their sum
+	slices []QuantileHistogram
+	head   int
+	total  QuantileHistogram
+
+	// Bounds of the newest slice; span is 0 for count-based windows
+	perSlice int
+	span     time.Duration
+	started  time.Time
+
+	mu sync.RWMutex
+}
+
+// NewQuantileSketch creates a sketch over the last size values
+func NewQuantileSketch(size int) *QuantileSketch {
+	return NewTimedQuantileSketch(0, size)
+}
+
+// NewTimedQuantileSketch creates a sketch over the values observed within
+// span of the newest one, holding at most maxSize values. A span of 0 makes
+// a sketch over the last maxSize values.
+func NewTimedQuantileSketch(span time.Duration, maxSize int) *QuantileSketch {
+	if maxSize <= 0 {
+		maxSize = DefaultWindowSize
+	}
+	return &QuantileSketch{
+		slices:   make([]QuantileHistogram, quantileSlices),
+		perSlice: (maxSize + quantileSlices - 1) / quantileSlices,
+		span:     span / quantileSlices,
+	}
+}
+
+// Add adds a value observed now to the sketch
+func (qs *QuantileSketch) Add(value float64) {
+	qs.AddAt(time.Now(), value)
+}
+
+// AddAt adds a value observed at t to the sketch
+func (qs *QuantileSketch) AddAt(t time.Time, value float64) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	if qs.started.IsZero() {
+		qs.started = t
+	}
+	if qs.span > 0 {
+		// Drop the slices that ended before t, all of them after a long gap
+		for i := 0; i < quantileSlices && !t.Before(qs.started.Add(qs.span)); i++ {
+			qs.rotate()
+			qs.started = qs.started.Add(qs.span)
+		}
+		if !t.Before(qs.started.Add(qs.span)) {
+			qs.started = t
+		}
+	}
+	if qs.slices[qs.head].Count() >= qs.perSlice {
+		qs.rotate()
+		qs.started = t
+	}
+
+	qs.slices[qs.head].add(value, 1)
+	qs.total.add(value, 1)
+}
+
+// rotate starts a new slice in place of the oldest (must hold lock)
+func (qs *QuantileSketch) rotate() {
+	qs.head = (qs.head + 1) % len(qs.slices)
+	oldest := &qs.slices[qs.head]
+	qs.total.combine(oldest, -1)
+	oldest.reset()
+}
+
+// Quantile returns the estimate of quantile p (0 <= p <= 1) over the window
+func (qs *QuantileSketch) Quantile(p float64) float64 {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	return qs.total.Quantile(p)
+}
+
+// MergeInto adds the values of the window to a histogram
+func (qs *QuantileSketch) MergeInto(h *QuantileHistogram) {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	h.Merge(&qs.total)
+}
+
+// Count returns the number of values in the window
+func (qs *QuantileSketch) Count() int {
+	qs.mu.RLock()
+	defer qs.mu.RUnlock()
+	return qs.total.Count()
+}
+
+// Reset clears the sketch
+func (qs *QuantileSketch) Reset() {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	for i := range qs.slices {
+		qs.slices[i].reset()
+	}
+	qs.total.reset()
+	qs.head = 0
+	qs.started = time.Time{}
+}
@@ -0,0 +1,232 @@
+package analytics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testQuantiles are the quantiles checked against the naive value
+var testQuantiles = []float64{0, 0.01, 0.25, 0.5, 0.9, 0.95, 0.99, 1}
+
+// naiveQuantile returns the value of the rank a QuantileHistogram estimates
+func naiveQuantile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// checkQuantiles fails the test if an estimate is not within the sketch
+// accuracy of the naive quantile of values
+func checkQuantiles(t *testing.T, step int, quantile func(float64) float64, values []float64) {
+	t.Helper()
+	for _, p := range testQuantiles {
+		got, want := quantile(p), naiveQuantile(values, p)
+		if math.Abs(got-want) > quantileAccuracy*math.Abs(want)*(1+1e-9)+quantileMinValue {
+			t.Fatalf("step %d: quantile(%v) = %v, want %v within %v%%", step, p, got, want, quantileAccuracy*100)
+		}
+	}
+}
+
+// spreadValues returns n values mixing signs, zeros and magnitudes from 1e-6 to 1e6
+func spreadValues(seed int64, n int) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	values := make([]float64, n)
+	for i := range values {
+		switch rng.Intn(10) {
+		case 0:
+			values[i] = 0
+		case 1, 2, 3:
+			values[i] = -math.Pow(10, rng.Float64()*12-6)
+		default:
+			values[i] = math.Pow(10, rng.Float64()*12-6)
+		}
+	}
+	return values
+}
+
+func TestQuantileHistogramMatchesNaive(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+	}{
+		{"normal", sampleValues(randomSamples(20, 5000, 100, 15))},
+		{"around zero", sampleValues(randomSamples(21, 5000, 0, 1))},
+		{"signs zeros and magnitudes", spreadValues(22, 5000)},
+		{"duplicates", sampleValues(duplicateSamples(23, 1000))},
+		{"single value", []float64{42}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h QuantileHistogram
+			for i, v := range tt.values {
+				h.Add(v)
+				if i%97 == 0 || i == len(tt.values)-1 {
+					checkQuantiles(t, i, h.Quantile, tt.values[:i+1])
+				}
+			}
+			if h.Count() != len(tt.values) {
+				t.Fatalf("count = %d, want %d", h.Count(), len(tt.values))
+			}
+		})
+	}
+}
+
+func TestQuantileHistogramMerge(t *testing.T) {
+	values := spreadValues(24, 3000)
+	var whole, merged QuantileHistogram
+	parts := make([]QuantileHistogram, 3)
+	for i, v := range values {
+		whole.Add(v)
+		parts[i%len(parts)].Add(v)
+	}
+	for i := range parts {
+		merged.Merge(&parts[i])
+	}
+
+	if merged.Count() != whole.Count() {
+		t.Fatalf("merged count = %d, want %d", merged.Count(), whole.Count())
+	}
+	for _, p := range testQuantiles {
+		if got, want := merged.Quantile(p), whole.Quantile(p); got != want {
+			t.Fatalf("merged quantile(%v) = %v, want %v", p, got, want)
+		}
+	}
+	checkQuantiles(t, len(values), merged.Quantile, values)
+}
+
+func TestQuantileSketchCountWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		values []float64
+	}{
+		{"random", 100, sampleValues(randomSamples(25, 3000, 50, 10))},
+		{"size not a multiple of the slices", 37, spreadValues(26, 3000)},
+		{"eviction heavy", 4, sampleValues(randomSamples(27, 3000, 0, 5))},
+		{"level shift", 200, append(sampleValues(randomSamples(28, 1000, 10, 1)), sampleValues(randomSamples(29, 1000, 1000, 1))...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs := NewQuantileSketch(tt.size)
+			perSlice := (tt.size + quantileSlices - 1) / quantileSlices
+
+			for i, v := range tt.values {
+				qs.AddAt(testEpoch, v)
+				n := qs.Count()
+
+				// The sketch holds the newest values, dropping a slice at a time
+				if lo, hi := min(i+1, (quantileSlices-1)*perSlice+1), quantileSlices*perSlice; n < lo || n > hi {
+					t.Fatalf("step %d: count = %d, want between %d and %d", i, n, lo, hi)
+				}
+				checkQuantiles(t, i, qs.Quantile, tt.values[i+1-n:i+1])
+			}
+		})
+	}
+}
+
+func TestQuantileSketchTimeWindow(t *testing.T) {
+	gapped := irregularSamples(30, 5000)
+	sort.SliceStable(gapped, func(i, j int) bool { return gapped[i].t.Before(gapped[j].t) })
+
+	tests := []struct {
+		name    string
+		span    time.Duration
+		samples []sample
+	}{
+		{"regular", 40 * time.Second, randomSamples(31, 3000, 50, 10)},
+		{"gaps", 20 * time.Second, gapped},
+		{"span shorter than a sample interval", 2 * time.Second, randomSamples(32, 500, 0, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs := NewTimedQuantileSketch(tt.span, 1_000_000)
+
+			for i, s := range tt.samples {
+				qs.AddAt(s.t, s.value)
+				n := qs.Count()
+				kept := tt.samples[i+1-n : i+1]
+
+				// Estimates cover between the last three quarters of the span
+				// and the whole span
+				if oldest := kept[0].t; !oldest.After(s.t.Add(-tt.span)) {
+					t.Fatalf("step %d: keeps a value from %v, older than the span", i, s.t.Sub(oldest))
+				}
+				if i+1 > n {
+					if dropped := tt.samples[i-n].t; !dropped.Before(s.t.Add(-tt.span * (quantileSlices - 1) / quantileSlices)) {
+						t.Fatalf("step %d: dropped a value from %v, within three quarters of the span", i, s.t.Sub(dropped))
+					}
+				}
+				checkQuantiles(t, i, qs.Quantile, sampleValues(kept))
+			}
+		})
+	}
+}
+
+func TestQuantileHistogramBoundedBuckets(t *testing.T) {
+	// A few values far below the rest force the lowest buckets to collapse
+	values := sampleValues(randomSamples(34, 2000, 1e6, 1e5))
+	for i := 0; i < len(values); i += 50 {
+		values[i] = 1e-250
+	}
+
+	var h QuantileHistogram
+	for _, v := range values {
+		h.Add(v)
+	}
+	if n := len(h.positive.counts); n > quantileMaxBuckets {
+		t.Fatalf("histogram holds %d buckets, want at most %d", n, quantileMaxBuckets)
+	}
+	if h.Count() != len(values) {
+		t.Fatalf("count = %d, want %d", h.Count(), len(values))
+	}
+	for _, p := range []float64{0.05, 0.25, 0.5, 0.95, 0.99, 1} {
+		if got, want := h.Quantile(p), naiveQuantile(values, p); !closeTo(got, want, quantileAccuracy) {
+			t.Fatalf("quantile(%v) = %v, want %v", p, got, want)
+		}
+	}
+
+	// Once the collapsed values leave the window, estimates are exact again
+	qs := NewQuantileSketch(400)
+	for _, v := range values {
+		qs.AddAt(testEpoch, v)
+	}
+	rest := sampleValues(randomSamples(35, 1000, 1e6, 1e5))
+	for i, v := range rest {
+		qs.AddAt(testEpoch, v)
+		if i >= 400 {
+			n := qs.Count()
+			checkQuantiles(t, i, qs.Quantile, rest[i+1-n:i+1])
+		}
+	}
+}
+
+func TestQuantileSketchReset(t *testing.T) {
+	qs := NewTimedQuantileSketch(time.Minute, 100)
+	for _, s := range randomSamples(33, 300, 10, 2) {
+		qs.AddAt(s.t, s.value)
+	}
+	qs.Reset()
+	if qs.Count() != 0 || qs.Quantile(0.5) != 0 {
+		t.Fatalf("after reset: count %d, median %v", qs.Count(), qs.Quantile(0.5))
+	}
+
+	qs.AddAt(testEpoch, 7)
+	if qs.Count() != 1 || !closeTo(qs.Quantile(0.5), 7, quantileAccuracy) {
+		t.Fatalf("after refill: count %d, median %v", qs.Count(), qs.Quantile(0.5))
+	}
+}
+
+// sampleValues returns the values of samples
+func sampleValues(samples []sample) []float64 {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = s.value
+	}
+	return values
+}
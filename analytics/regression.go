@@ -0,0 +1,168 @@
+package analytics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRegressionThreshold is the anomaly threshold on standardized residuals
+	DefaultRegressionThreshold = 3.0
+
+	// regressionMinSamples is the number of pairs required before scoring
+	regressionMinSamples = 10
+)
+
+// RollingRegression fits y ~ a + b·x by least squares over a sliding window
+// of (x, y) pairs and scores new pairs by their standardized residual, i.e.
+// how far y is from the value expected for x, in prediction standard errors.
+// The window holds either the last N pairs or the pairs observed within a
+// time span of the newest one, like the other windows.
+//
+// It catches joint anomalies that univariate detectors miss: a CPU reading
+// that is normal on its own but high for the current request rate.
+//
+// The pairs are kept as three windows of x, y and x+y values pushed in
+// lockstep, so they evict the same pairs. Their means and sums of squared
+// deviations are maintained in O(1) by the windows, and the co-moment follows
+// from M2(x+y) = M2(x) + M2(y) + 2·C(x, y).
+type RollingRegression struct {
+	x, y, sum slidingWindow
+	threshold float64
+
+	mu sync.RWMutex
+}
+
+// NewRollingRegression creates a regression over the last windowSize pairs
+func NewRollingRegression(windowSize int, threshold float64) *RollingRegression {
+	return NewTimedRollingRegression(0, windowSize, threshold)
+}
+
+// NewTimedRollingRegression creates a regression over the pairs observed
+// within span of the newest one, holding at most maxSize pairs. A zero span
+// falls back to a window of the last maxSize pairs.
+func NewTimedRollingRegression(span time.Duration, maxSize int, threshold float64) *RollingRegression {
+	if threshold <= 0 {
+		threshold = DefaultRegressionThreshold
+	}
+	return &RollingRegression{
+		x:         newTimeWindow(span, maxSize),
+		y:         newTimeWindow(span, maxSize),
+		sum:       newTimeWindow(span, maxSize),
+		threshold: threshold,
+	}
+}
+
+// Add scores a pair observed now against the current fit, then adds it to
+// the window
+func (rr *RollingRegression) Add(x, y float64) (isAnomaly bool, score, expected float64) {
+	return rr.AddAt(time.Now(), x, y)
+}
+
+// AddAt scores a pair observed at t against the current fit, then adds it to
+// the window. It returns whether the pair is an anomaly, its standardized
+// residual and the value of y expected for x.
+func (rr *RollingRegression) AddAt(t time.Time, x, y float64) (isAnomaly bool, score, expected float64) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	score, expected, _ = rr.score(x, y)
+	isAnomaly = math.Abs(score) > rr.threshold
+
+	rr.x.pushAt(t, x)
+	rr.y.pushAt(t, y)
+	rr.sum.pushAt(t, x+y)
+	return isAnomaly, score, expected
+}
+
+// IsAnomaly scores a pair against the current fit without adding it
+func (rr *RollingRegression) IsAnomaly(x, y float64) (isAnomaly bool, score, expected float64) {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	score, expected, _ = rr.score(x, y)
+	return math.Abs(score) > rr.threshold, score, expected
+}
+
+// Predict returns the value of y expected for x and its prediction standard error
+func (rr *RollingRegression) Predict(x float64) (expected, stderr float64) {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	_, expected, stderr = rr.score(x, 0)
+	return expected, stderr
+}
+
+// Fit returns the current intercept and slope of y ~ a + b·x
+func (rr *RollingRegression) Fit() (intercept, slope float64) {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return rr.fit()
+}
+
+// moments returns the means of x and y, their sums of squared deviations
+// and the sum of cross deviations (must hold lock)
+func (rr *RollingRegression) moments() (meanX, meanY, cxx, cyy, cxy float64) {
+	cxx, cyy = rr.x.m2, rr.y.m2
+	return rr.x.mean, rr.y.mean, cxx, cyy, (rr.sum.m2 - cxx - cyy) / 2
+}
+
+// fit returns the intercept and slope (must hold lock)
+func (rr *RollingRegression) fit() (intercept, slope float64) {
+	meanX, meanY, cxx, _, cxy := rr.moments()
+	if cxx > 0 {
+		slope = cxy / cxx
+	}
+	return meanY - slope*meanX, slope
+}
+
+// score returns the standardized residual of a pair, the expected y and the
+// prediction standard error (must hold lock). When x has not varied over the
+// window the fit degenerates to the mean of y.
+func (rr *RollingRegression) score(x, y float64) (score, expected, stderr float64) {
+	intercept, slope := rr.fit()
+	expected = intercept + slope*x
+	if rr.x.len() < regressionMinSamples {
+		return 0, expected, 0
+	}
+
+	meanX, _, cxx, cyy, cxy := rr.moments()
+	n := float64(rr.x.len())
+	sse := cyy
+	if cxx > 0 {
+		sse -= cxy * cxy / cxx
+	}
+	if sse <= 0 {
+		return 0, expected, 0
+	}
+
+	variance := sse / (n - 2) * (1 + 1/n)
+	if cxx > 0 {
+		dx := x - meanX
+		variance += sse / (n - 2) * dx * dx / cxx
+	}
+	stderr = math.Sqrt(variance)
+	return (y - expected) / stderr, expected, stderr
+}
+
+// Count returns the number of pairs in the window
+func (rr *RollingRegression) Count() int {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return rr.x.len()
+}
+
+// Threshold returns the configured threshold
+func (rr *RollingRegression) Threshold() float64 {
+	return rr.threshold
+}
+
+// Reset clears all pairs from the window
+func (rr *RollingRegression) Reset() {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.x.reset()
+	rr.y.reset()
+	rr.sum.reset()
+}
@@ -2,89 +2,101 @@ package analytics
 
 import (
 	"sync"
+	"time"
 )
 
 const DefaultWindowSize = 50
 
-// RollingAverage calculates rolling average over a sliding window
+// RollingAverage calculates rolling average over a sliding window, either the
+// last N samples or the samples of the last time span.
+// Adding a value and reading the average are O(1) in the window size.
 type RollingAverage struct {
-	window []float64
-	size   int
+	window slidingWindow
 	mu     sync.RWMutex
 }
 
 // NewRollingAverage creates a new RollingAverage with specified window size
 func NewRollingAverage(size int) *RollingAverage {
-	if size <= 0 {
-		size = DefaultWindowSize
-	}
-	return &RollingAverage{
-		window: make([]float64, 0, size),
-		size:   size,
-	}
+	return &RollingAverage{window: newSlidingWindow(size)}
 }
 
-// Add adds a value to the window and returns the current average
-func (ra *RollingAverage) Add(value float64) float64 {
-	ra.mu.Lock()
-	defer ra.mu.Unlock()
-
-	// Remove oldest value if window is full
-	if len(ra.window) >= ra.size {
-		ra.window = ra.window[1:]
-	}
-	ra.window = append(ra.window, value)
+// NewTimedRollingAverage creates a new RollingAverage over the samples observed
+// within span of the newest one, holding at most maxSize samples
+func NewTimedRollingAverage(span time.Duration, maxSize int) *RollingAverage {
+	return &RollingAverage{window: newTimeWindow(span, maxSize)}
+}
 
-	return ra.calculateAverage()
+// Add adds a value observed now to the window and returns the current average
+func (ra *RollingAverage) Add(value float64) float64 {
+	return ra.AddAt(time.Now(), value)
 }
 
-// calculateAverage computes the average of values in window (must hold lock)
-func (ra *RollingAverage) calculateAverage() float64 {
-	if len(ra.window) == 0 {
-		return 0
-	}
+// AddAt adds a value observed at t to the window and returns the current average
+func (ra *RollingAverage) AddAt(t time.Time, value float64) float64 {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
 
-	sum := 0.0
-	for _, v := range ra.window {
-		sum += v
-	}
-	return sum / float64(len(ra.window))
+	ra.window.pushAt(t, value)
+	return ra.window.average()
 }
 
 // GetAverage returns the current rolling average
 func (ra *RollingAverage) GetAverage() float64 {
 	ra.mu.RLock()
 	defer ra.mu.RUnlock()
-	return ra.calculateAverage()
+	return ra.window.average()
 }
 
-// GetValues returns a copy of current window values
+// GetValues returns a copy of current window values, oldest first
 func (ra *RollingAverage) GetValues() []float64 {
 	ra.mu.RLock()
 	defer ra.mu.RUnlock()
+	return ra.window.values()
+}
 
-	result := make([]float64, len(ra.window))
-	copy(result, ra.window)
-	return result
+// ZScore returns the z-score of a value against the window without adding
+// it, or 0 while the window has no spread
+func (ra *RollingAverage) ZScore(value float64) float64 {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+
+	stddev := ra.window.stddev()
+	if stddev == 0 {
+		return 0
+	}
+	return (value - ra.window.average()) / stddev
+}
+
+// Replay calls fn for each value in the window with the time it was
+// observed, oldest first, e.g. to seed other analytics from the window
+func (ra *RollingAverage) Replay(fn func(t time.Time, value float64)) {
+	ra.mu.RLock()
+	defer ra.mu.RUnlock()
+	ra.window.eachAt(fn)
 }
 
 // Count returns the number of values in the window
 func (ra *RollingAverage) Count() int {
 	ra.mu.RLock()
 	defer ra.mu.RUnlock()
-	return len(ra.window)
+	return ra.window.len()
 }
 
-// WindowSize returns the configured window size
+// WindowSize returns the configured window size, the sample limit of time-based windows
 func (ra *RollingAverage) WindowSize() int {
-	return ra.size
+	return ra.window.size()
+}
+
+// WindowSpan returns the time span of a time-based window, or 0
+func (ra *RollingAverage) WindowSpan() time.Duration {
+	return ra.window.span
 }
 
 // Reset clears all values from the window
 func (ra *RollingAverage) Reset() {
 	ra.mu.Lock()
 	defer ra.mu.Unlock()
-	ra.window = make([]float64, 0, ra.size)
+	ra.window.reset()
 }
 
 // GetPrediction returns the rolling average as a simple prediction
@@ -0,0 +1,114 @@
+package analytics
+
+import (
+	"math"
+	"sort"
+)
+
+// sortedValues keeps the values of a window in ascending order, so that its
+// median and median absolute deviation can be read in O(log n) instead of
+// sorting the window for every score. Inserting or removing a value is a
+// binary search and a single memmove of the tail.
+//
+// sortedValues is not safe for concurrent use; callers hold their own lock.
+type sortedValues struct {
+	values []float64
+}
+
+// insert adds a value
+func (s *sortedValues) insert(value float64) {
+	i := sort.SearchFloat64s(s.values, value)
+	s.values = append(s.values, 0)
+	copy(s.values[i+1:], s.values[i:])
+	s.values[i] = value
+}
+
+// remove removes one occurrence of a value, if present
+func (s *sortedValues) remove(value float64) {
+	i := sort.SearchFloat64s(s.values, value)
+	if i < len(s.values) && s.values[i] == value {
+		s.values = append(s.values[:i], s.values[i+1:]...)
+	}
+}
+
+// reset removes all values, keeping the buffer
+func (s *sortedValues) reset() {
+	s.values = s.values[:0]
+}
+
+// len returns the number of values
+func (s *sortedValues) len() int {
+	return len(s.values)
+}
+
+// median returns the median of the values, or 0 if there are none
+func (s *sortedValues) median() float64 {
+	n := len(s.values)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return s.values[n/2]
+	}
+	return (s.values[n/2-1] + s.values[n/2]) / 2
+}
+
+// medianAbsDeviation returns the median of the values and the median of the
+// absolute deviations from it. The deviations of the values below and above
+// the median form two sorted sequences, so their median is a selection over
+// two sorted sequences rather than a sort.
+func (s *sortedValues) medianAbsDeviation() (median, mad float64) {
+	n := len(s.values)
+	if n == 0 {
+		return 0, 0
+	}
+	median = s.median()
+	split := sort.SearchFloat64s(s.values, median)
+	if n%2 == 1 {
+		return median, s.kthDeviation(median, split, n/2)
+	}
+	return median, (s.kthDeviation(median, split, n/2-1) + s.kthDeviation(median, split, n/2)) / 2
+}
+
+// kthDeviation returns the k-th smallest (0-based) absolute deviation from
+// median, given the index split of the first value not below the median
+func (s *sortedValues) kthDeviation(median float64, split, k int) float64 {
+	// Deviations of the values below the median, nearest first, and of the
+	// values from the median up, nearest first; both are ascending
+	below := func(i int) float64 { return median - s.values[split-1-i] }
+	above := func(j int) float64 { return s.values[split+j] - median }
+	nBelow, nAbove := split, len(s.values)-split
+
+	// Find how many of the k+1 smallest deviations come from below
+	lo, hi := max(0, k+1-nAbove), min(k+1, nBelow)
+	for lo < hi {
+		i := (lo + hi) / 2
+		if j := k + 1 - i; j > 0 && below(i) < above(j-1) {
+			lo = i + 1
+		} else {
+			hi = i
+		}
+	}
+
+	i, j := lo, k+1-lo
+	deviation := math.Inf(-1)
+	if i > 0 {
+		deviation = below(i - 1)
+	}
+	if j > 0 {
+		deviation = max(deviation, above(j-1))
+	}
+	return deviation
+}
+
+// meanAbsDeviation returns the mean absolute deviation of the values from median
+func (s *sortedValues) meanAbsDeviation(median float64) float64 {
+	if len(s.values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range s.values {
+		sum += math.Abs(v - median)
+	}
+	return sum / float64(len(s.values))
+}
@@ -0,0 +1,117 @@
+package analytics
+
+import (
+	"math"
+)
+
+// minTrendSamples is the minimum number of points for a trend fit
+const minTrendSamples = 3
+
+// LinearTrend is an ordinary least squares fit of value = Intercept + Slope*x
+type LinearTrend struct {
+	Slope       float64
+	Intercept   float64
+	SlopeStdErr float64
+	RSquared    float64
+	N           int
+
+	// XLast is the x coordinate of the most recent point
+	XLast float64
+}
+
+// FitLinearTrend fits a straight line through the points (xs[i], ys[i]).
+// It returns false if there are fewer than three points or all xs are equal.
+func FitLinearTrend(xs, ys []float64) (LinearTrend, bool) {
+	n := len(xs)
+	if n != len(ys) || n < minTrendSamples {
+		return LinearTrend{}, false
+	}
+
+	var sumX, sumY, xLast float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		if i == 0 || xs[i] > xLast {
+			xLast = xs[i]
+		}
+	}
+	meanX := sumX / float64(n)
+	meanY := sumY / float64(n)
+
+	var sxx, sxy, syy float64
+	for i := range xs {
+		dx := xs[i] - meanX
+		dy := ys[i] - meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 {
+		return LinearTrend{}, false
+	}
+
+	slope := sxy / sxx
+	intercept := meanY - slope*meanX
+
+	var sse float64
+	for i := range xs {
+		r := ys[i] - (intercept + slope*xs[i])
+		sse += r * r
+	}
+
+	rSquared := 1.0
+	if syy > 0 {
+		rSquared = 1 - sse/syy
+	}
+
+	return LinearTrend{
+		Slope:       slope,
+		Intercept:   intercept,
+		SlopeStdErr: math.Sqrt(sse / float64(n-2) / sxx),
+		RSquared:    rSquared,
+		N:           n,
+		XLast:       xLast,
+	}, true
+}
+
+// ValueAt returns the fitted value at x
+func (lt LinearTrend) ValueAt(x float64) float64 {
+	return lt.Intercept + lt.Slope*x
+}
+
+// TimeToCross returns the distance in x from the most recent point until the
+// fitted line rises above (above=true) or falls below threshold. It returns 0
+// if the threshold is already crossed and false if the trend never crosses it.
+func (lt LinearTrend) TimeToCross(threshold float64, above bool) (float64, bool) {
+	return crossAt(lt.ValueAt(lt.XLast), lt.Slope, threshold, above)
+}
+
+// TimeToCrossInterval returns the earliest and latest distances until the
+// threshold is crossed for slopes within the confidence interval of the fit.
+// A bound is not available (false) when the corresponding slope of the
+// interval never crosses the threshold.
+func (lt LinearTrend) TimeToCrossInterval(threshold float64, above bool, confidence float64) (earliest, latest float64, earliestOK, latestOK bool) {
+	start := lt.ValueAt(lt.XLast)
+	margin := normalQuantile(confidence) * lt.SlopeStdErr
+
+	fast, slow := lt.Slope+margin, lt.Slope-margin
+	if !above {
+		fast, slow = lt.Slope-margin, lt.Slope+margin
+	}
+
+	earliest, earliestOK = crossAt(start, fast, threshold, above)
+	latest, latestOK = crossAt(start, slow, threshold, above)
+	return earliest, latest, earliestOK, latestOK
+}
+
+// crossAt returns the distance for a line starting at start with the given
+// slope to cross threshold in the given direction
+func crossAt(start, slope, threshold float64, above bool) (float64, bool) {
+	if (above && start >= threshold) || (!above && start <= threshold) {
+		return 0, true
+	}
+	if (above && slope <= 0) || (!above && slope >= 0) {
+		return 0, false
+	}
+	return (threshold - start) / slope, true
+}
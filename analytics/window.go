@@ -0,0 +1,289 @@
+package analytics
+
+import (
+	"math"
+	"time"
+)
+
+// windowInitialSize is the initial buffer size of windows, which grow on
+// demand up to their sample limit so that idle or short-lived streams do
+// not hold a full buffer
+const windowInitialSize = 64
+
+// slidingWindow is a ring buffer that maintains the mean and the sum of
+// squared deviations (M2) of its values incrementally with Welford's method,
+// so inserting a value and reading the mean or variance are O(1) regardless
+// of the window size.
+//
+// A count-based window holds the last size values. A time-based window holds
+// the values observed within span of the newest timestamp, up to size values,
+// so its meaning does not depend on the ingest rate. Both keep the timestamps
+// of their values, so other analytics can be seeded from a window.
+//
+// Incremental updates accumulate floating-point error as values enter and
+// leave the window, so the statistics are recomputed exactly from the buffer
+// once per buffer length of evictions, which keeps the amortized cost O(1).
+//
+// slidingWindow is not safe for concurrent use; callers hold their own lock.
+type slidingWindow struct {
+	buf   []float64
+	head  int // index of the oldest value
+	count int
+	limit int // maximum number of values
+
+	// Timestamps of the values, and the time bounds; span is 0 for
+	// count-based windows
+	times  []time.Time
+	span   time.Duration
+	latest time.Time
+
+	mean float64
+	m2   float64
+
+	// Evictions since the last exact recomputation
+	evictions int
+
+	// Values in ascending order, kept only for windows that need order
+	// statistics (see keepOrder)
+	order *sortedValues
+}
+
+// newSlidingWindow creates a window holding the last size values
+func newSlidingWindow(size int) slidingWindow {
+	if size <= 0 {
+		size = DefaultWindowSize
+	}
+	initial := min(windowInitialSize, size)
+	return slidingWindow{
+		buf:   make([]float64, initial),
+		times: make([]time.Time, initial),
+		limit: size,
+	}
+}
+
+// newTimeWindow creates a window holding the values observed within span of
+// the newest one, capped at maxSize values
+func newTimeWindow(span time.Duration, maxSize int) slidingWindow {
+	if span <= 0 {
+		return newSlidingWindow(maxSize)
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultWindowSize
+	}
+	initial := min(windowInitialSize, maxSize)
+	return slidingWindow{
+		buf:   make([]float64, initial),
+		times: make([]time.Time, initial),
+		limit: maxSize,
+		span:  span,
+	}
+}
+
+// keepOrder makes the window maintain its values in ascending order as well,
+// for the median and MAD; it must be called before any value is added
+func (w *slidingWindow) keepOrder() {
+	w.order = &sortedValues{}
+}
+
+// timed reports whether the window is bounded by time
+func (w *slidingWindow) timed() bool {
+	return w.span > 0
+}
+
+// push adds a value, evicting the oldest one if the window is full
+func (w *slidingWindow) push(value float64) {
+	w.pushAt(time.Now(), value)
+}
+
+// pushAt adds a value observed at t. Count-based windows ignore t; time-based
+// windows first evict values older than span before the newest timestamp and
+// ignore values that are already outside the window.
+func (w *slidingWindow) pushAt(t time.Time, value float64) {
+	if w.timed() {
+		if t.After(w.latest) {
+			w.latest = t
+		}
+		w.expire()
+		if !t.After(w.latest.Add(-w.span)) {
+			return
+		}
+	}
+
+	if w.count == w.limit {
+		w.replaceOldest(t, value)
+		return
+	}
+	if w.count == len(w.buf) {
+		w.grow()
+	}
+
+	i := (w.head + w.count) % len(w.buf)
+	w.buf[i] = value
+	w.times[i] = t
+	w.count++
+	if w.order != nil {
+		w.order.insert(value)
+	}
+
+	delta := value - w.mean
+	w.mean += delta / float64(w.count)
+	w.m2 += delta * (value - w.mean)
+}
+
+// replaceOldest replaces the oldest value of a full window in a single Welford step
+func (w *slidingWindow) replaceOldest(t time.Time, value float64) {
+	old := w.buf[w.head]
+	w.buf[w.head] = value
+	w.times[w.head] = t
+	w.head = (w.head + 1) % len(w.buf)
+	if w.order != nil {
+		w.order.remove(old)
+		w.order.insert(value)
+	}
+
+	oldMean := w.mean
+	w.mean += (value - old) / float64(w.count)
+	w.m2 += (value - old) * (value - w.mean + old - oldMean)
+	if w.m2 < 0 {
+		w.m2 = 0
+	}
+	w.evicted()
+}
+
+// expire removes values older than span before the newest timestamp
+func (w *slidingWindow) expire() {
+	cutoff := w.latest.Add(-w.span)
+	for w.count > 0 && !w.times[w.head].After(cutoff) {
+		w.removeOldest()
+	}
+}
+
+// removeOldest removes the oldest value, reversing its Welford update
+func (w *slidingWindow) removeOldest() {
+	old := w.buf[w.head]
+	w.head = (w.head + 1) % len(w.buf)
+	w.count--
+	if w.order != nil {
+		w.order.remove(old)
+	}
+
+	if w.count == 0 {
+		w.head = 0
+		w.mean, w.m2 = 0, 0
+		w.evictions = 0
+		return
+	}
+
+	delta := old - w.mean
+	w.mean -= delta / float64(w.count)
+	w.m2 -= delta * (old - w.mean)
+	if w.m2 < 0 {
+		w.m2 = 0
+	}
+	w.evicted()
+}
+
+// evicted counts an eviction and recomputes the statistics when due
+func (w *slidingWindow) evicted() {
+	w.evictions++
+	if w.evictions >= len(w.buf) {
+		w.renormalize()
+	}
+}
+
+// grow doubles the buffer of the window, up to its limit
+func (w *slidingWindow) grow() {
+	size := min(2*len(w.buf), w.limit)
+	buf := make([]float64, size)
+	times := make([]time.Time, size)
+	for i := 0; i < w.count; i++ {
+		j := (w.head + i) % len(w.buf)
+		buf[i] = w.buf[j]
+		times[i] = w.times[j]
+	}
+	w.buf, w.times, w.head = buf, times, 0
+}
+
+// renormalize recomputes the mean and M2 exactly from the buffer
+func (w *slidingWindow) renormalize() {
+	w.evictions = 0
+	if w.count == 0 {
+		w.mean, w.m2 = 0, 0
+		return
+	}
+
+	sum := 0.0
+	w.each(func(v float64) { sum += v })
+	mean := sum / float64(w.count)
+
+	m2 := 0.0
+	w.each(func(v float64) {
+		diff := v - mean
+		m2 += diff * diff
+	})
+	w.mean, w.m2 = mean, m2
+}
+
+// each calls fn for each value from oldest to newest
+func (w *slidingWindow) each(fn func(v float64)) {
+	size := len(w.buf)
+	for i := 0; i < w.count; i++ {
+		fn(w.buf[(w.head+i)%size])
+	}
+}
+
+// eachAt calls fn for each value and its timestamp from oldest to newest
+func (w *slidingWindow) eachAt(fn func(t time.Time, v float64)) {
+	size := len(w.buf)
+	for i := 0; i < w.count; i++ {
+		j := (w.head + i) % size
+		fn(w.times[j], w.buf[j])
+	}
+}
+
+// values returns a copy of the values from oldest to newest
+func (w *slidingWindow) values() []float64 {
+	result := make([]float64, 0, w.count)
+	w.each(func(v float64) { result = append(result, v) })
+	return result
+}
+
+// len returns the number of values in the window
+func (w *slidingWindow) len() int {
+	return w.count
+}
+
+// size returns the maximum number of values in the window
+func (w *slidingWindow) size() int {
+	return w.limit
+}
+
+// average returns the mean of the values, or 0 if the window is empty
+func (w *slidingWindow) average() float64 {
+	return w.mean
+}
+
+// stddev returns the population standard deviation of the values
+func (w *slidingWindow) stddev() float64 {
+	if w.count < 2 {
+		return 0
+	}
+	return math.Sqrt(w.m2 / float64(w.count))
+}
+
+// reset clears the window
+func (w *slidingWindow) reset() {
+	for i := range w.buf {
+		w.buf[i] = 0
+	}
+	for i := range w.times {
+		w.times[i] = time.Time{}
+	}
+	w.head, w.count = 0, 0
+	w.latest = time.Time{}
+	w.mean, w.m2 = 0, 0
+	w.evictions = 0
+	if w.order != nil {
+		w.order.reset()
+	}
+}
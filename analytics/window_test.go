@@ -0,0 +1,209 @@
+package analytics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// naiveWindow is the reference for slidingWindow: it keeps its values in a
+// plain slice and recomputes every statistic from scratch
+type naiveWindow struct {
+	span   time.Duration
+	limit  int
+	times  []time.Time
+	values []float64
+	latest time.Time
+}
+
+func (n *naiveWindow) push(t time.Time, value float64) {
+	if n.span > 0 {
+		if t.After(n.latest) {
+			n.latest = t
+		}
+		cutoff := n.latest.Add(-n.span)
+		for len(n.values) > 0 && !n.times[0].After(cutoff) {
+			n.times, n.values = n.times[1:], n.values[1:]
+		}
+		if !t.After(cutoff) {
+			return
+		}
+	}
+	n.times = append(n.times, t)
+	n.values = append(n.values, value)
+	if len(n.values) > n.limit {
+		n.times, n.values = n.times[1:], n.values[1:]
+	}
+}
+
+func (n *naiveWindow) mean() float64 {
+	if len(n.values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range n.values {
+		sum += v
+	}
+	return sum / float64(len(n.values))
+}
+
+func (n *naiveWindow) stddev() float64 {
+	if len(n.values) < 2 {
+		return 0
+	}
+	mean := n.mean()
+	m2 := 0.0
+	for _, v := range n.values {
+		m2 += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(m2 / float64(len(n.values)))
+}
+
+func (n *naiveWindow) sorted() []float64 {
+	sorted := append([]float64(nil), n.values...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// sample is a value observed at a time
+type sample struct {
+	t     time.Time
+	value float64
+}
+
+// testEpoch is the time of the first sample of generated sequences
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// randomSamples returns n normally distributed values around mean, one per second
+func randomSamples(seed int64, n int, mean, stddev float64) []sample {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]sample, n)
+	for i := range samples {
+		samples[i] = sample{testEpoch.Add(time.Duration(i) * time.Second), mean + stddev*rng.NormFloat64()}
+	}
+	return samples
+}
+
+// irregularSamples returns n values with jittered, partly out-of-order
+// timestamps and occasional gaps longer than a minute
+func irregularSamples(seed int64, n int) []sample {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]sample, n)
+	t := testEpoch
+	for i := range samples {
+		switch r := rng.Intn(100); {
+		case r < 2:
+			t = t.Add(time.Duration(60+rng.Intn(120)) * time.Second)
+		case r < 10:
+			t = t.Add(-time.Duration(rng.Intn(3000)) * time.Millisecond)
+		default:
+			t = t.Add(time.Duration(rng.Intn(2000)) * time.Millisecond)
+		}
+		samples[i] = sample{t, rng.Float64()*100 - 20}
+	}
+	return samples
+}
+
+// duplicateSamples returns n values drawn from a handful of levels, so
+// windows hold many equal values
+func duplicateSamples(seed int64, n int) []sample {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]sample, n)
+	for i := range samples {
+		samples[i] = sample{testEpoch.Add(time.Duration(i) * time.Second), float64(rng.Intn(4))}
+	}
+	return samples
+}
+
+// windowCases are count-based and time-based windows over random and
+// eviction-heavy sequences, including expiry by time. The running variance
+// loses precision when the values sit far from zero relative to their
+// spread, so those cases allow a larger relative stddev error
+var windowCases = []struct {
+	name      string
+	span      time.Duration
+	size      int
+	samples   []sample
+	tolerance float64
+}{
+	{"count/random", 0, 50, randomSamples(1, 2000, 50, 10), 1e-9},
+	{"count/growing past initial buffer", 0, 500, randomSamples(2, 3000, 0, 1), 1e-9},
+	{"count/eviction heavy", 0, 3, randomSamples(3, 20000, 100, 5), 1e-9},
+	{"count/large offset small spread", 0, 40, randomSamples(4, 20000, 1e9, 0.5), 1e-4},
+	{"count/duplicates", 0, 25, duplicateSamples(5, 2000), 1e-9},
+	{"count/single value", 0, 1, randomSamples(6, 200, 5, 1), 1e-9},
+	{"time/regular", 30 * time.Second, 1000, randomSamples(7, 3000, 50, 10), 1e-9},
+	{"time/capped by size", time.Hour, 20, randomSamples(8, 3000, 50, 10), 1e-9},
+	{"time/irregular with gaps", 20 * time.Second, 1000, irregularSamples(9, 5000), 1e-9},
+	{"time/large offset small spread", 10 * time.Second, 1000, randomSamples(10, 20000, 1e9, 0.5), 1e-4},
+}
+
+// closeTo reports whether got is within a relative tolerance of want
+func closeTo(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance*math.Max(1, math.Abs(want))
+}
+
+func TestSlidingWindowMatchesNaive(t *testing.T) {
+	for _, tt := range windowCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTimeWindow(tt.span, tt.size)
+			w.keepOrder()
+			ref := &naiveWindow{span: tt.span, limit: tt.size}
+
+			for i, s := range tt.samples {
+				w.pushAt(s.t, s.value)
+				ref.push(s.t, s.value)
+
+				if w.len() != len(ref.values) {
+					t.Fatalf("sample %d: len = %d, want %d", i, w.len(), len(ref.values))
+				}
+				if got, want := w.average(), ref.mean(); !closeTo(got, want, 1e-9) {
+					t.Fatalf("sample %d: average = %v, want %v", i, got, want)
+				}
+				if got, want := w.stddev(), ref.stddev(); !closeTo(got, want, tt.tolerance) {
+					t.Fatalf("sample %d: stddev = %v, want %v", i, got, want)
+				}
+			}
+
+			values := w.values()
+			for i, v := range ref.values {
+				if values[i] != v {
+					t.Fatalf("values[%d] = %v, want %v", i, values[i], v)
+				}
+			}
+			i := 0
+			w.eachAt(func(ts time.Time, v float64) {
+				if !ts.Equal(ref.times[i]) || v != ref.values[i] {
+					t.Fatalf("eachAt %d = (%v, %v), want (%v, %v)", i, ts, v, ref.times[i], ref.values[i])
+				}
+				i++
+			})
+			sorted := ref.sorted()
+			for i, v := range sorted {
+				if w.order.values[i] != v {
+					t.Fatalf("order[%d] = %v, want %v", i, w.order.values[i], v)
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingWindowReset(t *testing.T) {
+	w := newTimeWindow(time.Minute, 100)
+	for _, s := range randomSamples(11, 300, 10, 2) {
+		w.pushAt(s.t, s.value)
+	}
+	w.reset()
+	if w.len() != 0 || w.average() != 0 || w.stddev() != 0 {
+		t.Fatalf("after reset: len %d, average %v, stddev %v", w.len(), w.average(), w.stddev())
+	}
+
+	// Timestamps before the previous latest one are accepted again
+	w.pushAt(testEpoch, 1)
+	w.pushAt(testEpoch.Add(time.Second), 3)
+	if w.len() != 2 || w.average() != 2 || w.stddev() != 1 {
+		t.Fatalf("after refill: len %d, average %v, stddev %v", w.len(), w.average(), w.stddev())
+	}
+}
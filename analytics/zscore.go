@@ -3,35 +3,56 @@ package analytics
 import (
 	"math"
 	"sync"
+	"time"
 )
 
 const DefaultZScoreThreshold = 2.0
 
-// ZScoreDetector detects anomalies using z-score method
+func init() {
+	RegisterDetector("zscore", func(cfg DetectorConfig) Detector {
+		return NewTimedZScoreDetector(cfg.WindowSpan, cfg.WindowSize, cfg.Threshold)
+	})
+}
+
+// ZScoreDetector detects anomalies using z-score method.
+// Adding and scoring a value are O(1) in the window size.
 type ZScoreDetector struct {
-	window    []float64
-	size      int
+	window    slidingWindow
 	threshold float64
 	mu        sync.RWMutex
 }
 
 // NewZScoreDetector creates a new z-score anomaly detector
 func NewZScoreDetector(windowSize int, threshold float64) *ZScoreDetector {
-	if windowSize <= 0 {
-		windowSize = DefaultWindowSize
+	if threshold <= 0 {
+		threshold = DefaultZScoreThreshold
 	}
+	return &ZScoreDetector{
+		window:    newSlidingWindow(windowSize),
+		threshold: threshold,
+	}
+}
+
+// NewTimedZScoreDetector creates a new z-score anomaly detector over the values
+// observed within span of the newest one, holding at most maxSize values.
+// A zero span falls back to a window of the last maxSize values.
+func NewTimedZScoreDetector(span time.Duration, maxSize int, threshold float64) *ZScoreDetector {
 	if threshold <= 0 {
 		threshold = DefaultZScoreThreshold
 	}
 	return &ZScoreDetector{
-		window:    make([]float64, 0, windowSize),
-		size:      windowSize,
+		window:    newTimeWindow(span, maxSize),
 		threshold: threshold,
 	}
 }
 
-// Add adds a value and returns whether it's an anomaly
+// Add adds a value observed now and returns whether it's an anomaly
 func (zd *ZScoreDetector) Add(value float64) (isAnomaly bool, zscore float64) {
+	return zd.AddAt(time.Now(), value)
+}
+
+// AddAt adds a value observed at t and returns whether it's an anomaly
+func (zd *ZScoreDetector) AddAt(t time.Time, value float64) (isAnomaly bool, zscore float64) {
 	zd.mu.Lock()
 	defer zd.mu.Unlock()
 
@@ -39,68 +60,24 @@ func (zd *ZScoreDetector) Add(value float64) (isAnomaly bool, zscore float64) {
 	zscore = zd.calculateZScore(value)
 	isAnomaly = math.Abs(zscore) > zd.threshold
 
-	// Add to window
-	if len(zd.window) >= zd.size {
-		zd.window = zd.window[1:]
-	}
-	zd.window = append(zd.window, value)
-
+	zd.window.pushAt(t, value)
 	return isAnomaly, zscore
 }
 
 // calculateZScore computes the z-score for a value (must hold lock)
 func (zd *ZScoreDetector) calculateZScore(value float64) float64 {
-	if len(zd.window) < 2 {
-		return 0
-	}
-
-	mean := zd.calculateMean()
-	stddev := zd.calculateStdDev(mean)
-
+	stddev := zd.window.stddev()
 	if stddev == 0 {
 		return 0
 	}
-
-	return (value - mean) / stddev
-}
-
-// calculateMean computes the mean of window values (must hold lock)
-func (zd *ZScoreDetector) calculateMean() float64 {
-	if len(zd.window) == 0 {
-		return 0
-	}
-
-	sum := 0.0
-	for _, v := range zd.window {
-		sum += v
-	}
-	return sum / float64(len(zd.window))
-}
-
-// calculateStdDev computes the standard deviation (must hold lock)
-func (zd *ZScoreDetector) calculateStdDev(mean float64) float64 {
-	if len(zd.window) < 2 {
-		return 0
-	}
-
-	sumSquares := 0.0
-	for _, v := range zd.window {
-		diff := v - mean
-		sumSquares += diff * diff
-	}
-
-	variance := sumSquares / float64(len(zd.window))
-	return math.Sqrt(variance)
+	return (value - zd.window.average()) / stddev
 }
 
-// GetStats returns current mean and standard deviation
-func (zd *ZScoreDetector) GetStats() (mean, stddev float64) {
+// Stats returns current mean and standard deviation
+func (zd *ZScoreDetector) Stats() (mean, stddev float64) {
 	zd.mu.RLock()
 	defer zd.mu.RUnlock()
-
-	mean = zd.calculateMean()
-	stddev = zd.calculateStdDev(mean)
-	return mean, stddev
+	return zd.window.average(), zd.window.stddev()
 }
 
 // IsAnomaly checks if a value is an anomaly without adding it
@@ -116,7 +93,7 @@ func (zd *ZScoreDetector) IsAnomaly(value float64) (bool, float64) {
 func (zd *ZScoreDetector) Count() int {
 	zd.mu.RLock()
 	defer zd.mu.RUnlock()
-	return len(zd.window)
+	return zd.window.len()
 }
 
 // Threshold returns the configured threshold
@@ -128,5 +105,5 @@ func (zd *ZScoreDetector) Threshold() float64 {
 func (zd *ZScoreDetector) Reset() {
 	zd.mu.Lock()
 	defer zd.mu.Unlock()
-	zd.window = make([]float64, 0, zd.size)
+	zd.window.reset()
 }
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"high-load-service/models"
+)
+
+const (
+	DeadLettersKey     = "webhooks:dead_letters"
+	DeadLettersDataKey = "webhooks:dead_letters:data"
+
+	// Default bounds of the webhook dead-letter queue of each tenant
+	DefaultDeadLetterRetention = 7 * 24 * time.Hour
+	MaxDeadLettersStored       = 10000
+)
+
+// StoreDeadLetter adds a failed webhook delivery to a tenant's dead-letter
+// queue: a sorted set of delivery IDs scored by failure time in milliseconds,
+// with the deliveries in a hash keyed by ID. The oldest entries beyond the
+// retention are dropped.
+func (rc *RedisClient) StoreDeadLetter(tenantID string, dl models.DeadLetter, retention Retention) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	indexKey := tenantKey(tenantID, DeadLettersKey)
+	dataKey := tenantKey(tenantID, DeadLettersDataKey)
+	pipe := rc.client.TxPipeline()
+	pipe.ZAdd(rc.ctx, indexKey, &redis.Z{Score: float64(dl.FailedAt.UnixMilli()), Member: dl.ID})
+	pipe.HSet(rc.ctx, dataKey, dl.ID, data)
+	if _, err := pipe.Exec(rc.ctx); err != nil {
+		return fmt.Errorf("failed to store dead letter: %w", err)
+	}
+
+	var expired []string
+	if retention.MaxAge > 0 {
+		cutoff := time.Now().Add(-retention.MaxAge).UnixMilli()
+		ids, err := rc.client.ZRangeByScore(rc.ctx, indexKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: "(" + strconv.FormatInt(cutoff, 10),
+		}).Result()
+		if err != nil {
+			return fmt.Errorf("failed to trim dead letters: %w", err)
+		}
+		expired = append(expired, ids...)
+	}
+	if retention.MaxEntries > 0 {
+		ids, err := rc.client.ZRange(rc.ctx, indexKey, 0, -retention.MaxEntries-1).Result()
+		if err != nil {
+			return fmt.Errorf("failed to trim dead letters: %w", err)
+		}
+		expired = append(expired, ids...)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	members := make([]interface{}, len(expired))
+	for i, id := range expired {
+		members[i] = id
+	}
+	pipe = rc.client.TxPipeline()
+	pipe.ZRem(rc.ctx, indexKey, members...)
+	pipe.HDel(rc.ctx, dataKey, expired...)
+	if _, err := pipe.Exec(rc.ctx); err != nil {
+		return fmt.Errorf("failed to trim dead letters: %w", err)
+	}
+	return nil
+}
+
+// GetDeadLetters returns up to limit dead letters of a tenant, newest first,
+// skipping the first offset, and the total number of dead letters
+func (rc *RedisClient) GetDeadLetters(tenantID string, limit, offset int64) ([]models.DeadLetter, int64, error) {
+	indexKey := tenantKey(tenantID, DeadLettersKey)
+	total, err := rc.client.ZCard(rc.ctx, indexKey).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count dead letters: %w", err)
+	}
+
+	ids, err := rc.client.ZRevRange(rc.ctx, indexKey, offset, offset+limit-1).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	deadLetters := make([]models.DeadLetter, 0, len(ids))
+	if len(ids) == 0 {
+		return deadLetters, total, nil
+	}
+
+	data, err := rc.client.HMGet(rc.ctx, tenantKey(tenantID, DeadLettersDataKey), ids...).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	for _, d := range data {
+		s, ok := d.(string)
+		if !ok {
+			continue // Removed concurrently
+		}
+		var dl models.DeadLetter
+		if err := json.Unmarshal([]byte(s), &dl); err != nil {
+			continue // Skip invalid entries
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	return deadLetters, total, nil
+}
+
+// GetDeadLetterIDs returns the IDs of all dead letters of a tenant, oldest first
+func (rc *RedisClient) GetDeadLetterIDs(tenantID string) ([]string, error) {
+	ids, err := rc.client.ZRange(rc.ctx, tenantKey(tenantID, DeadLettersKey), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	return ids, nil
+}
+
+// TakeDeadLetter removes a dead letter of a tenant and returns it. ok is false
+// if there is no such dead letter, including when it was taken concurrently.
+func (rc *RedisClient) TakeDeadLetter(tenantID, id string) (dl models.DeadLetter, ok bool, err error) {
+	dataKey := tenantKey(tenantID, DeadLettersDataKey)
+	data, err := rc.client.HGet(rc.ctx, dataKey, id).Result()
+	if err == redis.Nil {
+		return dl, false, nil
+	}
+	if err != nil {
+		return dl, false, fmt.Errorf("failed to get dead letter: %w", err)
+	}
+
+	pipe := rc.client.TxPipeline()
+	deleted := pipe.HDel(rc.ctx, dataKey, id)
+	pipe.ZRem(rc.ctx, tenantKey(tenantID, DeadLettersKey), id)
+	if _, err := pipe.Exec(rc.ctx); err != nil {
+		return dl, false, fmt.Errorf("failed to remove dead letter: %w", err)
+	}
+	if deleted.Val() == 0 {
+		return dl, false, nil
+	}
+
+	if err := json.Unmarshal([]byte(data), &dl); err != nil {
+		return dl, false, fmt.Errorf("failed to unmarshal dead letter: %w", err)
+	}
+	return dl, true, nil
+}
@@ -0,0 +1,327 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"high-load-service/models"
+)
+
+const (
+	// Events of a tenant ordered by timestamp, and their IDs in the order
+	// they were stored
+	AnomalyEventsKey   = "anomaly:events:time"
+	AnomalyArrivalsKey = "anomaly:events:arrival"
+	AnomalyEventSeqKey = "anomaly:events:seq"
+
+	// Default bounds of the anomaly event history of each tenant
+	DefaultEventRetention  = 7 * 24 * time.Hour
+	MaxAnomalyEventsStored = 10000
+
+	// eventScanBatch is the number of stored events read per round trip
+	eventScanBatch = 500
+)
+
+// ErrInvalidCursor is returned for pagination cursors that are not event IDs
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Retention bounds a stored history by age and by number of entries;
+// zero values leave the history unbounded in that dimension
+type Retention struct {
+	MaxAge     time.Duration
+	MaxEntries int64
+}
+
+// storeEventScript assigns the next sequence number of a tenant's events and
+// adds the event in one step, so an event is visible as soon as its ID exists
+// and no event with a lower sequence number is stored later. Events are
+// members "<timestamp>:<sequence>:<JSON>" of equal score, so they sort by
+// timestamp and then by arrival; the arrivals set scores their
+// "<timestamp>:<sequence>" keys by sequence number. Both sets drop the same
+// events when the history is trimmed.
+//
+// KEYS: events, arrivals, sequence. ARGV: padded timestamp, event JSON,
+// padded retention cutoff ("" for none), TTL seconds, max entries (0 for no bound).
+var storeEventScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[3])
+local key = ARGV[1] .. ':' .. string.format('%019d', seq)
+redis.call('ZADD', KEYS[1], 0, key .. ':' .. ARGV[2])
+redis.call('ZADD', KEYS[2], seq, key)
+local function drop(members)
+	for _, member in ipairs(members) do
+		redis.call('ZREM', KEYS[1], member)
+		redis.call('ZREM', KEYS[2], string.sub(member, 1, #key))
+	end
+end
+if ARGV[3] ~= '' then
+	drop(redis.call('ZRANGEBYLEX', KEYS[1], '-', '(' .. ARGV[3] .. ':'))
+end
+if tonumber(ARGV[5]) > 0 then
+	drop(redis.call('ZRANGE', KEYS[1], 0, -tonumber(ARGV[5]) - 1))
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[4])
+	redis.call('EXPIRE', KEYS[2], ARGV[4])
+end
+return seq
+`)
+
+// StoreAnomalyEvent adds an anomaly event to a tenant's history and returns
+// it with its assigned ID, "<timestamp unix ms>-<sequence>". The history is
+// ordered by event timestamp, and events of the same millisecond by arrival;
+// the sequence number also keeps the order in which events were stored for
+// the anomaly stream, so events of slow or replayed device clocks are still
+// replayed to reconnecting clients. Events beyond the retention, by
+// timestamp or by number, are dropped.
+func (rc *RedisClient) StoreAnomalyEvent(tenantID string, event models.AnomalyEvent, retention Retention) (models.AnomalyEvent, error) {
+	event.ID = ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return event, fmt.Errorf("failed to marshal anomaly event: %w", err)
+	}
+
+	var cutoff string
+	var ttl int64
+	if retention.MaxAge > 0 {
+		cutoff = eventTime(time.Now().Add(-retention.MaxAge).UnixMilli())
+		ttl = int64(retention.MaxAge.Seconds())
+	}
+	millis := eventMillis(event.Timestamp)
+	keys := []string{
+		tenantKey(tenantID, AnomalyEventsKey),
+		tenantKey(tenantID, AnomalyArrivalsKey),
+		tenantKey(tenantID, AnomalyEventSeqKey),
+	}
+	seq, err := storeEventScript.Run(rc.ctx, rc.client, keys,
+		eventTime(millis), data, cutoff, ttl, retention.MaxEntries).Int64()
+	if err != nil {
+		return event, fmt.Errorf("failed to store anomaly event: %w", err)
+	}
+
+	event.ID = formatEventID(millis, seq)
+	return event, nil
+}
+
+// GetAnomalyEvents returns up to query.Limit stored anomaly events of a tenant
+// matching the query, by timestamp or, with query.Stored, in the order they
+// were stored, starting after the cursor event. From and To bound the event
+// timestamp. Without a limit at most MaxAnomalyEventsStored events are
+// returned; if more events match, the page is marked truncated and carries the
+// cursor of the next page. Pages are read by key range rather than offset, so
+// reading a page costs the same however deep it is.
+func (rc *RedisClient) GetAnomalyEvents(tenantID string, query models.AnomalyEventQuery) (models.AnomalyEventPage, error) {
+	page := models.AnomalyEventPage{Events: []models.AnomalyEvent{}}
+	if query.Limit <= 0 {
+		query.Limit = MaxAnomalyEventsStored
+	}
+
+	var afterMillis, afterSeq int64
+	if query.Cursor != "" {
+		var err error
+		if afterMillis, afterSeq, err = parseEventID(query.Cursor); err != nil {
+			return page, err
+		}
+	}
+
+	next := rc.eventsByTime(tenantID, query, afterMillis, afterSeq)
+	if query.Stored {
+		next = rc.eventsByArrival(tenantID, afterSeq)
+	}
+	for {
+		events, more, err := next()
+		if err != nil {
+			return page, fmt.Errorf("failed to get anomaly events: %w", err)
+		}
+		for _, event := range events {
+			if !query.Matches(event) || !inRange(event.Timestamp, query.From, query.To) {
+				continue
+			}
+			if len(page.Events) == query.Limit {
+				page.NextCursor = page.Events[len(page.Events)-1].ID
+				page.Truncated = true
+				return page, nil
+			}
+			page.Events = append(page.Events, event)
+		}
+		if !more {
+			return page, nil
+		}
+	}
+}
+
+// eventsByTime returns a function reading the next batch of a tenant's events
+// by timestamp, after the given event and within the query's time bounds, and
+// whether more may follow
+func (rc *RedisClient) eventsByTime(tenantID string, query models.AnomalyEventQuery, afterMillis, afterSeq int64) func() ([]models.AnomalyEvent, bool, error) {
+	// Members of the cursor event sort before "<timestamp>:<sequence>;"
+	start, end := "-", "+"
+	if !query.From.IsZero() {
+		start = "[" + eventTime(eventMillis(query.From)) + ":"
+	}
+	if query.Cursor != "" {
+		if after := "[" + eventKey(afterMillis, afterSeq) + ";"; after > start {
+			start = after
+		}
+	}
+	if !query.To.IsZero() {
+		end = "(" + eventTime(eventMillis(query.To)) + ":"
+	}
+
+	key := tenantKey(tenantID, AnomalyEventsKey)
+	return func() ([]models.AnomalyEvent, bool, error) {
+		members, err := rc.client.ZRangeByLex(rc.ctx, key, &redis.ZRangeBy{
+			Min:   start,
+			Max:   end,
+			Count: eventScanBatch,
+		}).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(members) > 0 {
+			start = "(" + members[len(members)-1]
+		}
+
+		events := make([]models.AnomalyEvent, 0, len(members))
+		for _, member := range members {
+			if event, ok := parseEventMember(member); ok {
+				events = append(events, event)
+			}
+		}
+		return events, len(members) == eventScanBatch, nil
+	}
+}
+
+// eventsByArrival returns a function reading the next batch of a tenant's
+// events in the order they were stored, after sequence number afterSeq, and
+// whether more may follow
+func (rc *RedisClient) eventsByArrival(tenantID string, afterSeq int64) func() ([]models.AnomalyEvent, bool, error) {
+	eventsKey := tenantKey(tenantID, AnomalyEventsKey)
+	arrivalsKey := tenantKey(tenantID, AnomalyArrivalsKey)
+	return func() ([]models.AnomalyEvent, bool, error) {
+		arrivals, err := rc.client.ZRangeByScoreWithScores(rc.ctx, arrivalsKey, &redis.ZRangeBy{
+			Min:   "(" + strconv.FormatInt(afterSeq, 10),
+			Max:   "+inf",
+			Count: eventScanBatch,
+		}).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(arrivals) == 0 {
+			return nil, false, nil
+		}
+		afterSeq = int64(arrivals[len(arrivals)-1].Score)
+
+		// Look up the events of the batch in one round trip
+		pipe := rc.client.Pipeline()
+		cmds := make([]*redis.StringSliceCmd, len(arrivals))
+		for i, arrival := range arrivals {
+			key, _ := arrival.Member.(string)
+			cmds[i] = pipe.ZRangeByLex(rc.ctx, eventsKey, &redis.ZRangeBy{
+				Min:   "[" + key + ":",
+				Max:   "(" + key + ";",
+				Count: 1,
+			})
+		}
+		if _, err := pipe.Exec(rc.ctx); err != nil {
+			return nil, false, err
+		}
+
+		events := make([]models.AnomalyEvent, 0, len(arrivals))
+		for _, cmd := range cmds {
+			members, _ := cmd.Result()
+			if len(members) == 0 {
+				continue // Dropped by the retention meanwhile
+			}
+			if event, ok := parseEventMember(members[0]); ok {
+				events = append(events, event)
+			}
+		}
+		return events, len(arrivals) == eventScanBatch, nil
+	}
+}
+
+// parseEventMember parses a stored "<timestamp>:<sequence>:<JSON>" member
+// into its event, with the event ID set
+func parseEventMember(member string) (models.AnomalyEvent, bool) {
+	var event models.AnomalyEvent
+	millisPart, rest, ok := strings.Cut(member, ":")
+	if !ok {
+		return event, false
+	}
+	seqPart, data, ok := strings.Cut(rest, ":")
+	if !ok {
+		return event, false
+	}
+	millis, err := strconv.ParseInt(millisPart, 10, 64)
+	if err != nil {
+		return event, false
+	}
+	seq, err := strconv.ParseInt(seqPart, 10, 64)
+	if err != nil {
+		return event, false
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return event, false
+	}
+	event.ID = formatEventID(millis, seq)
+	return event, true
+}
+
+// inRange reports whether t is within [from, to), zero bounds being open
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// eventMillis returns the millisecond of an event timestamp as stored;
+// timestamps before the Unix epoch are stored as the epoch
+func eventMillis(t time.Time) int64 {
+	return max(t.UnixMilli(), 0)
+}
+
+// eventTime returns the zero-padded timestamp of stored members, which sort
+// by it as strings
+func eventTime(millis int64) string {
+	return fmt.Sprintf("%016d", millis)
+}
+
+// eventKey returns the "<timestamp>:<sequence>" prefix of a stored member
+func eventKey(millis, seq int64) string {
+	return eventTime(millis) + ":" + fmt.Sprintf("%019d", seq)
+}
+
+// formatEventID returns the ID of an event with the given timestamp
+// millisecond and sequence number
+func formatEventID(millis, seq int64) string {
+	return strconv.FormatInt(millis, 10) + "-" + strconv.FormatInt(seq, 10)
+}
+
+// EventSequence returns the sequence number of an event ID; sequence numbers
+// of a tenant's events grow in the order the events were stored
+func EventSequence(id string) (int64, error) {
+	_, seq, err := parseEventID(id)
+	return seq, err
+}
+
+// parseEventID parses an event ID into its millisecond and sequence number
+func parseEventID(id string) (millis, seq int64, err error) {
+	i := strings.LastIndexByte(id, '-')
+	if i <= 0 {
+		return 0, 0, fmt.Errorf("%w %q", ErrInvalidCursor, id)
+	}
+	millisPart, seqPart := id[:i], id[i+1:]
+	millis, err = strconv.ParseInt(millisPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w %q", ErrInvalidCursor, id)
+	}
+	seq, err = strconv.ParseInt(seqPart, 10, 64)
+	if err != nil || seq <= 0 {
+		return 0, 0, fmt.Errorf("%w %q", ErrInvalidCursor, id)
+	}
+	return millis, seq, nil
+}
@@ -14,10 +14,19 @@ import (
 )
 
 const (
-	MetricsListKey    = "metrics:list"
-	MetricsCounterKey = "metrics:counter"
-	DefaultTTL        = 24 * time.Hour
-	MaxMetricsStored  = 10000
+	MetricsListKey     = "metrics:list"
+	MetricsCounterKey  = "metrics:counter"
+	AnomalyCountKey    = "anomaly:count"
+	LatestAnalyticsKey = "analytics:latest"
+	TenantKeyPrefix    = "tenant"
+	DefaultTTL         = 24 * time.Hour
+	MaxMetricsStored   = 10000
+
+	// Per-device history, kept so that device trends are not crowded out of
+	// the tenant list by the rest of the fleet; idle devices expire after
+	// DefaultTTL
+	DeviceMetricsKeyPrefix = "device"
+	MaxDeviceMetricsStored = 1000
 )
 
 // RedisClient wraps the Redis client for metrics caching
@@ -59,31 +68,59 @@ func NewRedisClient() (*RedisClient, error) {
 	}, nil
 }
 
-// StoreMetric stores a metric in Redis
-func (rc *RedisClient) StoreMetric(metric models.Metric) error {
+// tenantKey returns the tenant-scoped form of a key, e.g. "tenant:acme:metrics:list"
+func tenantKey(tenantID, key string) string {
+	if tenantID == "" {
+		tenantID = models.DefaultTenantID
+	}
+	return fmt.Sprintf("%s:%s:%s", TenantKeyPrefix, tenantID, key)
+}
+
+// StoreMetric stores a metric, including its values and labels, in the tenant's keyspace
+func (rc *RedisClient) StoreMetric(tenantID string, metric models.Metric) error {
+	listKey := tenantKey(tenantID, MetricsListKey)
+
 	data, err := json.Marshal(metric)
 	if err != nil {
 		return fmt.Errorf("failed to marshal metric: %w", err)
 	}
 
-	// Push to list (newest first)
-	err = rc.client.LPush(rc.ctx, MetricsListKey, data).Err()
-	if err != nil {
+	// Push to the tenant list and the device's own history (newest first),
+	// trimmed to their max size, and count the metric, in one round trip
+	deviceKey := deviceMetricsKey(tenantID, metric.DeviceID)
+	pipe := rc.client.TxPipeline()
+	pipe.LPush(rc.ctx, listKey, data)
+	pipe.LTrim(rc.ctx, listKey, 0, MaxMetricsStored-1)
+	pipe.LPush(rc.ctx, deviceKey, data)
+	pipe.LTrim(rc.ctx, deviceKey, 0, MaxDeviceMetricsStored-1)
+	pipe.Expire(rc.ctx, deviceKey, DefaultTTL)
+	pipe.Incr(rc.ctx, tenantKey(tenantID, MetricsCounterKey))
+	if _, err := pipe.Exec(rc.ctx); err != nil {
 		return fmt.Errorf("failed to store metric: %w", err)
 	}
+	return nil
+}
 
-	// Trim list to max size
-	rc.client.LTrim(rc.ctx, MetricsListKey, 0, MaxMetricsStored-1)
+// deviceMetricsKey returns the key of a device's metric list, e.g.
+// "tenant:acme:device:sensor-1:metrics:list"
+func deviceMetricsKey(tenantID, deviceID string) string {
+	return tenantKey(tenantID, fmt.Sprintf("%s:%s:%s", DeviceMetricsKeyPrefix, deviceID, MetricsListKey))
+}
 
-	// Increment counter
-	rc.client.Incr(rc.ctx, MetricsCounterKey)
+// GetRecentMetrics retrieves the most recent N metrics of a tenant
+func (rc *RedisClient) GetRecentMetrics(tenantID string, count int64) ([]models.Metric, error) {
+	return rc.recentMetrics(tenantKey(tenantID, MetricsListKey), count)
+}
 
-	return nil
+// GetRecentDeviceMetrics retrieves the most recent N metrics of a device,
+// up to MaxDeviceMetricsStored
+func (rc *RedisClient) GetRecentDeviceMetrics(tenantID, deviceID string, count int64) ([]models.Metric, error) {
+	return rc.recentMetrics(deviceMetricsKey(tenantID, deviceID), count)
 }
 
-// GetRecentMetrics retrieves the most recent N metrics
-func (rc *RedisClient) GetRecentMetrics(count int64) ([]models.Metric, error) {
-	data, err := rc.client.LRange(rc.ctx, MetricsListKey, 0, count-1).Result()
+// recentMetrics decodes the first N metrics of a list
+func (rc *RedisClient) recentMetrics(listKey string, count int64) ([]models.Metric, error) {
+	data, err := rc.client.LRange(rc.ctx, listKey, 0, count-1).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get metrics: %w", err)
 	}
@@ -100,9 +137,9 @@ func (rc *RedisClient) GetRecentMetrics(count int64) ([]models.Metric, error) {
 	return metrics, nil
 }
 
-// GetMetricsCount returns the total number of metrics received
-func (rc *RedisClient) GetMetricsCount() (int64, error) {
-	count, err := rc.client.Get(rc.ctx, MetricsCounterKey).Int64()
+// GetMetricsCount returns the total number of metrics received by a tenant
+func (rc *RedisClient) GetMetricsCount(tenantID string) (int64, error) {
+	count, err := rc.client.Get(rc.ctx, tenantKey(tenantID, MetricsCounterKey)).Int64()
 	if err == redis.Nil {
 		return 0, nil
 	}
@@ -112,23 +149,23 @@ func (rc *RedisClient) GetMetricsCount() (int64, error) {
 	return count, nil
 }
 
-// GetStoredMetricsCount returns the number of metrics in the list
-func (rc *RedisClient) GetStoredMetricsCount() (int64, error) {
-	count, err := rc.client.LLen(rc.ctx, MetricsListKey).Result()
+// GetStoredMetricsCount returns the number of metrics in a tenant's list
+func (rc *RedisClient) GetStoredMetricsCount(tenantID string) (int64, error) {
+	count, err := rc.client.LLen(rc.ctx, tenantKey(tenantID, MetricsListKey)).Result()
 	if err != nil {
 		return 0, fmt.Errorf("failed to get stored metrics count: %w", err)
 	}
 	return count, nil
 }
 
-// StoreAnalyticsResult caches the latest analytics result
-func (rc *RedisClient) StoreAnalyticsResult(result models.AnalyticsResult) error {
+// StoreAnalyticsResult caches the latest analytics result of a tenant
+func (rc *RedisClient) StoreAnalyticsResult(tenantID string, result models.AnalyticsResult) error {
 	data, err := json.Marshal(result)
 	if err != nil {
 		return fmt.Errorf("failed to marshal analytics result: %w", err)
 	}
 
-	err = rc.client.Set(rc.ctx, "analytics:latest", data, DefaultTTL).Err()
+	err = rc.client.Set(rc.ctx, tenantKey(tenantID, LatestAnalyticsKey), data, DefaultTTL).Err()
 	if err != nil {
 		return fmt.Errorf("failed to store analytics result: %w", err)
 	}
@@ -136,9 +173,9 @@ func (rc *RedisClient) StoreAnalyticsResult(result models.AnalyticsResult) error
 	return nil
 }
 
-// GetLatestAnalyticsResult retrieves the cached analytics result
-func (rc *RedisClient) GetLatestAnalyticsResult() (*models.AnalyticsResult, error) {
-	data, err := rc.client.Get(rc.ctx, "analytics:latest").Result()
+// GetLatestAnalyticsResult retrieves the cached analytics result of a tenant
+func (rc *RedisClient) GetLatestAnalyticsResult(tenantID string) (*models.AnalyticsResult, error) {
+	data, err := rc.client.Get(rc.ctx, tenantKey(tenantID, LatestAnalyticsKey)).Result()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -154,15 +191,38 @@ func (rc *RedisClient) GetLatestAnalyticsResult() (*models.AnalyticsResult, erro
 	return &result, nil
 }
 
-// IncrementAnomalyCount increments the anomaly counter
-func (rc *RedisClient) IncrementAnomalyCount(metricType string) error {
-	key := fmt.Sprintf("anomaly:count:%s", metricType)
-	return rc.client.Incr(rc.ctx, key).Err()
+// anomalyCountKey returns the counter key of an anomaly event type, e.g.
+// "tenant:acme:anomaly:count:cpu" for spikes and
+// "tenant:acme:anomaly:count:cpu:level_shift" for other event types
+func anomalyCountKey(tenantID, metricType, eventType string) string {
+	key := AnomalyCountKey + ":" + metricType
+	if eventType != "" && eventType != models.EventTypeSpike {
+		key += ":" + eventType
+	}
+	return tenantKey(tenantID, key)
+}
+
+// IncrementAnomalyCount increments a tenant's anomaly counter for an event type
+// and, if given, the counter of its severity, e.g.
+// "tenant:acme:anomaly:count:cpu:severity:critical"
+func (rc *RedisClient) IncrementAnomalyCount(tenantID, metricType, eventType, severity string) error {
+	key := anomalyCountKey(tenantID, metricType, eventType)
+	if err := rc.client.Incr(rc.ctx, key).Err(); err != nil {
+		return err
+	}
+	if severity == "" {
+		return nil
+	}
+	return rc.client.Incr(rc.ctx, key+":severity:"+severity).Err()
 }
 
-// GetAnomalyCount returns the anomaly count for a metric type
-func (rc *RedisClient) GetAnomalyCount(metricType string) (int64, error) {
-	key := fmt.Sprintf("anomaly:count:%s", metricType)
+// GetAnomalyCount returns a tenant's anomaly count for a metric and event type,
+// restricted to a severity if one is given
+func (rc *RedisClient) GetAnomalyCount(tenantID, metricType, eventType, severity string) (int64, error) {
+	key := anomalyCountKey(tenantID, metricType, eventType)
+	if severity != "" {
+		key += ":severity:" + severity
+	}
 	count, err := rc.client.Get(rc.ctx, key).Int64()
 	if err == redis.Nil {
 		return 0, nil
@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"high-load-service/models"
+)
+
+const (
+	AlertRulesKey = "alert:rules"
+
+	// AlertRuleTenantsKey is the set of tenants with stored alert rules
+	AlertRuleTenantsKey = "alert:rules:tenants"
+
+	// AlertRulesVersionKey is incremented on every rule change, and the
+	// change announced on AlertRulesChannel, so replicas reload the rules
+	// only when they changed
+	AlertRulesVersionKey = "alert:rules:version"
+	AlertRulesChannel    = "alert:rules:changed"
+
+	// AlertEvaluatorKey holds the ID of the replica that evaluates the rules
+	AlertEvaluatorKey = "alert:evaluator"
+
+	// AlertInputsKeyPrefix prefixes the rule inputs published by each
+	// replica; AlertInputsReplicasKey scores the replicas by publication time
+	AlertInputsKeyPrefix   = "alert:inputs"
+	AlertInputsReplicasKey = "alert:inputs:replicas"
+
+	// AlertsKey holds the alerts of a tenant, by rule ID
+	AlertsKey = "alerts"
+)
+
+// acquireEvaluatorScript makes a replica the rule evaluator if no other
+// replica holds the role, or extends its hold.
+//
+// KEYS: evaluator. ARGV: replica ID, hold ms. Returns 1 if the replica holds the role.
+var acquireEvaluatorScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// StoreAlertRule creates or replaces an alert rule of a tenant
+func (rc *RedisClient) StoreAlertRule(tenantID string, rule models.AlertRule) error {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert rule: %w", err)
+	}
+	if tenantID == "" {
+		tenantID = models.DefaultTenantID
+	}
+
+	pipe := rc.client.TxPipeline()
+	pipe.HSet(rc.ctx, tenantKey(tenantID, AlertRulesKey), rule.ID, data)
+	pipe.SAdd(rc.ctx, AlertRuleTenantsKey, tenantID)
+	pipe.Incr(rc.ctx, AlertRulesVersionKey)
+	pipe.Publish(rc.ctx, AlertRulesChannel, tenantID)
+	if _, err := pipe.Exec(rc.ctx); err != nil {
+		return fmt.Errorf("failed to store alert rule: %w", err)
+	}
+	return nil
+}
+
+// DeleteAlertRule removes an alert rule of a tenant
+func (rc *RedisClient) DeleteAlertRule(tenantID, id string) error {
+	pipe := rc.client.TxPipeline()
+	pipe.HDel(rc.ctx, tenantKey(tenantID, AlertRulesKey), id)
+	pipe.Incr(rc.ctx, AlertRulesVersionKey)
+	pipe.Publish(rc.ctx, AlertRulesChannel, tenantID)
+	if _, err := pipe.Exec(rc.ctx); err != nil {
+		return fmt.Errorf("failed to delete alert rule: %w", err)
+	}
+	return nil
+}
+
+// GetAlertRulesVersion returns the version of the stored alert rules, 0 if
+// they never changed
+func (rc *RedisClient) GetAlertRulesVersion() (int64, error) {
+	version, err := rc.client.Get(rc.ctx, AlertRulesVersionKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get alert rules version: %w", err)
+	}
+	return version, nil
+}
+
+// SubscribeAlertRuleChanges returns a channel that receives a value whenever
+// alert rules change, until stop is closed. Changes made while the channel
+// is not drained are coalesced; changes missed while disconnected are not
+// announced, so receivers should also compare GetAlertRulesVersion.
+func (rc *RedisClient) SubscribeAlertRuleChanges(stop <-chan struct{}) <-chan struct{} {
+	pubsub := rc.client.Subscribe(rc.ctx, AlertRulesChannel)
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-messages:
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return changes
+}
+
+// AcquireAlertEvaluator makes a replica the alert rule evaluator for hold,
+// unless another replica holds the role, and reports whether it holds it
+func (rc *RedisClient) AcquireAlertEvaluator(replicaID string, hold time.Duration) (bool, error) {
+	held, err := acquireEvaluatorScript.Run(rc.ctx, rc.client, []string{AlertEvaluatorKey},
+		replicaID, hold.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire alert evaluator: %w", err)
+	}
+	return held == 1, nil
+}
+
+// StoreAlertInputs publishes the alert rule inputs of a replica for ttl
+func (rc *RedisClient) StoreAlertInputs(replicaID string, inputs models.AlertInputs, ttl time.Duration) error {
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert inputs: %w", err)
+	}
+	now := time.Now()
+
+	pipe := rc.client.TxPipeline()
+	pipe.Set(rc.ctx, AlertInputsKeyPrefix+":"+replicaID, data, ttl)
+	pipe.ZAdd(rc.ctx, AlertInputsReplicasKey, &redis.Z{Score: float64(now.UnixMilli()), Member: replicaID})
+	pipe.ZRemRangeByScore(rc.ctx, AlertInputsReplicasKey, "-inf", "("+strconv.FormatInt(now.Add(-ttl).UnixMilli(), 10))
+	if _, err := pipe.Exec(rc.ctx); err != nil {
+		return fmt.Errorf("failed to store alert inputs: %w", err)
+	}
+	return nil
+}
+
+// GetAlertInputs returns the alert rule inputs published by every replica
+// within ttl
+func (rc *RedisClient) GetAlertInputs(ttl time.Duration) ([]models.AlertInputs, error) {
+	cutoff := strconv.FormatInt(time.Now().Add(-ttl).UnixMilli(), 10)
+	replicas, err := rc.client.ZRangeByScore(rc.ctx, AlertInputsReplicasKey, &redis.ZRangeBy{Min: cutoff, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alert input replicas: %w", err)
+	}
+	if len(replicas) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(replicas))
+	for i, replicaID := range replicas {
+		keys[i] = AlertInputsKeyPrefix + ":" + replicaID
+	}
+	values, err := rc.client.MGet(rc.ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alert inputs: %w", err)
+	}
+
+	all := make([]models.AlertInputs, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // Expired since the replica was listed
+		}
+		var inputs models.AlertInputs
+		if err := json.Unmarshal([]byte(data), &inputs); err != nil {
+			continue // Skip invalid entries
+		}
+		all = append(all, inputs)
+	}
+	return all, nil
+}
+
+// StoreAlerts replaces the alerts of the given tenants, by tenant and rule ID
+func (rc *RedisClient) StoreAlerts(alerts map[string]map[string][]models.Alert) error {
+	pipe := rc.client.TxPipeline()
+	for tenantID, rules := range alerts {
+		key := tenantKey(tenantID, AlertsKey)
+		pipe.Del(rc.ctx, key)
+		for ruleID, ruleAlerts := range rules {
+			if len(ruleAlerts) == 0 {
+				continue
+			}
+			data, err := json.Marshal(ruleAlerts)
+			if err != nil {
+				return fmt.Errorf("failed to marshal alerts: %w", err)
+			}
+			pipe.HSet(rc.ctx, key, ruleID, data)
+		}
+	}
+	if _, err := pipe.Exec(rc.ctx); err != nil {
+		return fmt.Errorf("failed to store alerts: %w", err)
+	}
+	return nil
+}
+
+// GetAlerts returns the stored alerts of a tenant, by rule ID
+func (rc *RedisClient) GetAlerts(tenantID string) (map[string][]models.Alert, error) {
+	data, err := rc.client.HGetAll(rc.ctx, tenantKey(tenantID, AlertsKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alerts: %w", err)
+	}
+
+	alerts := make(map[string][]models.Alert, len(data))
+	for ruleID, d := range data {
+		var ruleAlerts []models.Alert
+		if err := json.Unmarshal([]byte(d), &ruleAlerts); err != nil {
+			continue // Skip invalid entries
+		}
+		alerts[ruleID] = ruleAlerts
+	}
+	return alerts, nil
+}
+
+// GetAlertRules returns the stored alert rules of every tenant, keyed by tenant ID
+func (rc *RedisClient) GetAlertRules() (map[string][]models.AlertRule, error) {
+	tenants, err := rc.client.SMembers(rc.ctx, AlertRuleTenantsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alert rule tenants: %w", err)
+	}
+
+	rules := make(map[string][]models.AlertRule, len(tenants))
+	for _, tenantID := range tenants {
+		data, err := rc.client.HGetAll(rc.ctx, tenantKey(tenantID, AlertRulesKey)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get alert rules: %w", err)
+		}
+		for _, d := range data {
+			var rule models.AlertRule
+			if err := json.Unmarshal([]byte(d), &rule); err != nil {
+				continue // Skip invalid entries
+			}
+			rules[tenantID] = append(rules[tenantID], rule)
+		}
+	}
+	return rules, nil
+}
@@ -5,6 +5,7 @@ go 1.22
 require (
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/prometheus/client_golang v1.20.0
 	golang.org/x/time v0.5.0
 )
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"high-load-service/models"
+	"high-load-service/utils"
+)
+
+// Live feed parameters
+const (
+	// LiveDefaultInterval and LiveMinInterval bound how often a subscriber
+	// receives updates; updates in between are coalesced per device
+	LiveDefaultInterval = time.Second
+	LiveMinInterval     = 100 * time.Millisecond
+
+	// liveWriteWait is how long a write may take before the subscriber is
+	// considered a slow consumer and disconnected
+	liveWriteWait = 10 * time.Second
+
+	// livePongWait is how long the client may stay silent; pings are sent
+	// more often than that
+	livePongWait   = 60 * time.Second
+	livePingPeriod = livePongWait * 9 / 10
+
+	// liveMaxMessageSize limits the size of client messages
+	liveMaxMessageSize = 4096
+)
+
+// Live feed message types
+const (
+	liveTypeSubscribe  = "subscribe"  // client: replace the subscription
+	liveTypeSubscribed = "subscribed" // server: subscription in effect
+	liveTypeMetric     = "metric"     // server: metric update
+	liveTypeError      = "error"      // server: rejected client message
+)
+
+// LiveSubprotocol is the WebSocket subprotocol of the live feed. Browsers
+// that pass a stream token as a subprotocol must also offer this one, which
+// the server selects, so that the token is never echoed back.
+const LiveSubprotocol = "live"
+
+// newLiveUpgrader creates the WebSocket upgrader of the live feed
+func newLiveUpgrader(checkOrigin func(*http.Request) bool) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		Subprotocols:    []string{LiveSubprotocol},
+		CheckOrigin:     checkOrigin,
+	}
+}
+
+// liveRequest is a client message of the live feed
+type liveRequest struct {
+	Type string `json:"type"`
+	models.LiveFilter
+	Interval string `json:"interval,omitempty"` // e.g. "500ms"
+
+	err error // set if the message could not be decoded
+}
+
+// liveSubscribed confirms the subscription in effect
+type liveSubscribed struct {
+	Type string `json:"type"`
+	models.LiveFilter
+	Interval string `json:"interval"`
+}
+
+// liveMetric is a metric update pushed to the client
+type liveMetric struct {
+	Type string `json:"type"`
+	models.LiveUpdate
+}
+
+// liveError reports a rejected client message
+type liveError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+// LiveFeed handles GET /live - a WebSocket feed of ingested metrics with the
+// rolling average and z-score they updated on their device.
+//
+// The initial subscription is taken from the ?device=, ?metric= (both
+// comma-separated) and ?interval= parameters; the client may replace it at
+// any time by sending {"type":"subscribe","devices":[...],"metrics":[...],
+// "interval":"500ms"}. Each subscriber receives at most one update per device
+// per interval, merging the values reported in between. Subscribers that do
+// not keep up are disconnected. Browsers authenticate with a stream token
+// and must connect from an allowed origin.
+func (h *MetricsHandler) LiveFeed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := liveRequest{
+		Type: liveTypeSubscribe,
+		LiveFilter: models.LiveFilter{
+			Devices: splitList(query.Get("device")),
+			Metrics: splitList(query.Get("metric")),
+		},
+		Interval: query.Get("interval"),
+	}
+	interval, err := liveInterval(req.Interval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has replied to the client
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	requests := make(chan liveRequest)
+	go readLive(conn, requests, done)
+
+	tenantID := utils.TenantFromContext(r.Context())
+	filter := req.LiveFilter
+	sub := h.service.SubscribeLive(tenantID, filter)
+	defer func() { sub.Close() }()
+
+	flush := time.NewTicker(interval)
+	defer flush.Stop()
+	ping := time.NewTicker(livePingPeriod)
+	defer ping.Stop()
+
+	if writeLive(conn, liveSubscribed{liveTypeSubscribed, filter, interval.String()}) != nil {
+		return
+	}
+
+	// Latest update of each device since the last flush
+	pending := make(map[string]models.LiveUpdate)
+
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				return // Client went away
+			}
+			var err error
+			if req.err != nil {
+				err = req.err
+			} else if req.Type != liveTypeSubscribe {
+				err = fmt.Errorf("unknown message type %q", req.Type)
+			} else {
+				var newInterval time.Duration
+				if newInterval, err = liveInterval(req.Interval); err == nil {
+					sub.Close()
+					filter, interval = req.LiveFilter, newInterval
+					sub = h.service.SubscribeLive(tenantID, filter)
+					flush.Reset(interval)
+					clear(pending)
+				}
+			}
+
+			var reply interface{} = liveSubscribed{liveTypeSubscribed, filter, interval.String()}
+			if err != nil {
+				reply = liveError{liveTypeError, err.Error()}
+			}
+			if writeLive(conn, reply) != nil {
+				return
+			}
+
+		case update, ok := <-sub.Events():
+			if !ok {
+				if sub.Dropped() {
+					deadline := time.Now().Add(liveWriteWait)
+					msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+					conn.WriteControl(websocket.CloseMessage, msg, deadline)
+				}
+				return
+			}
+			mergeLive(pending, filter.Select(update))
+
+		case <-flush.C:
+			deviceIDs := make([]string, 0, len(pending))
+			for id := range pending {
+				deviceIDs = append(deviceIDs, id)
+			}
+			sort.Strings(deviceIDs)
+			for _, id := range deviceIDs {
+				if writeLive(conn, liveMetric{liveTypeMetric, pending[id]}) != nil {
+					return
+				}
+			}
+			clear(pending)
+
+		case <-ping.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait)) != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLive reads client messages into requests until the connection fails
+// or done is closed. It also keeps the read deadline moving on pongs.
+func readLive(conn *websocket.Conn, requests chan<- liveRequest, done <-chan struct{}) {
+	defer close(requests)
+
+	conn.SetReadLimit(liveMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(livePongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req liveRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			req.err = fmt.Errorf("invalid message: %w", err)
+		}
+		select {
+		case requests <- req:
+		case <-done:
+			return
+		}
+	}
+}
+
+// writeLive writes a JSON message, failing if the client does not take it in time
+func writeLive(conn *websocket.Conn, v interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+	return conn.WriteJSON(v)
+}
+
+// mergeLive coalesces an update into the pending update of its device
+func mergeLive(pending map[string]models.LiveUpdate, update models.LiveUpdate) {
+	if len(update.Values) == 0 {
+		return
+	}
+	prev, ok := pending[update.DeviceID]
+	if !ok {
+		pending[update.DeviceID] = update
+		return
+	}
+	for name, value := range update.Values {
+		prev.Values[name] = value
+	}
+	for name, a := range update.Analytics {
+		prev.Analytics[name] = a
+	}
+	if update.Timestamp.After(prev.Timestamp) {
+		prev.Timestamp = update.Timestamp
+	}
+	if update.Labels != nil {
+		prev.Labels = update.Labels
+	}
+	pending[update.DeviceID] = prev
+}
+
+// liveInterval parses the update interval of a subscription
+func liveInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return LiveDefaultInterval, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < LiveMinInterval {
+		return 0, fmt.Errorf("interval must be a duration of at least %s", LiveMinInterval)
+	}
+	return d, nil
+}
+
+// splitList splits a comma-separated parameter, ignoring empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -2,22 +2,51 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
+
+	"high-load-service/analytics"
+	"high-load-service/cache"
 	"high-load-service/models"
 	"high-load-service/services"
 	"high-load-service/utils"
 )
 
+// Forecast request defaults and limits
+const (
+	DefaultForecastHorizon = 10
+	MaxForecastHorizon     = 1000
+	DefaultForecastStep    = 10 * time.Second
+)
+
+// Capacity request defaults
+const DefaultCapacityHistory = 1000
+
+// Anomaly event page size defaults and limits
+const (
+	DefaultEventsLimit = 100
+	MaxEventsLimit     = 1000
+)
+
 // MetricsHandler handles HTTP requests for metrics operations
 type MetricsHandler struct {
-	service *services.MetricsService
+	service  *services.MetricsService
+	upgrader websocket.Upgrader
 }
 
-// NewMetricsHandler creates a new MetricsHandler
-func NewMetricsHandler(service *services.MetricsService) *MetricsHandler {
-	return &MetricsHandler{service: service}
+// NewMetricsHandler creates a new MetricsHandler. checkOrigin decides which
+// browser origins may open the live feed.
+func NewMetricsHandler(service *services.MetricsService, checkOrigin func(*http.Request) bool) *MetricsHandler {
+	return &MetricsHandler{
+		service:  service,
+		upgrader: newLiveUpgrader(checkOrigin),
+	}
 }
 
 // IngestMetric handles POST /metrics - accepts incoming metric data
@@ -43,7 +72,12 @@ func (h *MetricsHandler) IngestMetric(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Process the metric
+	metric.TenantID = utils.TenantFromContext(r.Context())
 	if err := h.service.ProcessMetric(metric); err != nil {
+		if errors.Is(err, services.ErrTooManyMetrics) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 		go utils.HandleError(err, "IngestMetric: processing metric")
 		http.Error(w, "Failed to process metric", http.StatusInternalServerError)
 		return
@@ -70,6 +104,7 @@ func (h *MetricsHandler) IngestMetricBatch(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	tenantID := utils.TenantFromContext(r.Context())
 	processed := 0
 	failed := 0
 
@@ -85,6 +120,7 @@ func (h *MetricsHandler) IngestMetricBatch(w http.ResponseWriter, r *http.Reques
 			continue
 		}
 
+		metric.TenantID = tenantID
 		if err := h.service.ProcessMetric(metric); err != nil {
 			failed++
 			continue
@@ -104,11 +140,21 @@ func (h *MetricsHandler) IngestMetricBatch(w http.ResponseWriter, r *http.Reques
 }
 
 // GetAnalytics handles GET /analyze - returns analytics results
+// Optional ?device= query parameter selects a single device's view;
+// ?match= and ?group_by= filter and group devices by label
 func (h *MetricsHandler) GetAnalytics(w http.ResponseWriter, r *http.Request) {
-	result := h.service.GetAnalytics()
+	results, grouped, ok := h.queryAnalytics(w, r)
+	if !ok {
+		return
+	}
+
+	var response interface{} = results[0]
+	if grouped {
+		response = map[string]interface{}{"groups": results}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(result); err != nil {
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		go utils.HandleError(err, "GetAnalytics: encoding response")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
@@ -116,49 +162,407 @@ func (h *MetricsHandler) GetAnalytics(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetAnomalies handles GET /anomalies - returns anomaly statistics
+// Accepts the same ?device=, ?match= and ?group_by= parameters as /analyze
 func (h *MetricsHandler) GetAnomalies(w http.ResponseWriter, r *http.Request) {
-	cpuCount, rpsCount := h.service.GetAnomalyCounts()
+	results, grouped, ok := h.queryAnalytics(w, r)
+	if !ok {
+		return
+	}
 
-	response := map[string]interface{}{
-		"cpu_anomalies": cpuCount,
-		"rps_anomalies": rpsCount,
-		"total":         cpuCount + rpsCount,
-		"threshold":     services.ZScoreThreshold,
-		"window_size":   services.WindowSize,
+	cfg := h.service.Config()
+	views := make([]map[string]interface{}, len(results))
+	for i, result := range results {
+		counts := anomalyCounts(result)
+		shifts := levelShiftCounts(result)
+		bySeverity, severityTotals := severityCounts(result)
+		views[i] = map[string]interface{}{
+			"anomalies":          counts,
+			"total":              sumCounts(counts),
+			"by_severity":        bySeverity,
+			"total_by_severity":  severityTotals,
+			"level_shifts":       shifts,
+			"total_level_shifts": sumCounts(shifts),
+			"threshold":          cfg.ZScoreThreshold,
+			"window_size":        cfg.WindowSize,
+			"detectors":          detectorNames(result),
+		}
+		addScope(views[i], result)
+	}
+
+	writeViews(w, views, grouped)
+}
+
+// GetAnomalyEvents handles GET /anomalies/events - returns stored anomaly events
+// ordered by timestamp. Query parameters: from (inclusive) and to (exclusive)
+// RFC3339 event timestamps, metric, device, limit, and cursor (next_cursor of
+// the previous page)
+func (h *MetricsHandler) GetAnomalyEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	eventQuery := models.AnomalyEventQuery{
+		AnomalyEventFilter: anomalyEventFilter(r),
+		Limit:              DefaultEventsLimit,
+		Cursor:             query.Get("cursor"),
+	}
+
+	for name, bound := range map[string]*time.Time{"from": &eventQuery.From, "to": &eventQuery.To} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, name+" must be an RFC3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			*bound = t
+		}
+	}
+
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxEventsLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", MaxEventsLimit), http.StatusBadRequest)
+			return
+		}
+		eventQuery.Limit = n
+	}
+
+	page, err := h.service.AnomalyEvents(utils.TenantFromContext(r.Context()), eventQuery)
+	if err != nil {
+		writeServiceError(w, err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(page)
 }
 
 // GetStats handles GET /stats - returns service statistics
+// Accepts the same ?device=, ?match= and ?group_by= parameters as /analyze
 func (h *MetricsHandler) GetStats(w http.ResponseWriter, r *http.Request) {
-	analytics := h.service.GetAnalytics()
-	cpuCount, rpsCount := h.service.GetAnomalyCounts()
+	results, grouped, ok := h.queryAnalytics(w, r)
+	if !ok {
+		return
+	}
 
-	response := map[string]interface{}{
-		"total_metrics":   h.service.GetTotalMetrics(),
-		"window_size":     services.WindowSize,
-		"zscore_threshold": services.ZScoreThreshold,
-		"current": map[string]float64{
-			"cpu": analytics.CurrentCPU,
-			"rps": analytics.CurrentRPS,
-		},
-		"averages": map[string]float64{
-			"cpu": analytics.AvgCPU,
-			"rps": analytics.AvgRPS,
-		},
-		"predictions": map[string]float64{
-			"cpu": analytics.PredictedCPU,
-			"rps": analytics.PredictedRPS,
-		},
-		"anomalies": map[string]int64{
-			"cpu":   cpuCount,
-			"rps":   rpsCount,
-			"total": cpuCount + rpsCount,
-		},
+	cfg := h.service.Config()
+	views := make([]map[string]interface{}, len(results))
+	for i, result := range results {
+		current := make(map[string]float64, len(result.Metrics))
+		averages := make(map[string]float64, len(result.Metrics))
+		predictions := make(map[string]float64, len(result.Metrics))
+		percentiles := make(map[string]models.Percentiles, len(result.Metrics))
+		for name, m := range result.Metrics {
+			current[name] = m.Current
+			averages[name] = m.Avg
+			predictions[name] = m.Predicted
+			percentiles[name] = m.Percentiles
+		}
+		anomalies := anomalyCounts(result)
+		anomalies["total"] = sumCounts(anomalies)
+
+		views[i] = map[string]interface{}{
+			"total_metrics":    result.TotalMetrics,
+			"devices":          h.service.GetDeviceCount(utils.TenantFromContext(r.Context())),
+			"window_size":      cfg.WindowSize,
+			"zscore_threshold": cfg.ZScoreThreshold,
+			"detectors":        detectorNames(result),
+			"current":          current,
+			"averages":         averages,
+			"percentiles":      percentiles,
+			"predictions":      predictions,
+			"anomalies":        anomalies,
+		}
+		addScope(views[i], result)
+	}
+
+	writeViews(w, views, grouped)
+}
+
+// GetForecast handles GET /forecast - returns a multi-step forecast of a metric
+// Query parameters: metric (required), device, horizon (steps), step (duration),
+// confidence (prediction interval coverage, 0-1)
+func (h *MetricsHandler) GetForecast(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	metric := query.Get("metric")
+	if metric == "" {
+		http.Error(w, "metric is required", http.StatusBadRequest)
+		return
+	}
+
+	horizon := DefaultForecastHorizon
+	if v := query.Get("horizon"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxForecastHorizon {
+			http.Error(w, fmt.Sprintf("horizon must be between 1 and %d", MaxForecastHorizon), http.StatusBadRequest)
+			return
+		}
+		horizon = n
+	}
+
+	step := DefaultForecastStep
+	if v := query.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "step must be a positive duration, e.g. 10s", http.StatusBadRequest)
+			return
+		}
+		step = d
+	}
+
+	confidence := analytics.DefaultConfidence
+	if v := query.Get("confidence"); v != "" {
+		c, err := strconv.ParseFloat(v, 64)
+		if err != nil || c <= 0 || c >= 1 {
+			http.Error(w, "confidence must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		confidence = c
+	}
+
+	result, err := h.service.Forecast(utils.TenantFromContext(r.Context()), query.Get("device"), metric, horizon, step, confidence)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetCorrelation handles GET /correlation - returns the correlation of two metrics
+// Query parameters: a and b (required metric names), device
+func (h *MetricsHandler) GetCorrelation(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	a, b := query.Get("a"), query.Get("b")
+	if a == "" || b == "" {
+		http.Error(w, "a and b are required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.service.Correlation(utils.TenantFromContext(r.Context()), query.Get("device"), a, b)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetCapacity handles GET /capacity - estimates when a metric crosses a threshold
+// Query parameters: metric and threshold (required), device, direction
+// (above|below, default above), history (stored samples to fit), confidence
+func (h *MetricsHandler) GetCapacity(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	metric := query.Get("metric")
+	if metric == "" {
+		http.Error(w, "metric is required", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := strconv.ParseFloat(query.Get("threshold"), 64)
+	if err != nil {
+		http.Error(w, "threshold must be a number", http.StatusBadRequest)
+		return
+	}
+
+	above := true
+	switch query.Get("direction") {
+	case "", "above":
+	case "below":
+		above = false
+	default:
+		http.Error(w, "direction must be above or below", http.StatusBadRequest)
+		return
+	}
+
+	history := int64(DefaultCapacityHistory)
+	if v := query.Get("history"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > cache.MaxMetricsStored {
+			http.Error(w, fmt.Sprintf("history must be between 1 and %d", cache.MaxMetricsStored), http.StatusBadRequest)
+			return
+		}
+		history = n
+	}
+
+	confidence := analytics.DefaultConfidence
+	if v := query.Get("confidence"); v != "" {
+		c, err := strconv.ParseFloat(v, 64)
+		if err != nil || c <= 0 || c >= 1 {
+			http.Error(w, "confidence must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		confidence = c
+	}
+
+	result, err := h.service.Capacity(utils.TenantFromContext(r.Context()), query.Get("device"), metric, threshold, above, history, confidence)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// queryAnalytics resolves the tenant and the ?device=, ?match= and ?group_by= parameters of
+// a read request. It writes an error response and returns ok=false on failure.
+func (h *MetricsHandler) queryAnalytics(w http.ResponseWriter, r *http.Request) (results []models.AnalyticsResult, grouped, ok bool) {
+	tenantID := utils.TenantFromContext(r.Context())
+	query := r.URL.Query()
+	device := query.Get("device")
+
+	matchers, err := models.ParseLabelMatchers(query.Get("match"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+	groupBy, err := parseGroupBy(query.Get("group_by"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+
+	if device == "" && (len(matchers) > 0 || len(groupBy) > 0) {
+		return h.service.GetGroupedAnalytics(tenantID, matchers, groupBy), true, true
+	}
+
+	result, err := h.service.GetAnalytics(tenantID, device)
+	if err != nil {
+		writeServiceError(w, err)
+		return nil, false, false
+	}
+	if !models.MatchLabels(matchers, result.Labels) {
+		writeServiceError(w, services.ErrDeviceNotFound)
+		return nil, false, false
+	}
+	return []models.AnalyticsResult{result}, false, true
+}
+
+// parseGroupBy parses a comma-separated list of label names
+func parseGroupBy(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !models.ValidLabelName(name) {
+			return nil, fmt.Errorf("invalid group_by label %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// addScope annotates a response view with the device or group it describes
+func addScope(view map[string]interface{}, result models.AnalyticsResult) {
+	if result.DeviceID != "" {
+		view["device_id"] = result.DeviceID
+	}
+	if result.Devices > 0 {
+		view["labels"] = result.Labels
+		view["devices"] = result.Devices
+	}
+}
+
+// writeViews writes a single view, or all views as groups
+func writeViews(w http.ResponseWriter, views []map[string]interface{}, grouped bool) {
+	var response interface{} = views[0]
+	if grouped {
+		response = map[string]interface{}{"groups": views}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// anomalyCounts returns anomaly counters keyed by metric name
+func anomalyCounts(result models.AnalyticsResult) map[string]int64 {
+	counts := make(map[string]int64, len(result.Metrics)+1)
+	for name, m := range result.Metrics {
+		counts[name] = m.Anomalies
+	}
+	return counts
+}
+
+// severityCounts returns the anomaly counters of each metric by severity,
+// and their totals by severity
+func severityCounts(result models.AnalyticsResult) (map[string]map[string]int64, map[string]int64) {
+	byMetric := make(map[string]map[string]int64, len(result.Metrics))
+	totals := make(map[string]int64, len(models.Severities))
+	for _, severity := range models.Severities {
+		totals[severity] = 0
+	}
+	for name, m := range result.Metrics {
+		counts := make(map[string]int64, len(models.Severities))
+		for _, severity := range models.Severities {
+			counts[severity] = m.Severities[severity]
+			totals[severity] += m.Severities[severity]
+		}
+		byMetric[name] = counts
+	}
+	return byMetric, totals
+}
+
+// levelShiftCounts returns the level shift counter of each metric
+func levelShiftCounts(result models.AnalyticsResult) map[string]int64 {
+	counts := make(map[string]int64, len(result.Metrics))
+	for name, m := range result.Metrics {
+		counts[name] = m.LevelShifts
+	}
+	return counts
+}
+
+// detectorNames returns the detector used for each metric
+func detectorNames(result models.AnalyticsResult) map[string]string {
+	names := make(map[string]string, len(result.Metrics))
+	for name, m := range result.Metrics {
+		names[name] = m.Detector
+	}
+	return names
+}
+
+// sumCounts returns the sum of all counters
+func sumCounts(counts map[string]int64) int64 {
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	return total
+}
+
+// anomalyEventFilter returns the anomaly event filter of the ?metric= and ?device= parameters
+func anomalyEventFilter(r *http.Request) models.AnomalyEventFilter {
+	query := r.URL.Query()
+	return models.AnomalyEventFilter{
+		MetricType: query.Get("metric"),
+		DeviceID:   query.Get("device"),
+	}
+}
+
+// writeServiceError maps service errors to HTTP responses
+func writeServiceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrDeviceNotFound) || errors.Is(err, services.ErrMetricNotFound) ||
+		errors.Is(err, services.ErrRuleNotFound) || errors.Is(err, services.ErrPairNotTracked) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, services.ErrRuleNameTaken) || errors.Is(err, services.ErrTooManyRules) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, cache.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, services.ErrHistoryUnavailable) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	go utils.HandleError(err, "service error")
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"high-load-service/models"
+	"high-load-service/utils"
+)
+
+// ListAlertRules handles GET /rules - returns the tenant's alert rules
+func (h *MetricsHandler) ListAlertRules(w http.ResponseWriter, r *http.Request) {
+	rules := h.service.AlertRules(utils.TenantFromContext(r.Context()))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": rules})
+}
+
+// GetAlertRule handles GET /rules/{id} - returns an alert rule
+func (h *MetricsHandler) GetAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := h.service.AlertRule(utils.TenantFromContext(r.Context()), mux.Vars(r)["id"])
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// CreateAlertRule handles POST /rules - adds an alert rule, e.g.
+// {"name":"cpu-hot","kind":"threshold","metric":"cpu","op":">","threshold":90,"for":"2m"}
+func (h *MetricsHandler) CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeAlertRule(w, r)
+	if !ok {
+		return
+	}
+
+	rule, err := h.service.CreateAlertRule(utils.TenantFromContext(r.Context()), rule)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// UpdateAlertRule handles PUT /rules/{id} - replaces an alert rule; its
+// alerts end and its conditions are evaluated afresh
+func (h *MetricsHandler) UpdateAlertRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeAlertRule(w, r)
+	if !ok {
+		return
+	}
+
+	rule, err := h.service.UpdateAlertRule(utils.TenantFromContext(r.Context()), mux.Vars(r)["id"], rule)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// DeleteAlertRule handles DELETE /rules/{id} - deletes an alert rule; its
+// firing alerts are resolved
+func (h *MetricsHandler) DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.DeleteAlertRule(utils.TenantFromContext(r.Context()), mux.Vars(r)["id"]); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAlerts handles GET /alerts - returns the alerts of the tenant's rules.
+// Query parameters: state (pending, firing or resolved) and rule (rule ID)
+func (h *MetricsHandler) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.AlertFilter{
+		State:  query.Get("state"),
+		RuleID: query.Get("rule"),
+	}
+	switch filter.State {
+	case "", models.AlertStatePending, models.AlertStateFiring, models.AlertStateResolved:
+	default:
+		http.Error(w, "state must be pending, firing or resolved", http.StatusBadRequest)
+		return
+	}
+
+	alerts, err := h.service.Alerts(utils.TenantFromContext(r.Context()), filter)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"alerts": alerts})
+}
+
+// decodeAlertRule reads and validates an alert rule definition from the
+// request body. Unknown fields are rejected so that misspelt conditions do
+// not silently fall back to defaults.
+func decodeAlertRule(w http.ResponseWriter, r *http.Request) (models.AlertRule, bool) {
+	var rule models.AlertRule
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return rule, false
+	}
+	if err := rule.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return rule, false
+	}
+	return rule, true
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"high-load-service/cache"
+	"high-load-service/models"
+	"high-load-service/services"
+	"high-load-service/utils"
+)
+
+// Anomaly stream parameters
+const (
+	// StreamHeartbeatInterval is how often a heartbeat comment is sent,
+	// keeping idle connections open through proxies
+	StreamHeartbeatInterval = 15 * time.Second
+
+	// StreamRetry is the reconnection delay suggested to SSE clients
+	StreamRetry = 3 * time.Second
+)
+
+// StreamAnomalies handles GET /anomalies/stream - pushes anomaly events as
+// Server-Sent Events as they are detected. Query parameters: metric, device.
+// A Last-Event-ID header (or ?last_event_id=) first replays the events stored
+// after that event, by sequence number, so reconnecting clients miss nothing.
+func (h *MetricsHandler) StreamAnomalies(w http.ResponseWriter, r *http.Request) {
+	tenantID := utils.TenantFromContext(r.Context())
+	filter := anomalyEventFilter(r)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	// Sequence number of the last event the client has, if any
+	var lastSeq int64
+	if lastEventID != "" {
+		var err error
+		if lastSeq, err = cache.EventSequence(lastEventID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before reading the history so that no event falls between the two
+	sub := h.service.SubscribeAnomalies(tenantID, filter)
+	defer sub.Close()
+
+	query := models.AnomalyEventQuery{
+		AnomalyEventFilter: filter,
+		Limit:              MaxEventsLimit,
+		Cursor:             lastEventID,
+		Stored:             true,
+	}
+	var page models.AnomalyEventPage
+	if lastEventID != "" {
+		var err error
+		page, err = h.service.AnomalyEvents(tenantID, query)
+		if err != nil && !errors.Is(err, services.ErrHistoryUnavailable) {
+			writeServiceError(w, err)
+			return
+		}
+	}
+
+	// Streams outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		go utils.HandleError(err, "StreamAnomalies: clearing write deadline")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", StreamRetry.Milliseconds())
+
+	// Replay the history; events are stored and published in sequence order,
+	// so live events up to the last sequence sent were already replayed
+	for {
+		for _, event := range page.Events {
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			lastSeq = eventSequence(event, lastSeq)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+		var err error
+		if page, err = h.service.AnomalyEvents(tenantID, query); err != nil {
+			go utils.HandleError(err, "StreamAnomalies: replaying history")
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		go utils.HandleError(err, "StreamAnomalies: streaming not supported")
+		return
+	}
+
+	heartbeat := time.NewTicker(StreamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Fell behind or shutting down; the client resumes from its last event ID
+				return
+			}
+			seq := eventSequence(event, 0)
+			if seq != 0 && seq <= lastSeq {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			lastSeq = max(lastSeq, seq)
+
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// eventSequence returns the sequence number of a stored event, or fallback
+// for events that were not stored
+func eventSequence(event models.AnomalyEvent, fallback int64) int64 {
+	if seq, err := cache.EventSequence(event.ID); err == nil {
+		return seq
+	}
+	return fallback
+}
+
+// writeEvent writes an anomaly event as an SSE message
+func writeEvent(w io.Writer, event models.AnomalyEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: anomaly\ndata: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"high-load-service/utils"
+)
+
+// TokenHandler handles HTTP requests for stream tokens
+type TokenHandler struct {
+	tokens *utils.StreamTokens
+}
+
+// NewTokenHandler creates a new TokenHandler
+func NewTokenHandler(tokens *utils.StreamTokens) *TokenHandler {
+	return &TokenHandler{tokens: tokens}
+}
+
+// streamToken is the response of POST /stream-tokens
+type streamToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueStreamToken handles POST /stream-tokens - issues a short-lived token
+// for the tenant of the request's API key, which the streaming routes accept
+// as ?access_token= or in the stream_token cookie set by this response.
+// Browsers cannot send an API key header with EventSource.
+func (h *TokenHandler) IssueStreamToken(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	token, expires := h.tokens.Issue(utils.TenantFromContext(r.Context()), now)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     utils.StreamTokenCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(expires.Sub(now).Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(streamToken{Token: token, ExpiresAt: expires})
+}
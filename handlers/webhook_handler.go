@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"high-load-service/services"
+	"high-load-service/utils"
+)
+
+// Dead letter page size defaults and limits
+const (
+	DefaultDeadLettersLimit = 100
+	MaxDeadLettersLimit     = 1000
+)
+
+// WebhookHandler handles HTTP requests for webhook operations
+type WebhookHandler struct {
+	dispatcher *services.WebhookDispatcher
+}
+
+// NewWebhookHandler creates a new WebhookHandler
+func NewWebhookHandler(dispatcher *services.WebhookDispatcher) *WebhookHandler {
+	return &WebhookHandler{dispatcher: dispatcher}
+}
+
+// GetDeadLetters handles GET /webhooks/dead-letters - returns the webhook
+// deliveries that exhausted their retries, newest first.
+// Query parameters: limit and offset
+func (h *WebhookHandler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := int64(DefaultDeadLettersLimit)
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > MaxDeadLettersLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", MaxDeadLettersLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var offset int64
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	deadLetters, total, err := h.dispatcher.DeadLetters(utils.TenantFromContext(r.Context()), limit, offset)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"dead_letters": deadLetters,
+		"total":        total,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RedriveDeadLetter handles POST /webhooks/dead-letters/{id}/redrive - queues
+// a dead letter for delivery again
+func (h *WebhookHandler) RedriveDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := h.dispatcher.Redrive(utils.TenantFromContext(r.Context()), id); err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	writeRedriven(w, 1)
+}
+
+// RedriveDeadLetters handles POST /webhooks/dead-letters/redrive - queues every
+// dead letter whose endpoint is still configured for delivery again
+func (h *WebhookHandler) RedriveDeadLetters(w http.ResponseWriter, r *http.Request) {
+	n, err := h.dispatcher.RedriveAll(utils.TenantFromContext(r.Context()))
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	writeRedriven(w, n)
+}
+
+// writeRedriven replies that n dead letters were queued for delivery
+func writeRedriven(w http.ResponseWriter, n int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"redriven": n})
+}
+
+// writeWebhookError maps dispatcher errors to HTTP status codes
+func writeWebhookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrDeadLetterNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrWebhookEndpointRemoved):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, services.ErrDeadLettersUnavailable):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		go utils.HandleError(err, "webhook error")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"high-load-service/cache"
 	"high-load-service/handlers"
 	"high-load-service/metrics"
+	"high-load-service/models"
 	"high-load-service/services"
 	"high-load-service/utils"
 )
@@ -32,16 +33,102 @@ func main() {
 		redisClient = nil
 	}
 
+	// Load analytics configuration
+	cfg, err := services.LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Load tenant API keys; without any the service is single-tenant
+	tenantKeys, err := utils.LoadTenantKeys()
+	if err != nil {
+		log.Fatalf("Invalid TENANT_API_KEYS: %v", err)
+	}
+	if tenantKeys == nil {
+		log.Println("Warning: TENANT_API_KEYS not set, serving the default tenant without authentication")
+	}
+
+	// Stream tokens let browsers authenticate the streaming routes, which
+	// cannot carry an API key header
+	streamTokens, err := utils.LoadStreamTokens("/anomalies/stream", "/live")
+	if err != nil {
+		log.Fatalf("Invalid stream token configuration: %v", err)
+	}
+	if tenantKeys != nil && os.Getenv("STREAM_TOKEN_SECRET") == "" {
+		log.Println("Warning: STREAM_TOKEN_SECRET not set, stream tokens are only accepted by the replica that issued them")
+	}
+
+	// Browser origins allowed to open the live feed besides the service's own
+	liveOrigins, err := utils.LoadOriginPolicy()
+	if err != nil {
+		log.Fatalf("Invalid LIVE_ALLOWED_ORIGINS: %v", err)
+	}
+
+	// Load webhook configuration
+	webhookCfg, err := services.LoadWebhookConfig()
+	if err != nil {
+		log.Fatalf("Invalid webhook configuration: %v", err)
+	}
+	webhookDispatcher := services.NewWebhookDispatcher(redisClient, webhookCfg, metrics.RecordWebhookDelivery)
+
 	// Anomaly callback for Prometheus metrics
-	onAnomaly := func(metricType string) {
-		metrics.RecordAnomaly(metricType)
+	onAnomaly := func(event models.AnomalyEvent) {
+		metrics.RecordAnomaly(event.TenantID, cfg.MetricLabel(event.MetricType), event.EventType, event.Severity)
+	}
+
+	// Update callback for Prometheus gauges
+	onUpdate := func(tenantID, metricName string, current, avg, zscore float64) {
+		metrics.UpdateMetricValues(tenantID, metricName, current, avg, zscore)
+	}
+
+	// Percentile callback for Prometheus gauges
+	onPercentiles := func(tenantID, metricName string, p models.Percentiles) {
+		metrics.UpdateMetricPercentiles(tenantID, metricName, p.P50, p.P95, p.P99)
+	}
+
+	// Correlation callback for Prometheus gauges
+	onCorrelation := func(tenantID, a, b string, c models.Correlation) {
+		if c.Pearson != nil {
+			metrics.UpdateMetricCorrelation(tenantID, a, b, "pearson", *c.Pearson)
+		}
+		if c.Spearman != nil {
+			metrics.UpdateMetricCorrelation(tenantID, a, b, "spearman", *c.Spearman)
+		}
+	}
+
+	// Alert transition callback for webhooks
+	onAlert := func(alert models.Alert, previous string) {
+		if alert.State == models.AlertStateFiring || alert.State == models.AlertStateResolved {
+			webhookDispatcher.DispatchAlert(alert)
+		}
+	}
+
+	// Current alerts callback for Prometheus gauges of pending and firing alerts
+	onAlerts := func(alerts []models.Alert) {
+		counts := make(map[metrics.AlertLabels]int)
+		for _, alert := range alerts {
+			if alert.State == models.AlertStatePending || alert.State == models.AlertStateFiring {
+				counts[metrics.AlertLabels{Tenant: alert.TenantID, Rule: alert.Rule, Severity: alert.Severity, State: alert.State}]++
+			}
+		}
+		metrics.SetAlerts(counts)
 	}
 
 	// Initialize services
-	metricsService := services.NewMetricsService(redisClient, onAnomaly)
+	metricsService := services.NewMetricsService(redisClient, cfg, services.Hooks{
+		OnAnomaly:     onAnomaly,
+		OnEvent:       webhookDispatcher.Dispatch,
+		OnUpdate:      onUpdate,
+		OnPercentiles: onPercentiles,
+		OnCorrelation: onCorrelation,
+		OnAlert:       onAlert,
+		OnAlerts:      onAlerts,
+	})
 
 	// Initialize handlers
-	metricsHandler := handlers.NewMetricsHandler(metricsService)
+	metricsHandler := handlers.NewMetricsHandler(metricsService, liveOrigins.Check)
+	webhookHandler := handlers.NewWebhookHandler(webhookDispatcher)
+	tokenHandler := handlers.NewTokenHandler(streamTokens)
 
 	// Create router
 	r := mux.NewRouter()
@@ -53,7 +140,27 @@ func main() {
 	// Analytics endpoints
 	r.HandleFunc("/analyze", metricsHandler.GetAnalytics).Methods("GET")
 	r.HandleFunc("/anomalies", metricsHandler.GetAnomalies).Methods("GET")
+	r.HandleFunc("/anomalies/events", metricsHandler.GetAnomalyEvents).Methods("GET")
+	r.HandleFunc("/anomalies/stream", metricsHandler.StreamAnomalies).Methods("GET")
+	r.HandleFunc("/stream-tokens", tokenHandler.IssueStreamToken).Methods("POST")
+	r.HandleFunc("/live", metricsHandler.LiveFeed).Methods("GET")
 	r.HandleFunc("/stats", metricsHandler.GetStats).Methods("GET")
+	r.HandleFunc("/forecast", metricsHandler.GetForecast).Methods("GET")
+	r.HandleFunc("/capacity", metricsHandler.GetCapacity).Methods("GET")
+	r.HandleFunc("/correlation", metricsHandler.GetCorrelation).Methods("GET")
+
+	// API routes - alert rules
+	r.HandleFunc("/rules", metricsHandler.ListAlertRules).Methods("GET")
+	r.HandleFunc("/rules", metricsHandler.CreateAlertRule).Methods("POST")
+	r.HandleFunc("/rules/{id}", metricsHandler.GetAlertRule).Methods("GET")
+	r.HandleFunc("/rules/{id}", metricsHandler.UpdateAlertRule).Methods("PUT")
+	r.HandleFunc("/rules/{id}", metricsHandler.DeleteAlertRule).Methods("DELETE")
+	r.HandleFunc("/alerts", metricsHandler.GetAlerts).Methods("GET")
+
+	// API routes - webhooks
+	r.HandleFunc("/webhooks/dead-letters", webhookHandler.GetDeadLetters).Methods("GET")
+	r.HandleFunc("/webhooks/dead-letters/redrive", webhookHandler.RedriveDeadLetters).Methods("POST")
+	r.HandleFunc("/webhooks/dead-letters/{id}/redrive", webhookHandler.RedriveDeadLetter).Methods("POST")
 
 	// Health check
 	r.HandleFunc("/health", healthCheck(redisClient)).Methods("GET")
@@ -66,8 +173,9 @@ func main() {
 	rateLimiter := utils.NewRateLimiter(rate.Limit(2000), 50000)
 	rateLimitMiddleware := utils.RateLimitMiddleware(rateLimiter)
 
-	// Wrap handler with middlewares (order: rate limit first, then metrics)
+	// Wrap handler with middlewares (order: rate limit first, then tenant, then metrics)
 	var handler http.Handler = r
+	handler = utils.TenantMiddleware(tenantKeys, streamTokens, "/health", "/metrics")(handler)
 	handler = rateLimitMiddleware(handler)
 	handler = metrics.MetricsMiddleware(handler)
 
@@ -89,7 +197,23 @@ func main() {
 	log.Printf("  - POST   /ingest/batch     (ingest batch of metrics)")
 	log.Printf("  - GET    /analyze          (get analytics results)")
 	log.Printf("  - GET    /anomalies        (get anomaly statistics)")
+	log.Printf("  - GET    /anomalies/events (get anomaly event history)")
+	log.Printf("  - GET    /anomalies/stream (live anomaly events, SSE)")
+	log.Printf("  - POST   /stream-tokens    (token for browser streaming clients)")
+	log.Printf("  - GET    /live             (live metrics feed, WebSocket)")
 	log.Printf("  - GET    /stats            (get service statistics)")
+	log.Printf("  - GET    /forecast         (get multi-step forecast)")
+	log.Printf("  - GET    /capacity         (get time to threshold crossing)")
+	log.Printf("  - GET    /correlation      (get correlation between two metrics)")
+	log.Printf("  - GET    /rules            (list alert rules)")
+	log.Printf("  - POST   /rules            (create alert rule)")
+	log.Printf("  - GET    /rules/{id}       (get alert rule)")
+	log.Printf("  - PUT    /rules/{id}       (replace alert rule)")
+	log.Printf("  - DELETE /rules/{id}       (delete alert rule)")
+	log.Printf("  - GET    /alerts           (pending, firing and resolved alerts)")
+	log.Printf("  - GET    /webhooks/dead-letters             (failed webhook deliveries)")
+	log.Printf("  - POST   /webhooks/dead-letters/redrive     (redrive all dead letters)")
+	log.Printf("  - POST   /webhooks/dead-letters/{id}/redrive (redrive a dead letter)")
 	log.Printf("  - GET    /health           (health check)")
 	log.Printf("  - GET    /metrics          (Prometheus metrics)")
 
@@ -101,6 +225,7 @@ func main() {
 
 		log.Println("Shutting down gracefully...")
 		metricsService.Stop()
+		webhookDispatcher.Stop()
 		if redisClient != nil {
 			redisClient.Close()
 		}
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"bufio"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -52,7 +54,7 @@ var (
 			Name: "anomaly_detected_total",
 			Help: "Total number of detected anomalies",
 		},
-		[]string{"metric_type"},
+		[]string{"tenant", "metric_type", "event_type", "severity"},
 	)
 
 	// AnomalyRate tracks the rate of anomalies
@@ -72,52 +74,68 @@ var (
 		},
 	)
 
-	// CurrentCPU tracks current CPU metric value
-	CurrentCPU = prometheus.NewGauge(
+	// MetricCurrent tracks the current value of each IoT metric
+	MetricCurrent = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "iot_cpu_current",
-			Help: "Current CPU metric value from IoT devices",
+			Name: "iot_metric_current",
+			Help: "Current metric value from IoT devices",
 		},
+		[]string{"tenant", "metric"},
 	)
 
-	// CurrentRPS tracks current RPS metric value
-	CurrentRPS = prometheus.NewGauge(
+	// MetricAvg tracks the rolling average of each IoT metric
+	MetricAvg = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "iot_rps_current",
-			Help: "Current RPS metric value from IoT devices",
+			Name: "iot_metric_avg",
+			Help: "Rolling average of IoT metric",
 		},
+		[]string{"tenant", "metric"},
 	)
 
-	// AvgCPU tracks rolling average CPU
-	AvgCPU = prometheus.NewGauge(
+	// MetricZScore tracks the z-score of each IoT metric
+	MetricZScore = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "iot_cpu_avg",
-			Help: "Rolling average CPU metric",
+			Name: "iot_metric_zscore",
+			Help: "Z-score of current IoT metric value",
 		},
+		[]string{"tenant", "metric"},
 	)
 
-	// AvgRPS tracks rolling average RPS
-	AvgRPS = prometheus.NewGauge(
+	// MetricQuantile tracks streaming percentiles of each IoT metric
+	MetricQuantile = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "iot_rps_avg",
-			Help: "Rolling average RPS metric",
+			Name: "iot_metric_quantile",
+			Help: "Streaming percentile estimate of IoT metric",
 		},
+		[]string{"tenant", "metric", "quantile"},
 	)
 
-	// ZScoreCPU tracks CPU z-score
-	ZScoreCPU = prometheus.NewGauge(
+	// MetricCorrelation tracks the fleet-wide correlation of metric pairs
+	MetricCorrelation = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "iot_cpu_zscore",
-			Help: "Z-score of current CPU metric",
+			Name: "iot_metric_correlation",
+			Help: "Rolling correlation between two IoT metrics",
 		},
+		[]string{"tenant", "a", "b", "method"},
 	)
 
-	// ZScoreRPS tracks RPS z-score
-	ZScoreRPS = prometheus.NewGauge(
+	// Alerts tracks the pending and firing alerts of each alert rule
+	Alerts = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "iot_rps_zscore",
-			Help: "Z-score of current RPS metric",
+			Name: "iot_alerts",
+			Help: "Number of pending and firing alerts per alert rule",
+		},
+		[]string{"tenant", "rule", "severity", "state"},
+	)
+
+	// WebhookDeliveriesTotal counts webhook delivery outcomes per endpoint,
+	// labeled by endpoint name since URLs may carry credentials
+	WebhookDeliveriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Total number of webhook delivery attempts by result",
 		},
+		[]string{"tenant", "endpoint", "result"},
 	)
 )
 
@@ -134,27 +152,58 @@ func init() {
 
 	// IoT metrics
 	prometheus.MustRegister(MetricsProcessed)
-	prometheus.MustRegister(CurrentCPU)
-	prometheus.MustRegister(CurrentRPS)
-	prometheus.MustRegister(AvgCPU)
-	prometheus.MustRegister(AvgRPS)
-	prometheus.MustRegister(ZScoreCPU)
-	prometheus.MustRegister(ZScoreRPS)
+	prometheus.MustRegister(MetricCurrent)
+	prometheus.MustRegister(MetricAvg)
+	prometheus.MustRegister(MetricZScore)
+	prometheus.MustRegister(MetricQuantile)
+	prometheus.MustRegister(MetricCorrelation)
+
+	// Alert and webhook metrics
+	prometheus.MustRegister(Alerts)
+	prometheus.MustRegister(WebhookDeliveriesTotal)
+}
+
+// RecordAnomaly increments the anomaly counter for a tenant's metric, event type and severity
+func RecordAnomaly(tenantID, metricType, eventType, severity string) {
+	AnomalyDetectedTotal.WithLabelValues(tenantID, metricType, eventType, severity).Inc()
+}
+
+// UpdateMetricValues updates the gauges of a tenant's named metric
+func UpdateMetricValues(tenantID, metricName string, current, avg, zscore float64) {
+	MetricCurrent.WithLabelValues(tenantID, metricName).Set(current)
+	MetricAvg.WithLabelValues(tenantID, metricName).Set(avg)
+	MetricZScore.WithLabelValues(tenantID, metricName).Set(zscore)
+}
+
+// UpdateMetricPercentiles updates the percentile gauges of a tenant's named metric
+func UpdateMetricPercentiles(tenantID, metricName string, p50, p95, p99 float64) {
+	MetricQuantile.WithLabelValues(tenantID, metricName, "0.5").Set(p50)
+	MetricQuantile.WithLabelValues(tenantID, metricName, "0.95").Set(p95)
+	MetricQuantile.WithLabelValues(tenantID, metricName, "0.99").Set(p99)
 }
 
-// RecordAnomaly increments the anomaly counter for a metric type
-func RecordAnomaly(metricType string) {
-	AnomalyDetectedTotal.WithLabelValues(metricType).Inc()
+// UpdateMetricCorrelation updates the correlation gauge of a tenant's metric pair
+func UpdateMetricCorrelation(tenantID, a, b, method string, value float64) {
+	MetricCorrelation.WithLabelValues(tenantID, a, b, method).Set(value)
 }
 
-// UpdateMetricValues updates the current metric gauges
-func UpdateMetricValues(cpu, rps, avgCPU, avgRPS, zscoreCPU, zscoreRPS float64) {
-	CurrentCPU.Set(cpu)
-	CurrentRPS.Set(rps)
-	AvgCPU.Set(avgCPU)
-	AvgRPS.Set(avgRPS)
-	ZScoreCPU.Set(zscoreCPU)
-	ZScoreRPS.Set(zscoreRPS)
+// AlertLabels identifies an alert gauge
+type AlertLabels struct {
+	Tenant, Rule, Severity, State string
+}
+
+// SetAlerts replaces the alert gauges with the given numbers of alerts;
+// replicas that do not evaluate alert rules export none
+func SetAlerts(counts map[AlertLabels]int) {
+	Alerts.Reset()
+	for l, n := range counts {
+		Alerts.WithLabelValues(l.Tenant, l.Rule, l.Severity, l.State).Set(float64(n))
+	}
+}
+
+// RecordWebhookDelivery increments the webhook delivery counter for an endpoint and result
+func RecordWebhookDelivery(tenantID, endpoint, result string) {
+	WebhookDeliveriesTotal.WithLabelValues(tenantID, endpoint, result).Inc()
 }
 
 // IncrementMetricsProcessed increments the processed metrics counter
@@ -184,6 +233,21 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	return rw.ResponseWriter.Write(b)
 }
 
+// Hijack lets WebSocket upgrades take over the connection
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// Unwrap returns the underlying ResponseWriter, so that http.ResponseController
+// can reach its Flush and deadline methods for streaming responses
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // MetricsMiddleware records metrics for each request
 func MetricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -218,7 +282,7 @@ func MetricsMiddleware(next http.Handler) http.Handler {
 // normalizeEndpoint reduces cardinality by grouping similar endpoints
 func normalizeEndpoint(path string) string {
 	switch path {
-	case "/metrics", "/health", "/analyze", "/anomalies", "/stats":
+	case "/metrics", "/health", "/analyze", "/anomalies", "/anomalies/events", "/anomalies/stream", "/stats", "/forecast", "/capacity", "/correlation", "/live", "/webhooks/dead-letters", "/webhooks/dead-letters/redrive", "/rules", "/alerts":
 		return path
 	default:
 		if len(path) > 0 && path[0] == '/' {
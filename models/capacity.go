@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// SaturationEstimate is a trend-based estimate of when a metric crosses a threshold
+type SaturationEstimate struct {
+	Source       string     `json:"source"` // "history" (Redis) or "live" (rolling window)
+	Samples      int        `json:"samples"`
+	SlopePerHour float64    `json:"slope_per_hour"`
+	RSquared     float64    `json:"r_squared"`
+	WillCross    bool       `json:"will_cross"`
+	ETA          *time.Time `json:"eta,omitempty"`
+	ETASeconds   float64    `json:"eta_seconds,omitempty"`
+	Earliest     *time.Time `json:"earliest,omitempty"` // crossing time at the fast end of the slope interval
+	Latest       *time.Time `json:"latest,omitempty"`   // crossing time at the slow end, omitted if it never crosses
+	Confidence   string     `json:"confidence"`         // "high", "medium" or "low"
+}
+
+// CapacityResult answers when a metric of a device or fleet crosses a threshold
+type CapacityResult struct {
+	DeviceID   string               `json:"device_id,omitempty"`
+	Metric     string               `json:"metric"`
+	Threshold  float64              `json:"threshold"`
+	Direction  string               `json:"direction"` // "above" or "below"
+	Current    float64              `json:"current"`
+	Level      float64              `json:"confidence_level"`
+	Estimates  []SaturationEstimate `json:"estimates"`
+	Best       *SaturationEstimate  `json:"best,omitempty"`
+	Calculated time.Time            `json:"calculated"`
+}
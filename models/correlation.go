@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Correlation holds correlation coefficients of two metrics over a window
+type Correlation struct {
+	Samples  int      `json:"samples"`  // samples reporting both metrics
+	Pearson  *float64 `json:"pearson"`  // null if undefined, e.g. a constant metric
+	Spearman *float64 `json:"spearman"` // null if undefined
+}
+
+// CorrelationResult represents the correlation of two metrics of a device,
+// or fleet-wide together with the correlation of each device
+type CorrelationResult struct {
+	A        string `json:"a"`
+	B        string `json:"b"`
+	DeviceID string `json:"device_id,omitempty"`
+	Correlation
+	Devices    map[string]Correlation `json:"devices,omitempty"`
+	Calculated time.Time              `json:"calculated"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// AnomalyEventFilter selects anomaly events by metric and device
+type AnomalyEventFilter struct {
+	MetricType string // empty for all metrics
+	DeviceID   string // empty for all devices
+}
+
+// Matches reports whether an event passes the filter
+func (f AnomalyEventFilter) Matches(event AnomalyEvent) bool {
+	return (f.MetricType == "" || event.MetricType == f.MetricType) &&
+		(f.DeviceID == "" || event.DeviceID == f.DeviceID)
+}
+
+// AnomalyEventQuery selects stored anomaly events
+type AnomalyEventQuery struct {
+	AnomalyEventFilter
+	From  time.Time // event timestamp, inclusive, zero for no lower bound
+	To    time.Time // event timestamp, exclusive, zero for no upper bound
+	Limit int
+
+	// Cursor is the ID of the last event of the previous page, or ""
+	Cursor string
+
+	// Stored lists events in the order they were stored, as the anomaly
+	// stream replays them, instead of by timestamp
+	Stored bool
+}
+
+// AnomalyEventPage is a page of stored anomaly events in chronological order
+type AnomalyEventPage struct {
+	Events     []AnomalyEvent `json:"events"`
+	NextCursor string         `json:"next_cursor,omitempty"` // empty on the last page
+
+	// Truncated is set if more events match than the page holds
+	Truncated bool `json:"truncated"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// ForecastPoint represents a predicted value with its prediction interval
+type ForecastPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+	Lower     float64   `json:"lower"`
+	Upper     float64   `json:"upper"`
+}
+
+// ForecastResult represents a multi-step forecast of a metric
+type ForecastResult struct {
+	DeviceID   string          `json:"device_id,omitempty"`
+	Metric     string          `json:"metric"`
+	Model      string          `json:"model"`
+	Origin     time.Time       `json:"origin"` // timestamp of the last observed sample
+	Step       string          `json:"step"`
+	Horizon    int             `json:"horizon"`
+	Confidence float64         `json:"confidence"`
+	Points     []ForecastPoint `json:"points"`
+}
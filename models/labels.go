@@ -0,0 +1,150 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxLabels limits how many labels a single data point may carry
+	MaxLabels = 16
+	// MaxLabelValueLength limits the size of label values
+	MaxLabelValueLength = 128
+)
+
+// MatchType is the comparison performed by a LabelMatcher
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// LabelMatcher matches a single label against a value or regular expression
+type LabelMatcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+// Matches reports whether the labels satisfy the matcher.
+// A missing label is treated as an empty value.
+func (lm LabelMatcher) Matches(labels map[string]string) bool {
+	value := labels[lm.Name]
+	switch lm.Type {
+	case MatchEqual:
+		return value == lm.Value
+	case MatchNotEqual:
+		return value != lm.Value
+	case MatchRegexp:
+		return lm.re.MatchString(value)
+	case MatchNotRegexp:
+		return !lm.re.MatchString(value)
+	}
+	return false
+}
+
+// String returns the matcher in query syntax
+func (lm LabelMatcher) String() string {
+	return lm.Name + string(lm.Type) + lm.Value
+}
+
+// ParseLabelMatchers parses a comma-separated list of matchers such as
+// "region=eu,firmware=~2.*". Regular expressions are anchored at both ends.
+func ParseLabelMatchers(s string) ([]LabelMatcher, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var matchers []LabelMatcher
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		matcher, err := parseLabelMatcher(part)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// parseLabelMatcher parses a single "name<op>value" expression
+func parseLabelMatcher(s string) (LabelMatcher, error) {
+	idx := strings.IndexAny(s, "=!")
+	if idx <= 0 {
+		return LabelMatcher{}, fmt.Errorf("invalid label matcher %q", s)
+	}
+
+	name := strings.TrimSpace(s[:idx])
+	rest := s[idx:]
+
+	var matchType MatchType
+	switch {
+	case strings.HasPrefix(rest, "=~"):
+		matchType = MatchRegexp
+	case strings.HasPrefix(rest, "!~"):
+		matchType = MatchNotRegexp
+	case strings.HasPrefix(rest, "!="):
+		matchType = MatchNotEqual
+	case strings.HasPrefix(rest, "="):
+		matchType = MatchEqual
+	default:
+		return LabelMatcher{}, fmt.Errorf("invalid label matcher %q", s)
+	}
+
+	if !ValidLabelName(name) {
+		return LabelMatcher{}, fmt.Errorf("invalid label name %q", name)
+	}
+
+	matcher := LabelMatcher{
+		Name:  name,
+		Type:  matchType,
+		Value: strings.TrimSpace(rest[len(matchType):]),
+	}
+	if matchType == MatchRegexp || matchType == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + matcher.Value + ")$")
+		if err != nil {
+			return LabelMatcher{}, fmt.Errorf("invalid regular expression in %q: %w", s, err)
+		}
+		matcher.re = re
+	}
+	return matcher, nil
+}
+
+// MatchLabels reports whether the labels satisfy all matchers
+func MatchLabels(matchers []LabelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidLabelName reports whether name is a valid label name
+func ValidLabelName(name string) bool {
+	return ValidMetricName(name)
+}
+
+// validateLabels checks label names and values
+func validateLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("at most %d labels are allowed", MaxLabels)
+	}
+	for name, value := range labels {
+		if !ValidLabelName(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if len(value) > MaxLabelValueLength {
+			return fmt.Errorf("label value for %s is too long", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import "slices"
+
+// LiveAnalytics is the analytics of a metric updated by an ingested value
+type LiveAnalytics struct {
+	Avg    float64 `json:"avg"`    // rolling average of the device metric
+	ZScore float64 `json:"zscore"` // z-score of the value against the device baseline
+}
+
+// LiveUpdate is an ingested metric with the analytics it updated, keyed by
+// metric name, as pushed to live feed subscribers
+type LiveUpdate struct {
+	Metric
+	Analytics map[string]LiveAnalytics `json:"analytics"`
+}
+
+// LiveFilter selects the devices and metrics of a live feed;
+// empty lists select all devices or metrics
+type LiveFilter struct {
+	Devices []string `json:"devices,omitempty"`
+	Metrics []string `json:"metrics,omitempty"`
+}
+
+// Matches reports whether an update comes from a selected device and carries
+// a selected metric
+func (f LiveFilter) Matches(update LiveUpdate) bool {
+	if len(f.Devices) > 0 && !slices.Contains(f.Devices, update.DeviceID) {
+		return false
+	}
+	if len(f.Metrics) == 0 {
+		return true
+	}
+	for _, name := range f.Metrics {
+		if _, ok := update.Values[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns a copy of an update restricted to the selected metrics.
+// The copy does not share maps with the update.
+func (f LiveFilter) Select(update LiveUpdate) LiveUpdate {
+	result := update
+	result.Values = make(map[string]float64, len(update.Values))
+	result.Analytics = make(map[string]LiveAnalytics, len(update.Analytics))
+	for name, value := range update.Values {
+		if len(f.Metrics) > 0 && !slices.Contains(f.Metrics, name) {
+			continue
+		}
+		result.Values[name] = value
+		if a, ok := update.Analytics[name]; ok {
+			result.Analytics[name] = a
+		}
+	}
+	return result
+}
@@ -2,21 +2,50 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"time"
 )
 
+// DefaultDeviceID is assigned to metrics ingested without a device identifier
+const DefaultDeviceID = "unknown"
+
+// MaxDeviceIDLength limits the size of device identifiers
+const MaxDeviceIDLength = 128
+
+const (
+	// MaxMetricNameLength limits the size of metric names
+	MaxMetricNameLength = 64
+	// MaxValuesPerMetric limits how many named values a single data point may carry
+	MaxValuesPerMetric = 64
+)
+
+// valueBounds holds optional validation bounds for well-known metric names.
+// Metrics not listed here are accepted with any finite value.
+var valueBounds = map[string]struct{ min, max float64 }{
+	"cpu": {0, 100},
+	"rps": {0, math.Inf(1)},
+}
+
 // Metric represents an IoT device metric data point
 type Metric struct {
-	Timestamp time.Time `json:"timestamp"`
-	CPU       float64   `json:"cpu"`
-	RPS       float64   `json:"rps"`
+	TenantID  string             `json:"tenant_id,omitempty"`
+	DeviceID  string             `json:"device_id"`
+	Timestamp time.Time          `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+	Labels    map[string]string  `json:"labels,omitempty"`
 }
 
 // MetricInput represents incoming metric data from API
 type MetricInput struct {
-	Timestamp string  `json:"timestamp"`
-	CPU       float64 `json:"cpu"`
-	RPS       float64 `json:"rps"`
+	DeviceID  string             `json:"device_id"`
+	Timestamp string             `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+	Labels    map[string]string  `json:"labels,omitempty"`
+
+	// Legacy top-level fields, merged into Values
+	CPU *float64 `json:"cpu,omitempty"`
+	RPS *float64 `json:"rps,omitempty"`
 }
 
 // Validate checks if the metric data is valid
@@ -24,51 +53,212 @@ func (m *MetricInput) Validate() error {
 	if m.Timestamp == "" {
 		return errors.New("timestamp is required")
 	}
-	if m.CPU < 0 || m.CPU > 100 {
-		return errors.New("cpu must be between 0 and 100")
+	if len(m.DeviceID) > MaxDeviceIDLength {
+		return errors.New("device_id is too long")
 	}
-	if m.RPS < 0 {
-		return errors.New("rps must be non-negative")
+	if m.DeviceID != "" && !ValidDeviceID(m.DeviceID) {
+		return errors.New("device_id may only contain letters, digits, '.', '_', ':' and '-'")
+	}
+	if err := validateLabels(m.Labels); err != nil {
+		return err
+	}
+
+	values := m.values()
+	if len(values) == 0 {
+		return errors.New("at least one metric value is required")
+	}
+	if len(values) > MaxValuesPerMetric {
+		return fmt.Errorf("at most %d metric values are allowed", MaxValuesPerMetric)
+	}
+	for name, value := range values {
+		if err := validateValue(name, value); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// validateValue checks a single named metric value
+func validateValue(name string, value float64) error {
+	if !ValidMetricName(name) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%s must be a finite number", name)
+	}
+	if bounds, ok := valueBounds[name]; ok {
+		if value < bounds.min {
+			return fmt.Errorf("%s must be at least %g", name, bounds.min)
+		}
+		if value > bounds.max {
+			return fmt.Errorf("%s must be at most %g", name, bounds.max)
+		}
+	}
+	return nil
+}
+
+// ValidMetricName reports whether name is a valid metric name
+// (letters, digits and underscores, not starting with a digit)
+func ValidMetricName(name string) bool {
+	if name == "" || len(name) > MaxMetricNameLength {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidDeviceID reports whether id is a valid device identifier (letters,
+// digits, dots, underscores, colons and hyphens). Device IDs become part of
+// Redis keys and Prometheus labels, so the character set is kept narrow.
+func ValidDeviceID(id string) bool {
+	if id == "" || len(id) > MaxDeviceIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// values returns the named values including legacy fields
+func (m *MetricInput) values() map[string]float64 {
+	if m.CPU == nil && m.RPS == nil {
+		return m.Values
+	}
+
+	values := make(map[string]float64, len(m.Values)+2)
+	for name, value := range m.Values {
+		values[name] = value
+	}
+	if m.CPU != nil {
+		values["cpu"] = *m.CPU
+	}
+	if m.RPS != nil {
+		values["rps"] = *m.RPS
+	}
+	return values
+}
+
 // ToMetric converts MetricInput to Metric with parsed timestamp
 func (m *MetricInput) ToMetric() (Metric, error) {
 	t, err := time.Parse(time.RFC3339, m.Timestamp)
 	if err != nil {
 		return Metric{}, errors.New("invalid timestamp format, use RFC3339")
 	}
+	deviceID := m.DeviceID
+	if deviceID == "" {
+		deviceID = DefaultDeviceID
+	}
 	return Metric{
+		DeviceID:  deviceID,
 		Timestamp: t,
-		CPU:       m.CPU,
-		RPS:       m.RPS,
+		Values:    m.values(),
+		Labels:    m.Labels,
 	}, nil
 }
 
+// Percentiles holds streaming percentile estimates of a metric
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// HorizonAnalytics represents analytics of a metric over one time horizon
+type HorizonAnalytics struct {
+	Avg     float64 `json:"avg"`
+	ZScore  float64 `json:"zscore"` // z-score of the current value within the horizon
+	Anomaly bool    `json:"anomaly"`
+	Samples int     `json:"samples"`
+	Covered float64 `json:"covered_seconds"` // time span covered by the samples
+}
+
+// MetricAnalytics represents analytics for a single named metric
+type MetricAnalytics struct {
+	Current     float64          `json:"current"`
+	Avg         float64          `json:"avg"`
+	Percentiles Percentiles      `json:"percentiles"`
+	Predicted   float64          `json:"predicted"` // Holt-Winters one-step-ahead forecast
+	EWMA        float64          `json:"ewma"`      // exponentially weighted moving average
+	Detector    string           `json:"detector"`
+	State       string           `json:"state"`      // MetricStateLearning or MetricStateReady
+	FillRatio   float64          `json:"fill_ratio"` // progress of the warm-up, 0-1
+	Score       float64          `json:"score"`      // score of the configured detector
+	ZScore      float64          `json:"zscore"`
+	MADScore    float64          `json:"mad_score"` // modified z-score (median/MAD)
+	Anomaly     bool             `json:"anomaly"`
+	EpisodeOpen bool             `json:"episode_open"`         // an anomaly episode is in progress
+	Anomalies   int64            `json:"anomalies"`            // anomaly episodes and escalations
+	Severities  map[string]int64 `json:"severities,omitempty"` // anomalies by severity
+	LevelShifts int64            `json:"level_shifts"`
+
+	// Analytics per time horizon, keyed by horizon name (e.g. "1m", "5m", "15m")
+	Horizons map[string]HorizonAnalytics `json:"horizons,omitempty"`
+}
+
+// Metric baseline states
+const (
+	MetricStateLearning = "learning" // too few samples, anomalies are not reported
+	MetricStateReady    = "ready"
+)
+
 // AnalyticsResult represents the result of analytics processing
 type AnalyticsResult struct {
-	CurrentCPU       float64   `json:"current_cpu"`
-	CurrentRPS       float64   `json:"current_rps"`
-	AvgCPU           float64   `json:"avg_cpu"`
-	AvgRPS           float64   `json:"avg_rps"`
-	PredictedCPU     float64   `json:"predicted_cpu"`
-	PredictedRPS     float64   `json:"predicted_rps"`
-	CPUZScore        float64   `json:"cpu_zscore"`
-	RPSZScore        float64   `json:"rps_zscore"`
-	CPUAnomaly       bool      `json:"cpu_anomaly"`
-	RPSAnomaly       bool      `json:"rps_anomaly"`
-	TotalMetrics     int       `json:"total_metrics"`
-	WindowSize       int       `json:"window_size"`
-	LastUpdated      time.Time `json:"last_updated"`
+	DeviceID     string                     `json:"device_id,omitempty"`
+	Labels       map[string]string          `json:"labels,omitempty"`
+	Devices      int                        `json:"devices,omitempty"`
+	Metrics      map[string]MetricAnalytics `json:"metrics"`
+	TotalMetrics int                        `json:"total_metrics"`
+	WindowSize   int                        `json:"window_size"`
+	WindowSpan   string                     `json:"window_duration,omitempty"` // span of time-based windows
+	LastUpdated  time.Time                  `json:"last_updated"`
 }
 
+// Anomaly event types
+const (
+	EventTypeSpike      = "spike"       // single value deviating from the baseline
+	EventTypeLevelShift = "level_shift" // sustained change of the level
+)
+
+// Anomaly severities, in increasing order
+const (
+	SeverityWarning   = "warning"
+	SeverityCritical  = "critical"
+	SeverityEmergency = "emergency"
+)
+
+// Severities lists the anomaly severities in increasing order
+var Severities = []string{SeverityWarning, SeverityCritical, SeverityEmergency}
+
 // AnomalyEvent represents a detected anomaly
 type AnomalyEvent struct {
-	Timestamp   time.Time `json:"timestamp"`
-	MetricType  string    `json:"metric_type"` // "cpu" or "rps"
-	Value       float64   `json:"value"`
-	ZScore      float64   `json:"zscore"`
-	Mean        float64   `json:"mean"`
-	StdDev      float64   `json:"stddev"`
+	ID         string    `json:"id,omitempty"` // assigned when the event is stored
+	TenantID   string    `json:"tenant_id,omitempty"`
+	DeviceID   string    `json:"device_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	EventType  string    `json:"event_type"`
+	Severity   string    `json:"severity"`
+	MetricType string    `json:"metric_type"` // metric name, e.g. "cpu" or "temperature"
+	Detector   string    `json:"detector"`
+	Value      float64   `json:"value"`
+	Score      float64   `json:"score"`
+	ZScore     float64   `json:"zscore"`
+	Mean       float64   `json:"mean"`   // baseline center of the detector
+	StdDev     float64   `json:"stddev"` // baseline spread of the detector
+
+	// Level shift details
+	ShiftMagnitude float64    `json:"shift_magnitude,omitempty"`
+	ChangeTime     *time.Time `json:"change_time,omitempty"`
 }
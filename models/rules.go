@@ -0,0 +1,216 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// Alert rule kinds
+const (
+	RuleKindThreshold   = "threshold"    // latest value of a metric
+	RuleKindChange      = "change"       // percent change of a metric from its average over a window
+	RuleKindAnomalyRate = "anomaly_rate" // anomalies per minute over a window
+)
+
+// Alert rule comparison operators
+var RuleOps = []string{">", ">=", "<", "<="}
+
+const (
+	// MaxRuleNameLength limits the size of rule names
+	MaxRuleNameLength = 128
+	// MaxRuleDescriptionLength limits the size of rule descriptions
+	MaxRuleDescriptionLength = 1024
+)
+
+// Alert states
+const (
+	AlertStatePending  = "pending"  // condition holds, waiting for the rule's for duration
+	AlertStateFiring   = "firing"   // condition held for the rule's for duration
+	AlertStateResolved = "resolved" // condition cleared after firing
+
+	// AlertStateInactive is reported when a pending alert clears before firing
+	AlertStateInactive = "inactive"
+)
+
+// AlertRule is a user-defined condition on a tenant's metric streams.
+// It is evaluated per device, or per group of devices for anomaly_rate rules
+// with GroupBy, and produces an alert for every device or group on which
+// the condition holds.
+type AlertRule struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+
+	// Metric is the metric the rule watches; anomaly_rate rules without it
+	// count anomalies of every metric
+	Metric string `json:"metric,omitempty"`
+
+	// The condition: the rule's value compared with Threshold. The value is
+	// the latest value for threshold rules, the change from the window
+	// average in percent for change rules, and anomalies per minute for
+	// anomaly_rate rules.
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+
+	// Window is the averaging window of change rules and the counting window
+	// of anomaly_rate rules, e.g. "10m"
+	Window string `json:"window,omitempty"`
+
+	// MinSeverity restricts anomaly_rate rules to anomalies of at least this severity
+	MinSeverity string `json:"min_severity,omitempty"`
+
+	// For is how long the condition must hold before an alert fires, e.g. "2m"
+	For string `json:"for,omitempty"`
+
+	// Match selects devices by label, in the syntax of ?match=
+	Match string `json:"match,omitempty"`
+
+	// GroupBy evaluates anomaly_rate rules per group of devices sharing
+	// these label values instead of per device
+	GroupBy []string `json:"group_by,omitempty"`
+
+	// Severity of the alerts produced, warning if empty
+	Severity    string `json:"severity,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate checks if the rule definition is valid
+func (r *AlertRule) Validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(r.Name) > MaxRuleNameLength {
+		return errors.New("name is too long")
+	}
+	if len(r.Description) > MaxRuleDescriptionLength {
+		return errors.New("description is too long")
+	}
+
+	switch r.Kind {
+	case RuleKindThreshold, RuleKindChange:
+		if r.Metric == "" {
+			return fmt.Errorf("metric is required for %s rules", r.Kind)
+		}
+		if r.MinSeverity != "" {
+			return errors.New("min_severity is only supported by anomaly_rate rules")
+		}
+		if len(r.GroupBy) > 0 {
+			return errors.New("group_by is only supported by anomaly_rate rules")
+		}
+	case RuleKindAnomalyRate:
+		if r.MinSeverity != "" && !slices.Contains(Severities, r.MinSeverity) {
+			return fmt.Errorf("invalid min_severity %q", r.MinSeverity)
+		}
+		for _, name := range r.GroupBy {
+			if !ValidLabelName(name) {
+				return fmt.Errorf("invalid group_by label %q", name)
+			}
+		}
+	default:
+		return fmt.Errorf("kind must be one of %s, %s or %s", RuleKindThreshold, RuleKindChange, RuleKindAnomalyRate)
+	}
+	if r.Metric != "" && !ValidMetricName(r.Metric) {
+		return fmt.Errorf("invalid metric name %q", r.Metric)
+	}
+
+	if !slices.Contains(RuleOps, r.Op) {
+		return fmt.Errorf("op must be one of %v", RuleOps)
+	}
+	if math.IsNaN(r.Threshold) || math.IsInf(r.Threshold, 0) {
+		return errors.New("threshold must be a finite number")
+	}
+
+	if r.Kind == RuleKindThreshold {
+		if r.Window != "" {
+			return errors.New("window is not supported by threshold rules")
+		}
+	} else if d, err := time.ParseDuration(r.Window); err != nil || d <= 0 {
+		return fmt.Errorf("window must be a positive duration for %s rules", r.Kind)
+	}
+	if r.For != "" {
+		if d, err := time.ParseDuration(r.For); err != nil || d < 0 {
+			return errors.New("for must be a non-negative duration")
+		}
+	}
+
+	if _, err := ParseLabelMatchers(r.Match); err != nil {
+		return fmt.Errorf("invalid match: %w", err)
+	}
+	if r.Severity != "" && !slices.Contains(Severities, r.Severity) {
+		return fmt.Errorf("invalid severity %q", r.Severity)
+	}
+	return nil
+}
+
+// Alert is the state of an alert rule on a device or group of devices
+type Alert struct {
+	TenantID string `json:"tenant_id,omitempty"`
+	RuleID   string `json:"rule_id"`
+	Rule     string `json:"rule"` // rule name
+	Severity string `json:"severity"`
+	State    string `json:"state"`
+
+	Description string `json:"description,omitempty"`
+
+	// Labels identify the device ("device_id") or, for grouped rules, the
+	// group (its group_by labels)
+	Labels map[string]string `json:"labels"`
+
+	// Latest value of the rule on the device or group, and its threshold
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+
+	// ActiveAt is when the condition started to hold
+	ActiveAt   time.Time  `json:"active_at"`
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// AlertFilter selects alerts by state and rule
+type AlertFilter struct {
+	State  string // empty for all states
+	RuleID string // empty for all rules
+}
+
+// Matches reports whether an alert passes the filter
+func (f AlertFilter) Matches(alert Alert) bool {
+	return (f.State == "" || alert.State == f.State) &&
+		(f.RuleID == "" || alert.RuleID == f.RuleID)
+}
+
+// AlertSeriesInput is what one replica has seen of a device or group for an
+// alert rule. Every replica publishes its inputs through Redis, so that the
+// replica evaluating the rules sees the values ingested by all of them.
+type AlertSeriesInput struct {
+	Labels map[string]string `json:"labels"`
+
+	// Updated is when the replica last received a value or anomaly
+	Updated time.Time `json:"updated"`
+
+	// Threshold and change rules: the latest value
+	Value float64 `json:"value,omitempty"`
+
+	// Change rules: mean and number of the values over the window up to and
+	// including the latest one
+	Mean  float64 `json:"mean,omitempty"`
+	Count int     `json:"count,omitempty"`
+
+	// Anomaly rate rules: anomalies counted within the window
+	Anomalies int `json:"anomalies,omitempty"`
+}
+
+// AlertRuleInputs are the series inputs of one definition of an alert rule
+type AlertRuleInputs struct {
+	// UpdatedAt identifies the definition the inputs were collected for
+	UpdatedAt time.Time                   `json:"updated_at"`
+	Series    map[string]AlertSeriesInput `json:"series"`
+}
+
+// AlertInputs are the alert rule inputs of a replica, by tenant and rule ID
+type AlertInputs map[string]map[string]AlertRuleInputs
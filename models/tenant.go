@@ -0,0 +1,24 @@
+package models
+
+// DefaultTenantID is used for requests that do not identify a tenant
+const DefaultTenantID = "default"
+
+// MaxTenantIDLength limits the size of tenant identifiers
+const MaxTenantIDLength = 64
+
+// ValidTenantID reports whether id is a valid tenant identifier
+// (letters, digits, hyphens and underscores). Tenant IDs become part of
+// Redis keys and Prometheus labels, so the character set is kept narrow.
+func ValidTenantID(id string) bool {
+	if id == "" || len(id) > MaxTenantIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Webhook payload types
+const (
+	WebhookEventAnomaly = "anomaly" // carries an anomaly event
+	WebhookEventAlert   = "alert"   // carries an alert that fired or resolved
+)
+
+// WebhookPayload is the JSON body POSTed to webhook endpoints
+type WebhookPayload struct {
+	ID        string        `json:"id"` // delivery ID, stable across retries and redrives
+	Type      string        `json:"type"`
+	CreatedAt time.Time     `json:"created_at"`
+	Event     *AnomalyEvent `json:"event,omitempty"`
+	Alert     *Alert        `json:"alert,omitempty"`
+}
+
+// DeadLetter is a webhook delivery that exhausted its retries
+type DeadLetter struct {
+	ID        string         `json:"id"`       // delivery ID
+	Endpoint  string         `json:"endpoint"` // endpoint name, the URL is not stored
+	Payload   WebhookPayload `json:"payload"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error"`
+	FailedAt  time.Time      `json:"failed_at"`
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"high-load-service/analytics"
+	"high-load-service/models"
+)
+
+// maxSaturationHorizon bounds reported crossing times; trends that need
+// longer to cross the threshold are reported as not crossing
+const maxSaturationHorizon = 10 * 365 * 24 * time.Hour
+
+// Capacity estimates when a metric of a device (or the tenant's fleet if
+// deviceID is empty) will cross threshold, rising above it if above is true
+// or falling below it otherwise. Trends are fitted over the stored history in
+// Redis (up to historySize samples of the device, or of the fleet) and over
+// the live rolling window.
+func (ms *MetricsService) Capacity(tenantID, deviceID, metricName string, threshold float64, above bool, historySize int64, confidence float64) (models.CapacityResult, error) {
+	result := models.CapacityResult{
+		DeviceID:   deviceID,
+		Metric:     metricName,
+		Threshold:  threshold,
+		Direction:  "below",
+		Level:      confidence,
+		Estimates:  []models.SaturationEstimate{},
+		Calculated: time.Now(),
+	}
+	if above {
+		result.Direction = "above"
+	}
+
+	found := false
+
+	if history, ok := ms.historyTrend(tenantID, deviceID, metricName, historySize); ok {
+		found = true
+		result.Estimates = append(result.Estimates,
+			saturationEstimate("history", history.fit, history.last, threshold, above, confidence))
+		result.Current = history.current
+	} else if history.samples > 0 {
+		found = true
+	}
+
+	state, err := ms.lookupTenant(tenantID).lookupState(deviceID)
+	if err == nil {
+		if metric, ok := state.lookupMetric(metricName); ok {
+			found = true
+			state.mu.RLock()
+			result.Current = metric.latest
+			state.mu.RUnlock()
+
+			if fit, last, ok := liveTrend(metric); ok {
+				result.Estimates = append(result.Estimates,
+					saturationEstimate("live", fit, last, threshold, above, confidence))
+			}
+		}
+	}
+
+	if !found {
+		if err != nil {
+			return result, err
+		}
+		return result, ErrMetricNotFound
+	}
+
+	for i := range result.Estimates {
+		if result.Best == nil || result.Estimates[i].RSquared > result.Best.RSquared {
+			result.Best = &result.Estimates[i]
+		}
+	}
+	return result, nil
+}
+
+// historyFit is a trend fitted over metrics stored in Redis
+type historyFit struct {
+	fit     analytics.LinearTrend
+	last    time.Time
+	current float64
+	samples int
+}
+
+// historyTrend fits a trend over the stored history of a metric
+func (ms *MetricsService) historyTrend(tenantID, deviceID, metricName string, historySize int64) (historyFit, bool) {
+	if ms.redis == nil {
+		return historyFit{}, false
+	}
+
+	var stored []models.Metric
+	var err error
+	if deviceID != "" {
+		stored, err = ms.redis.GetRecentDeviceMetrics(tenantID, deviceID, historySize)
+	} else {
+		stored, err = ms.redis.GetRecentMetrics(tenantID, historySize)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read metric history from Redis: %v", err)
+		return historyFit{}, false
+	}
+
+	type point struct {
+		t     time.Time
+		value float64
+	}
+	points := make([]point, 0, len(stored))
+	for _, m := range stored {
+		if value, ok := m.Values[metricName]; ok {
+			points = append(points, point{m.Timestamp, value})
+		}
+	}
+	if len(points) == 0 {
+		return historyFit{}, false
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].t.Before(points[j].t) })
+
+	origin := points[0].t
+	xs := make([]float64, len(points))
+	ys := make([]float64, len(points))
+	for i, p := range points {
+		xs[i] = p.t.Sub(origin).Seconds()
+		ys[i] = p.value
+	}
+
+	last := points[len(points)-1]
+	h := historyFit{last: last.t, current: last.value, samples: len(points)}
+	fit, ok := analytics.FitLinearTrend(xs, ys)
+	if !ok {
+		return h, false
+	}
+	h.fit = fit
+	return h, true
+}
+
+// liveTrend fits a trend over the rolling window of a metric, assuming the
+// samples are spaced by the interval observed by the forecaster
+func liveTrend(metric *metricState) (analytics.LinearTrend, time.Time, bool) {
+	forecaster := metric.forecast()
+	interval := forecaster.Interval().Seconds()
+	if interval <= 0 {
+		return analytics.LinearTrend{}, time.Time{}, false
+	}
+
+	values := metric.rolling.GetValues()
+	xs := make([]float64, len(values))
+	for i := range values {
+		xs[i] = float64(i) * interval
+	}
+
+	fit, ok := analytics.FitLinearTrend(xs, values)
+	return fit, forecaster.LastUpdate(), ok
+}
+
+// saturationEstimate converts a trend fit into a threshold crossing estimate.
+// Fit x coordinates are in seconds and last is the time of the most recent point.
+func saturationEstimate(source string, fit analytics.LinearTrend, last time.Time, threshold float64, above bool, confidence float64) models.SaturationEstimate {
+	estimate := models.SaturationEstimate{
+		Source:       source,
+		Samples:      fit.N,
+		SlopePerHour: fit.Slope * time.Hour.Seconds(),
+		RSquared:     fit.RSquared,
+		Confidence:   trendConfidence(fit),
+	}
+
+	at := func(seconds float64) *time.Time {
+		if seconds > maxSaturationHorizon.Seconds() {
+			return nil
+		}
+		t := last.Add(time.Duration(seconds * float64(time.Second)))
+		return &t
+	}
+
+	if eta, ok := fit.TimeToCross(threshold, above); ok {
+		if estimate.ETA = at(eta); estimate.ETA != nil {
+			estimate.WillCross = true
+			estimate.ETASeconds = eta
+		}
+	}
+
+	earliest, latest, earliestOK, latestOK := fit.TimeToCrossInterval(threshold, above, confidence)
+	if earliestOK {
+		estimate.Earliest = at(earliest)
+	}
+	if latestOK {
+		estimate.Latest = at(latest)
+	}
+	return estimate
+}
+
+// trendConfidence grades a fit by its sample count and goodness of fit
+func trendConfidence(fit analytics.LinearTrend) string {
+	switch {
+	case fit.N >= 30 && fit.RSquared >= 0.7:
+		return "high"
+	case fit.N >= 10 && fit.RSquared >= 0.3:
+		return "medium"
+	default:
+		return "low"
+	}
+}
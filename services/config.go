@@ -0,0 +1,579 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"high-load-service/analytics"
+	"high-load-service/cache"
+	"high-load-service/models"
+)
+
+// DefaultSeasonBuckets is the number of seasonal slots used when only
+// SEASON_PERIOD is set (hourly slots for a daily cycle)
+const DefaultSeasonBuckets = 24
+
+// Horizon is a named time window over which each metric is tracked
+type Horizon struct {
+	Name string // as configured, e.g. "5m"
+	Span time.Duration
+}
+
+// DefaultHorizons are the horizons tracked for every metric, like a load average
+var DefaultHorizons = []Horizon{
+	{Name: "1m", Span: time.Minute},
+	{Name: "5m", Span: 5 * time.Minute},
+	{Name: "15m", Span: 15 * time.Minute},
+}
+
+// DefaultWindowMaxSamples caps the number of samples in time-based windows
+const DefaultWindowMaxSamples = 10000
+
+// DefaultWarmupSamples is the number of samples a baseline needs before
+// anomalies against it are reported
+const DefaultWarmupSamples = 30
+
+// OtherMetricLabel is the Prometheus metric label of metrics that are not exported
+const OtherMetricLabel = "other"
+
+// Default limits of the analytics state kept per device and tenant
+const (
+	DefaultMaxMetricsPerDevice = 100
+	DefaultMaxMetricsPerTenant = 1000
+	DefaultMetricIdleTimeout   = time.Hour
+)
+
+// Config holds the analytics configuration of the metrics service
+type Config struct {
+	// WindowSize is the number of samples in rolling windows
+	WindowSize int
+
+	// WindowDuration switches rolling windows to the samples observed within
+	// this span of Metric.Timestamp, holding at most WindowMaxSamples samples
+	WindowDuration   time.Duration
+	WindowMaxSamples int
+
+	// WarmupSamples is the number of samples a metric's window must hold
+	// before its anomalies are reported; until then the metric is learning
+	WarmupSamples int
+
+	// Horizons are additional time windows tracked for every metric
+	Horizons []Horizon
+
+	// MaxMetricsPerDevice and MaxMetricsPerTenant cap the distinct metric
+	// names tracked per device and per tenant; values of further names are
+	// rejected
+	MaxMetricsPerDevice int
+	MaxMetricsPerTenant int
+
+	// MetricIdleTimeout is how long a metric or device may go without values
+	// before its analytics state is evicted
+	MetricIdleTimeout time.Duration
+
+	// ExportedMetrics are the metrics whose fleet-wide values are exported to
+	// Prometheus; anomalies of other metrics are counted as OtherMetricLabel
+	ExportedMetrics []string
+
+	// CorrelationPairs are the metric pairs whose recent values are kept for
+	// correlation queries and whose fleet-wide correlation is exported to
+	// Prometheus
+	CorrelationPairs [][2]string
+
+	// ZScoreThreshold is the anomaly threshold of the z-score detector
+	ZScoreThreshold float64
+
+	// EWMAHalfLife is the half-life of the exponentially weighted smoother
+	EWMAHalfLife time.Duration
+
+	// HoltWinters configures the forecaster behind predicted values
+	HoltWinters analytics.HoltWintersConfig
+
+	// CUSUMDrift and CUSUMThreshold configure level shift detection,
+	// in baseline standard deviations
+	CUSUMDrift     float64
+	CUSUMThreshold float64
+
+	// Episodes controls how per-sample verdicts become reported anomalies
+	Episodes EpisodeConfig
+
+	// Severities are per-metric severity thresholds on detector scores;
+	// other metrics use DefaultSeverityRatios of their detector threshold
+	Severities map[string]SeverityThresholds
+
+	// EventRetention bounds the anomaly event history kept in Redis
+	EventRetention cache.Retention
+
+	// RuleEvalInterval is how often alert rules are evaluated
+	RuleEvalInterval time.Duration
+
+	// DefaultDetector is the detector used for metrics without an explicit choice
+	DefaultDetector string
+
+	// Detectors maps metric names to detector names
+	Detectors map[string]string
+
+	// Thresholds maps detector names to anomaly thresholds
+	// (detectors not listed use their own defaults)
+	Thresholds map[string]float64
+}
+
+// DefaultConfig returns the built-in analytics configuration
+func DefaultConfig() Config {
+	return Config{
+		WindowSize:       WindowSize,
+		WindowMaxSamples: DefaultWindowMaxSamples,
+		WarmupSamples:    DefaultWarmupSamples,
+		Horizons:         DefaultHorizons,
+
+		MaxMetricsPerDevice: DefaultMaxMetricsPerDevice,
+		MaxMetricsPerTenant: DefaultMaxMetricsPerTenant,
+		MetricIdleTimeout:   DefaultMetricIdleTimeout,
+
+		ExportedMetrics:  []string{"cpu", "rps"},
+		CorrelationPairs: [][2]string{{"cpu", "rps"}},
+		ZScoreThreshold:  ZScoreThreshold,
+		EWMAHalfLife:     analytics.DefaultEWMAHalfLife,
+		HoltWinters: analytics.HoltWintersConfig{
+			Alpha: analytics.DefaultHWAlpha,
+			Beta:  analytics.DefaultHWBeta,
+			Gamma: analytics.DefaultHWGamma,
+		},
+		CUSUMDrift:     analytics.DefaultCUSUMDrift,
+		CUSUMThreshold: analytics.DefaultCUSUMThreshold,
+		Episodes: EpisodeConfig{
+			MinSamples: DefaultEpisodeMinSamples,
+			CloseRatio: DefaultEpisodeCloseRatio,
+			Cooldown:   DefaultEpisodeCooldown,
+		},
+		EventRetention: cache.Retention{
+			MaxAge:     cache.DefaultEventRetention,
+			MaxEntries: cache.MaxAnomalyEventsStored,
+		},
+		RuleEvalInterval: DefaultRuleEvalInterval,
+		DefaultDetector:  analytics.DefaultDetector,
+		Detectors:        map[string]string{},
+		Thresholds:       map[string]float64{},
+		Severities:       map[string]SeverityThresholds{},
+	}
+}
+
+// LoadConfig reads analytics configuration from environment variables:
+//
+//	WINDOW_SIZE          rolling window size in samples
+//	WINDOW_DURATION      time-based rolling window span, e.g. "5m" (empty for count-based windows)
+//	WINDOW_MAX_SAMPLES   sample limit of time-based windows
+//	WARMUP_SAMPLES       samples a metric's window must hold before anomalies are reported
+//	HORIZONS             comma-separated horizons tracked per metric, e.g. "1m,5m,15m"
+//	MAX_METRICS_PER_DEVICE  distinct metric names tracked per device
+//	MAX_METRICS_PER_TENANT  distinct metric names tracked per tenant
+//	METRIC_IDLE_TIMEOUT  time without values after which a metric or device is evicted, e.g. "1h"
+//	EXPORTED_METRICS     metrics exported as Prometheus gauges, e.g. "cpu,rps,temperature"
+//	CORRELATION_PAIRS    metric pairs tracked for correlation, e.g. "cpu:rps,temperature:cpu"
+//	ZSCORE_THRESHOLD     z-score anomaly threshold
+//	EWMA_HALF_LIFE       half-life of the EWMA smoother, e.g. "30s"
+//	HW_ALPHA, HW_BETA, HW_GAMMA  Holt-Winters level/trend/season smoothing factors
+//	SEASON_PERIOD        Holt-Winters seasonal cycle, e.g. "24h" (empty disables seasonality)
+//	SEASON_BUCKETS       seasonal slots per cycle, e.g. 24
+//	CUSUM_DRIFT          level shift allowance k, in standard deviations
+//	CUSUM_THRESHOLD      level shift decision threshold h, in standard deviations
+//	ANOMALY_MIN_SAMPLES  consecutive anomalous samples required to open an episode
+//	ANOMALY_MIN_DURATION time a metric must stay anomalous to open an episode, e.g. "10s"
+//	ANOMALY_CLOSE_RATIO  fraction of the threshold the score must fall under to close an episode
+//	ANOMALY_COOLDOWN     minimum time between episodes of a metric, e.g. "30s"
+//	SEVERITY_THRESHOLDS  per-metric warning:critical:emergency scores, e.g. "cpu=2:3:4"
+//	ANOMALY_EVENT_RETENTION  age after which stored anomaly events are dropped, e.g. "168h"
+//	ANOMALY_EVENT_MAX    anomaly events stored per tenant
+//	RULE_EVAL_INTERVAL   how often alert rules are evaluated, e.g. "15s"
+//	ANOMALY_DETECTOR     default detector name
+//	METRIC_DETECTORS     per-metric detectors, e.g. "temperature=mad,battery=zscore"
+//	DETECTOR_THRESHOLDS  per-detector thresholds, e.g. "mad=3.5"
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	if v := os.Getenv("WINDOW_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return cfg, fmt.Errorf("invalid WINDOW_SIZE %q", v)
+		}
+		cfg.WindowSize = size
+	}
+
+	if v := os.Getenv("WINDOW_DURATION"); v != "" {
+		span, err := time.ParseDuration(v)
+		if err != nil || span <= 0 {
+			return cfg, fmt.Errorf("invalid WINDOW_DURATION %q", v)
+		}
+		cfg.WindowDuration = span
+	}
+
+	if v := os.Getenv("WINDOW_MAX_SAMPLES"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return cfg, fmt.Errorf("invalid WINDOW_MAX_SAMPLES %q", v)
+		}
+		cfg.WindowMaxSamples = size
+	}
+
+	if v := os.Getenv("WARMUP_SAMPLES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid WARMUP_SAMPLES %q", v)
+		}
+		cfg.WarmupSamples = n
+	}
+
+	for name, param := range map[string]*int{
+		"MAX_METRICS_PER_DEVICE": &cfg.MaxMetricsPerDevice,
+		"MAX_METRICS_PER_TENANT": &cfg.MaxMetricsPerTenant,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return cfg, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*param = n
+		}
+	}
+
+	if v := os.Getenv("METRIC_IDLE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid METRIC_IDLE_TIMEOUT %q", v)
+		}
+		cfg.MetricIdleTimeout = d
+	}
+
+	if v := os.Getenv("ZSCORE_THRESHOLD"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 {
+			return cfg, fmt.Errorf("invalid ZSCORE_THRESHOLD %q", v)
+		}
+		cfg.ZScoreThreshold = threshold
+	}
+
+	if v, ok := os.LookupEnv("HORIZONS"); ok {
+		horizons, err := parseHorizons(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid HORIZONS: %w", err)
+		}
+		cfg.Horizons = horizons
+	}
+
+	if v, ok := os.LookupEnv("EXPORTED_METRICS"); ok {
+		names, err := parseMetricNames(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid EXPORTED_METRICS: %w", err)
+		}
+		cfg.ExportedMetrics = names
+	}
+
+	if v, ok := os.LookupEnv("CORRELATION_PAIRS"); ok {
+		pairs, err := parseMetricPairs(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid CORRELATION_PAIRS: %w", err)
+		}
+		cfg.CorrelationPairs = pairs
+	}
+
+	if v := os.Getenv("EWMA_HALF_LIFE"); v != "" {
+		halfLife, err := time.ParseDuration(v)
+		if err != nil || halfLife <= 0 {
+			return cfg, fmt.Errorf("invalid EWMA_HALF_LIFE %q", v)
+		}
+		cfg.EWMAHalfLife = halfLife
+	}
+
+	for name, factor := range map[string]*float64{
+		"HW_ALPHA": &cfg.HoltWinters.Alpha,
+		"HW_BETA":  &cfg.HoltWinters.Beta,
+		"HW_GAMMA": &cfg.HoltWinters.Gamma,
+	} {
+		if v := os.Getenv(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 || f > 1 {
+				return cfg, fmt.Errorf("invalid %s %q, must be in (0, 1]", name, v)
+			}
+			*factor = f
+		}
+	}
+
+	if v := os.Getenv("SEASON_PERIOD"); v != "" {
+		period, err := time.ParseDuration(v)
+		if err != nil || period <= 0 {
+			return cfg, fmt.Errorf("invalid SEASON_PERIOD %q", v)
+		}
+		cfg.HoltWinters.SeasonPeriod = period
+		cfg.HoltWinters.SeasonBuckets = DefaultSeasonBuckets
+	}
+
+	if v := os.Getenv("SEASON_BUCKETS"); v != "" {
+		buckets, err := strconv.Atoi(v)
+		if err != nil || buckets <= 0 {
+			return cfg, fmt.Errorf("invalid SEASON_BUCKETS %q", v)
+		}
+		cfg.HoltWinters.SeasonBuckets = buckets
+	}
+
+	for name, param := range map[string]*float64{
+		"CUSUM_DRIFT":     &cfg.CUSUMDrift,
+		"CUSUM_THRESHOLD": &cfg.CUSUMThreshold,
+	} {
+		if v := os.Getenv(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 {
+				return cfg, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*param = f
+		}
+	}
+
+	if v := os.Getenv("ANOMALY_MIN_SAMPLES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid ANOMALY_MIN_SAMPLES %q", v)
+		}
+		cfg.Episodes.MinSamples = n
+	}
+
+	for name, param := range map[string]*time.Duration{
+		"ANOMALY_MIN_DURATION": &cfg.Episodes.MinDuration,
+		"ANOMALY_COOLDOWN":     &cfg.Episodes.Cooldown,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return cfg, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*param = d
+		}
+	}
+
+	if v := os.Getenv("ANOMALY_CLOSE_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return cfg, fmt.Errorf("invalid ANOMALY_CLOSE_RATIO %q (must be in (0, 1])", v)
+		}
+		cfg.Episodes.CloseRatio = ratio
+	}
+
+	severities, err := parseSeverities(os.Getenv("SEVERITY_THRESHOLDS"))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid SEVERITY_THRESHOLDS: %w", err)
+	}
+	cfg.Severities = severities
+
+	if v := os.Getenv("ANOMALY_EVENT_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid ANOMALY_EVENT_RETENTION %q", v)
+		}
+		cfg.EventRetention.MaxAge = d
+	}
+
+	if v := os.Getenv("ANOMALY_EVENT_MAX"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid ANOMALY_EVENT_MAX %q", v)
+		}
+		cfg.EventRetention.MaxEntries = n
+	}
+
+	if v := os.Getenv("RULE_EVAL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid RULE_EVAL_INTERVAL %q", v)
+		}
+		cfg.RuleEvalInterval = d
+	}
+
+	if v := os.Getenv("ANOMALY_DETECTOR"); v != "" {
+		cfg.DefaultDetector = v
+	}
+
+	pairs, err := parsePairs(os.Getenv("METRIC_DETECTORS"))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid METRIC_DETECTORS: %w", err)
+	}
+	cfg.Detectors = pairs
+
+	pairs, err = parsePairs(os.Getenv("DETECTOR_THRESHOLDS"))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid DETECTOR_THRESHOLDS: %w", err)
+	}
+	for name, v := range pairs {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 {
+			return cfg, fmt.Errorf("invalid threshold %q for detector %s", v, name)
+		}
+		cfg.Thresholds[name] = threshold
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that all configured detectors are registered
+func (c Config) Validate() error {
+	if !analytics.HasDetector(c.DefaultDetector) {
+		return fmt.Errorf("unknown detector %q (available: %s)",
+			c.DefaultDetector, strings.Join(analytics.DetectorNames(), ", "))
+	}
+	for metric, name := range c.Detectors {
+		if !analytics.HasDetector(name) {
+			return fmt.Errorf("unknown detector %q for metric %s (available: %s)",
+				name, metric, strings.Join(analytics.DetectorNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// DetectorFor returns the detector name configured for a metric
+func (c Config) DetectorFor(metricName string) string {
+	if name, ok := c.Detectors[metricName]; ok {
+		return name
+	}
+	return c.DefaultDetector
+}
+
+// Exported reports whether a metric's fleet-wide values are exported to Prometheus
+func (c Config) Exported(metricName string) bool {
+	return slices.Contains(c.ExportedMetrics, metricName)
+}
+
+// MetricLabel returns the Prometheus label value of a metric type: its name
+// if it is exported or built in, OtherMetricLabel otherwise, so that clients
+// cannot create unbounded series
+func (c Config) MetricLabel(metricType string) string {
+	if metricType == CPUPerRPSMetric || c.Exported(metricType) {
+		return metricType
+	}
+	return OtherMetricLabel
+}
+
+// correlationPair returns the configured correlation pair of metrics a and b
+// and whether it is configured as (b, a)
+func (c Config) correlationPair(a, b string) (pair [2]string, swapped, ok bool) {
+	for _, pair := range c.CorrelationPairs {
+		switch pair {
+		case [2]string{a, b}:
+			return pair, false, true
+		case [2]string{b, a}:
+			return pair, true, true
+		}
+	}
+	return [2]string{}, false, false
+}
+
+// window returns the sample limit and time span of rolling windows
+func (c Config) window() (size int, span time.Duration) {
+	if c.WindowDuration > 0 {
+		return c.WindowMaxSamples, c.WindowDuration
+	}
+	return c.WindowSize, 0
+}
+
+// warmupSamples returns the number of samples a window of size samples must
+// hold before anomalies are reported, capped at its size so it can be reached
+func (c Config) warmupSamples(size int) int {
+	return max(1, min(c.WarmupSamples, size))
+}
+
+// windowSpan returns the span of time-based windows for display, or ""
+func (c Config) windowSpan() string {
+	if c.WindowDuration > 0 {
+		return c.WindowDuration.String()
+	}
+	return ""
+}
+
+// detectorConfig returns the parameters for creating a named detector
+func (c Config) detectorConfig(detectorName string) analytics.DetectorConfig {
+	threshold := c.Thresholds[detectorName]
+	if threshold == 0 {
+		switch detectorName {
+		case "zscore":
+			threshold = c.ZScoreThreshold
+		case "cusum":
+			threshold = c.CUSUMThreshold
+		}
+	}
+	size, span := c.window()
+	return analytics.DetectorConfig{
+		WindowSize: size,
+		WindowSpan: span,
+		Threshold:  threshold,
+		HalfLife:   c.EWMAHalfLife,
+	}
+}
+
+// parseHorizons parses a comma-separated list of durations
+func parseHorizons(s string) ([]Horizon, error) {
+	var horizons []Horizon
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		span, err := time.ParseDuration(part)
+		if err != nil || span <= 0 {
+			return nil, fmt.Errorf("expected a positive duration, got %q", part)
+		}
+		horizons = append(horizons, Horizon{Name: part, Span: span})
+	}
+	return horizons, nil
+}
+
+// parseMetricNames parses a comma-separated list of metric names
+func parseMetricNames(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !models.ValidMetricName(name) {
+			return nil, fmt.Errorf("invalid metric name %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// parseMetricPairs parses a comma-separated list of a:b metric name pairs
+func parseMetricPairs(s string) ([][2]string, error) {
+	var pairs [][2]string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		a, b, ok := strings.Cut(part, ":")
+		a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+		if !ok || !models.ValidMetricName(a) || !models.ValidMetricName(b) {
+			return nil, fmt.Errorf("expected a:b metric names, got %q", part)
+		}
+		pairs = append(pairs, [2]string{a, b})
+	}
+	return pairs, nil
+}
+
+// parsePairs parses a comma-separated list of key=value pairs
+func parsePairs(s string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", part)
+		}
+		pairs[key] = value
+	}
+	return pairs, nil
+}
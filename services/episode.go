@@ -0,0 +1,141 @@
+package services
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Default anomaly episode parameters
+const (
+	DefaultEpisodeMinSamples = 1
+	DefaultEpisodeCloseRatio = 0.8
+	DefaultEpisodeCooldown   = 30 * time.Second
+)
+
+// EpisodeConfig turns per-sample anomaly verdicts into anomaly episodes
+type EpisodeConfig struct {
+	// MinSamples and MinDuration are how long a detector must keep flagging
+	// a metric before an episode opens
+	MinSamples  int
+	MinDuration time.Duration
+
+	// CloseRatio is the fraction of the detector's threshold that the score
+	// must fall under for an open episode to close (hysteresis)
+	CloseRatio float64
+
+	// Cooldown is the minimum time between the openings of two episodes
+	Cooldown time.Duration
+}
+
+// episodeState is the phase of an anomaly episode
+type episodeState int
+
+const (
+	episodeIdle    episodeState = iota // no anomaly
+	episodePending                     // anomalous, not yet for long enough
+	episodeOpen                        // anomaly reported, waiting to close
+)
+
+// episode tracks anomaly episodes of a single metric stream. Only the opening
+// of an episode and its escalation to a higher severity are reported, so a
+// flapping signal yields one anomaly per episode rather than one per sample.
+type episode struct {
+	cfg       *EpisodeConfig
+	threshold float64 // detector threshold, 0 if unknown
+	tiers     SeverityThresholds
+
+	state        episodeState
+	severity     string // severity of the open episode
+	pendingSince time.Time
+	pendingCount int
+	lastOpened   time.Time
+
+	mu sync.Mutex
+}
+
+// thresholder is implemented by detectors exposing their anomaly threshold
+type thresholder interface {
+	Threshold() float64
+}
+
+// newEpisode creates episode tracking for a metric and its detector
+func newEpisode(cfg *Config, metricName string, detector interface{}) *episode {
+	e := &episode{cfg: &cfg.Episodes}
+	if d, ok := detector.(thresholder); ok {
+		e.threshold = d.Threshold()
+	}
+	e.tiers = cfg.severityThresholds(metricName, e.threshold)
+	return e
+}
+
+// update advances the episode with a detector verdict observed at t and
+// returns the severity of the anomaly to report: when an episode opens or
+// escalates to a higher severity. It returns "" if there is nothing to report.
+// Scores under the warning threshold do not count as anomalous.
+func (e *episode) update(t time.Time, isAnomaly bool, score float64) (severity string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	severity = e.tiers.classify(score)
+	if severity == "" {
+		isAnomaly = false
+	}
+
+	switch e.state {
+	case episodeOpen:
+		if e.closes(isAnomaly, score) {
+			e.state = episodeIdle
+			return ""
+		}
+		if isAnomaly && severityRank(severity) > severityRank(e.severity) {
+			e.severity = severity
+			return severity
+		}
+		return ""
+
+	case episodeIdle:
+		if !isAnomaly {
+			return ""
+		}
+		e.state = episodePending
+		e.pendingSince = t
+		e.pendingCount = 0
+
+	case episodePending:
+		if !isAnomaly {
+			e.state = episodeIdle
+			return ""
+		}
+	}
+
+	e.pendingCount++
+	if e.pendingCount < e.cfg.MinSamples || t.Sub(e.pendingSince) < e.cfg.MinDuration {
+		return ""
+	}
+	if !e.lastOpened.IsZero() && t.Sub(e.lastOpened) < e.cfg.Cooldown {
+		return ""
+	}
+
+	e.state = episodeOpen
+	e.severity = severity
+	e.lastOpened = t
+	return severity
+}
+
+// closes reports whether an open episode ends with the given verdict: the
+// score must be back under the lower close threshold, or, for detectors
+// without a known threshold, no longer anomalous
+func (e *episode) closes(isAnomaly bool, score float64) bool {
+	if e.threshold <= 0 {
+		return !isAnomaly
+	}
+	return math.Abs(score) < e.cfg.CloseRatio*e.threshold
+}
+
+// open reports whether an episode is currently open
+func (e *episode) open() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state == episodeOpen
+}
@@ -1,87 +1,221 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"high-load-service/analytics"
 	"high-load-service/cache"
 	"high-load-service/models"
 )
 
+// Default analytics parameters, overridable through Config
 const (
 	WindowSize      = 50
 	ZScoreThreshold = 2.0
 	ChannelBuffer   = 1000
+
+	// CorrelationInterval is how often fleet-wide correlations are published
+	CorrelationInterval = 15 * time.Second
+
+	// PercentileInterval is how often fleet-wide percentiles are published
+	PercentileInterval = 15 * time.Second
+
+	// EvictionInterval is how often idle metrics and devices are evicted
+	EvictionInterval = time.Minute
+)
+
+// Joint CPU/RPS anomaly detection
+const (
+	// CPUPerRPSMetric is the metric type of joint CPU/RPS anomalies
+	CPUPerRPSMetric = "cpu_per_rps"
+
+	// RegressionDetector scores CPU by its residual from a rolling CPU~RPS regression
+	RegressionDetector = "regression"
+)
+
+var (
+	// ErrDeviceNotFound is returned when a device has not reported any metrics yet
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrMetricNotFound is returned when a metric has not been reported yet
+	ErrMetricNotFound = errors.New("metric not found")
+
+	// ErrTooManyMetrics is returned when a metric would take its device or
+	// tenant past the limit of distinct metric names
+	ErrTooManyMetrics = errors.New("too many distinct metric names")
+
+	// ErrHistoryUnavailable is returned when anomaly event history is
+	// requested but Redis is not configured
+	ErrHistoryUnavailable = errors.New("anomaly event history requires Redis")
+
+	// ErrPairNotTracked is returned for correlations of metric pairs that are
+	// not in CORRELATION_PAIRS
+	ErrPairNotTracked = errors.New("metric pair not tracked, see CORRELATION_PAIRS")
 )
 
 // MetricsService handles metrics processing with analytics
 type MetricsService struct {
 	redis *cache.RedisClient
+	cfg   Config
 
-	// Rolling averages for smoothing
-	cpuRolling *analytics.RollingAverage
-	rpsRolling *analytics.RollingAverage
-
-	// Z-score detectors for anomaly detection
-	cpuZScore *analytics.ZScoreDetector
-	rpsZScore *analytics.ZScoreDetector
+	// Per-tenant analytics, keyed by tenant ID
+	tenants   map[string]*tenantState
+	tenantsMu sync.RWMutex
 
 	// Channels for async processing
-	metricsChan  chan models.Metric
-	anomalyChan  chan models.AnomalyEvent
-	stopChan     chan struct{}
+	metricsChan chan models.Metric
+	anomalyChan chan models.AnomalyEvent
+	stopChan    chan struct{}
 
-	// Latest values
-	latestMetric models.Metric
-	latestMu     sync.RWMutex
+	// Live anomaly event and metric update subscribers
+	anomalySubscribers *hub[models.AnomalyEvent]
+	liveSubscribers    *hub[models.LiveUpdate]
+
+	// User-defined alert rules
+	rules *ruleEngine
+
+	// Callbacks to the rest of the application
+	hooks Hooks
+}
 
-	// Anomaly counters
-	cpuAnomalyCount int64
-	rpsAnomalyCount int64
-	anomalyMu       sync.RWMutex
+// Hooks are the callbacks of a MetricsService; any of them may be nil
+type Hooks struct {
+	// Anomaly callback for Prometheus metrics, called on detection
+	OnAnomaly func(event models.AnomalyEvent)
 
-	// Total metrics counter
-	totalMetrics int64
-	totalMu      sync.RWMutex
+	// Event callback for webhooks, called once an event is stored and has its
+	// history ID; runs on the anomaly worker, so it must not block
+	OnEvent func(event models.AnomalyEvent)
 
-	// Anomaly callback for Prometheus metrics
-	onAnomaly func(metricType string)
+	// Fleet-wide update callback for Prometheus gauges of exported metrics
+	OnUpdate func(tenantID, metricName string, current, avg, zscore float64)
+
+	// Fleet-wide percentile callback for Prometheus gauges of exported
+	// metrics, called every PercentileInterval
+	OnPercentiles func(tenantID, metricName string, percentiles models.Percentiles)
+
+	// Fleet-wide correlation callback for Prometheus gauges, called every
+	// CorrelationInterval
+	OnCorrelation func(tenantID, a, b string, correlation models.Correlation)
+
+	// Alert transition callback, called on the replica evaluating the rules
+	OnAlert func(alert models.Alert, previous string)
+
+	// Alerts callback, called after every evaluation round with the current
+	// alerts of every tenant, or none on replicas that do not evaluate
+	OnAlerts func(alerts []models.Alert)
 }
 
-// NewMetricsService creates a new metrics service
-func NewMetricsService(redisClient *cache.RedisClient, onAnomaly func(string)) *MetricsService {
+// NewMetricsService creates a new metrics service reporting through hooks
+func NewMetricsService(redisClient *cache.RedisClient, cfg Config, hooks Hooks) *MetricsService {
 	ms := &MetricsService{
 		redis:       redisClient,
-		cpuRolling:  analytics.NewRollingAverage(WindowSize),
-		rpsRolling:  analytics.NewRollingAverage(WindowSize),
-		cpuZScore:   analytics.NewZScoreDetector(WindowSize, ZScoreThreshold),
-		rpsZScore:   analytics.NewZScoreDetector(WindowSize, ZScoreThreshold),
+		cfg:         cfg,
+		tenants:     make(map[string]*tenantState),
 		metricsChan: make(chan models.Metric, ChannelBuffer),
 		anomalyChan: make(chan models.AnomalyEvent, ChannelBuffer),
 		stopChan:    make(chan struct{}),
-		onAnomaly:   onAnomaly,
+		hooks:       hooks,
+
+		anomalySubscribers: newHub[models.AnomalyEvent](SubscriberBuffer),
+		liveSubscribers:    newHub[models.LiveUpdate](LiveSubscriberBuffer),
 	}
+	ms.rules = newRuleEngine(redisClient, cfg.RuleEvalInterval, ms.stopChan, hooks.OnAlert, hooks.OnAlerts)
 
 	// Start background workers
 	go ms.processMetrics()
 	go ms.processAnomalies()
+	go ms.evaluateRules()
+	go ms.evictIdle()
+	if hooks.OnPercentiles != nil {
+		go ms.publishPercentiles()
+	}
+	if hooks.OnCorrelation != nil && len(cfg.CorrelationPairs) > 0 {
+		go ms.publishCorrelations()
+	}
 
 	return ms
 }
 
+// tenantState returns the analytics state of a tenant, creating it if needed
+func (ms *MetricsService) tenantState(tenantID string) *tenantState {
+	ms.tenantsMu.RLock()
+	state, ok := ms.tenants[tenantID]
+	ms.tenantsMu.RUnlock()
+	if ok {
+		return state
+	}
+
+	ms.tenantsMu.Lock()
+	defer ms.tenantsMu.Unlock()
+	if state, ok = ms.tenants[tenantID]; !ok {
+		state = newTenantState(&ms.cfg)
+		ms.tenants[tenantID] = state
+	}
+	return state
+}
+
+// streams returns the analytics states of a tenant and one of its devices,
+// creating them if needed
+func (ms *MetricsService) streams(tenantID, deviceID string) (*tenantState, *streamState) {
+	for {
+		// No device is returned if the tenant was evicted since it was
+		// looked up, and the lookup is retried
+		tenant := ms.tenantState(tenantID)
+		if device := tenant.deviceState(deviceID); device != nil {
+			return tenant, device
+		}
+	}
+}
+
+// lookupTenant returns the analytics state of a tenant for read access.
+// Tenants that have not ingested anything yet get an empty, unregistered
+// state so fleet views remain valid without growing the tenant map.
+func (ms *MetricsService) lookupTenant(tenantID string) *tenantState {
+	if tenantID == "" {
+		tenantID = models.DefaultTenantID
+	}
+
+	ms.tenantsMu.RLock()
+	defer ms.tenantsMu.RUnlock()
+	if state, ok := ms.tenants[tenantID]; ok {
+		return state
+	}
+	return newTenantState(&ms.cfg)
+}
+
 // ProcessMetric processes an incoming metric
 func (ms *MetricsService) ProcessMetric(metric models.Metric) error {
-	// Update latest metric
-	ms.latestMu.Lock()
-	ms.latestMetric = metric
-	ms.latestMu.Unlock()
+	if metric.TenantID == "" {
+		metric.TenantID = models.DefaultTenantID
+	}
+	if metric.DeviceID == "" {
+		metric.DeviceID = models.DefaultDeviceID
+	}
+
+	for {
+		// Reject metric names beyond the limits of the device or tenant
+		tenant, device := ms.streams(metric.TenantID, metric.DeviceID)
+		if !device.admit(metric.Values) {
+			return fmt.Errorf("%w: at most %d per device", ErrTooManyMetrics, ms.cfg.MaxMetricsPerDevice)
+		}
+		if !tenant.fleet.admit(metric.Values) {
+			return fmt.Errorf("%w: at most %d per tenant", ErrTooManyMetrics, ms.cfg.MaxMetricsPerTenant)
+		}
 
-	// Increment total counter
-	ms.totalMu.Lock()
-	ms.totalMetrics++
-	ms.totalMu.Unlock()
+		// Update latest metric and counters. A device evicted since it was
+		// looked up records nothing and the lookup is retried; one that
+		// recorded the metric keeps its tenant from being evicted.
+		if device.record(metric) {
+			tenant.fleet.record(metric)
+			break
+		}
+	}
 
 	// Send to channel for async processing
 	select {
@@ -93,7 +227,7 @@ func (ms *MetricsService) ProcessMetric(metric models.Metric) error {
 
 	// Store in Redis if available
 	if ms.redis != nil {
-		if err := ms.redis.StoreMetric(metric); err != nil {
+		if err := ms.redis.StoreMetric(metric.TenantID, metric); err != nil {
 			log.Printf("Warning: failed to store metric in Redis: %v", err)
 		}
 	}
@@ -115,60 +249,117 @@ func (ms *MetricsService) processMetrics() {
 
 // processMetricSync processes a metric synchronously
 func (ms *MetricsService) processMetricSync(metric models.Metric) {
-	// Update rolling averages
-	ms.cpuRolling.Add(metric.CPU)
-	ms.rpsRolling.Add(metric.RPS)
+	tenant, device := ms.streams(metric.TenantID, metric.DeviceID)
 
-	// Check for anomalies
-	cpuAnomaly, cpuZScore := ms.cpuZScore.Add(metric.CPU)
-	rpsAnomaly, rpsZScore := ms.rpsZScore.Add(metric.RPS)
-
-	if cpuAnomaly {
-		ms.anomalyMu.Lock()
-		ms.cpuAnomalyCount++
-		ms.anomalyMu.Unlock()
+	// Device analytics for live subscribers, only collected if there are any
+	var live map[string]models.LiveAnalytics
+	if ms.liveSubscribers.active() {
+		live = make(map[string]models.LiveAnalytics, len(metric.Values))
+	}
 
-		if ms.onAnomaly != nil {
-			ms.onAnomaly("cpu")
+	for name, value := range metric.Values {
+		// Fleet-wide state is only used for the aggregate view;
+		// anomalies are detected against each device's own baseline
+		if fleetMetric, fleetObs := tenant.fleet.observe(name, metric.Timestamp, value); fleetMetric != nil {
+			if ms.hooks.OnUpdate != nil && ms.cfg.Exported(name) {
+				ms.hooks.OnUpdate(metric.TenantID, name, value, fleetMetric.rolling.GetAverage(), fleetObs.zscore)
+			}
 		}
 
-		mean, stddev := ms.cpuZScore.GetStats()
-		event := models.AnomalyEvent{
-			Timestamp:  metric.Timestamp,
-			MetricType: "cpu",
-			Value:      metric.CPU,
-			ZScore:     cpuZScore,
-			Mean:       mean,
-			StdDev:     stddev,
+		// Update analytics and check for anomalies
+		deviceMetric, obs := device.observe(name, metric.Timestamp, value)
+		if deviceMetric == nil {
+			continue
 		}
-		select {
-		case ms.anomalyChan <- event:
-		default:
+		if live != nil {
+			live[name] = models.LiveAnalytics{
+				Avg:    deviceMetric.rolling.GetAverage(),
+				ZScore: obs.zscore,
+			}
+		}
+		if obs.severity != "" {
+			mean, stddev := deviceMetric.detector.Stats()
+			ms.publishAnomaly(tenant, device, models.AnomalyEvent{
+				TenantID:   metric.TenantID,
+				DeviceID:   metric.DeviceID,
+				Timestamp:  metric.Timestamp,
+				EventType:  models.EventTypeSpike,
+				Severity:   obs.severity,
+				MetricType: name,
+				Detector:   deviceMetric.detectorName,
+				Value:      value,
+				Score:      obs.score,
+				ZScore:     obs.zscore,
+				Mean:       mean,
+				StdDev:     stddev,
+			})
+		}
+		if obs.shifted {
+			changeTime := obs.shift.ChangeTime
+			_, stddev := deviceMetric.cusum.Stats()
+			ms.publishAnomaly(tenant, device, models.AnomalyEvent{
+				TenantID:       metric.TenantID,
+				DeviceID:       metric.DeviceID,
+				Timestamp:      metric.Timestamp,
+				EventType:      models.EventTypeLevelShift,
+				Severity:       models.SeverityWarning,
+				MetricType:     name,
+				Detector:       "cusum",
+				Value:          value,
+				Score:          obs.shift.Statistic,
+				ZScore:         obs.zscore,
+				Mean:           obs.shift.OldMean,
+				StdDev:         stddev,
+				ShiftMagnitude: obs.shift.Magnitude,
+				ChangeTime:     &changeTime,
+			})
 		}
 	}
 
-	if rpsAnomaly {
-		ms.anomalyMu.Lock()
-		ms.rpsAnomalyCount++
-		ms.anomalyMu.Unlock()
-
-		if ms.onAnomaly != nil {
-			ms.onAnomaly("rps")
-		}
+	if live != nil {
+		ms.liveSubscribers.publish(models.LiveUpdate{Metric: metric, Analytics: live})
+	}
+	ms.rules.observe(metric, device.labelSet())
 
-		mean, stddev := ms.rpsZScore.GetStats()
-		event := models.AnomalyEvent{
+	// Score CPU against the CPU expected for the request rate
+	cpu, hasCPU := metric.Values["cpu"]
+	rps, hasRPS := metric.Values["rps"]
+	if !hasCPU || !hasRPS {
+		return
+	}
+	tenant.fleet.observeJoint(metric.Timestamp, cpu, rps)
+	severity, score, expected, stderr := device.observeJoint(metric.Timestamp, cpu, rps)
+	if severity != "" {
+		ms.publishAnomaly(tenant, device, models.AnomalyEvent{
+			TenantID:   metric.TenantID,
+			DeviceID:   metric.DeviceID,
 			Timestamp:  metric.Timestamp,
-			MetricType: "rps",
-			Value:      metric.RPS,
-			ZScore:     rpsZScore,
-			Mean:       mean,
-			StdDev:     stddev,
-		}
-		select {
-		case ms.anomalyChan <- event:
-		default:
-		}
+			EventType:  models.EventTypeSpike,
+			Severity:   severity,
+			MetricType: CPUPerRPSMetric,
+			Detector:   RegressionDetector,
+			Value:      cpu,
+			Score:      score,
+			ZScore:     score,
+			Mean:       expected,
+			StdDev:     stderr,
+		})
+	}
+}
+
+// publishAnomaly updates counters and publishes an anomaly event
+func (ms *MetricsService) publishAnomaly(tenant *tenantState, device *streamState, event models.AnomalyEvent) {
+	device.incrementAnomaly(event.MetricType, event.EventType, event.Severity)
+	tenant.fleet.incrementAnomaly(event.MetricType, event.EventType, event.Severity)
+	ms.rules.recordAnomaly(event, device.labelSet())
+
+	if ms.hooks.OnAnomaly != nil {
+		ms.hooks.OnAnomaly(event)
+	}
+
+	select {
+	case ms.anomalyChan <- event:
+	default:
 	}
 }
 
@@ -177,12 +368,29 @@ func (ms *MetricsService) processAnomalies() {
 	for {
 		select {
 		case event := <-ms.anomalyChan:
-			log.Printf("ANOMALY DETECTED: type=%s value=%.2f zscore=%.2f mean=%.2f stddev=%.2f",
-				event.MetricType, event.Value, event.ZScore, event.Mean, event.StdDev)
+			if event.EventType == models.EventTypeLevelShift {
+				log.Printf("LEVEL SHIFT DETECTED: tenant=%s device=%s type=%s value=%.2f magnitude=%.2f old_mean=%.2f change_time=%s",
+					event.TenantID, event.DeviceID, event.MetricType, event.Value, event.ShiftMagnitude, event.Mean, event.ChangeTime.Format(time.RFC3339))
+			} else {
+				log.Printf("ANOMALY DETECTED: tenant=%s device=%s type=%s severity=%s detector=%s value=%.2f score=%.2f zscore=%.2f mean=%.2f stddev=%.2f",
+					event.TenantID, event.DeviceID, event.MetricType, event.Severity, event.Detector, event.Value, event.Score, event.ZScore, event.Mean, event.StdDev)
+			}
 
 			// Store in Redis if available
 			if ms.redis != nil {
-				ms.redis.IncrementAnomalyCount(event.MetricType)
+				ms.redis.IncrementAnomalyCount(event.TenantID, event.MetricType, event.EventType, event.Severity)
+				stored, err := ms.redis.StoreAnomalyEvent(event.TenantID, event, ms.cfg.EventRetention)
+				if err != nil {
+					log.Printf("Warning: failed to store anomaly event in Redis: %v", err)
+				} else {
+					event = stored
+				}
+			}
+
+			// Push to live subscribers and webhooks once the event has its history ID
+			ms.anomalySubscribers.publish(event)
+			if ms.hooks.OnEvent != nil {
+				ms.hooks.OnEvent(event)
 			}
 		case <-ms.stopChan:
 			return
@@ -190,52 +398,361 @@ func (ms *MetricsService) processAnomalies() {
 	}
 }
 
-// GetAnalytics returns current analytics results
-func (ms *MetricsService) GetAnalytics() models.AnalyticsResult {
-	ms.latestMu.RLock()
-	latest := ms.latestMetric
-	ms.latestMu.RUnlock()
-
-	ms.totalMu.RLock()
-	total := ms.totalMetrics
-	ms.totalMu.RUnlock()
+// GetAnalytics returns current analytics results for a device of a tenant,
+// or the tenant's fleet-wide results if deviceID is empty
+func (ms *MetricsService) GetAnalytics(tenantID, deviceID string) (models.AnalyticsResult, error) {
+	state, err := ms.lookupTenant(tenantID).lookupState(deviceID)
+	if err != nil {
+		return models.AnalyticsResult{}, err
+	}
 
-	// Check if current values are anomalies
-	cpuAnomaly, cpuZScore := ms.cpuZScore.IsAnomaly(latest.CPU)
-	rpsAnomaly, rpsZScore := ms.rpsZScore.IsAnomaly(latest.RPS)
+	state.mu.RLock()
+	total := state.totalMetrics
+	labels := state.labels
+	state.mu.RUnlock()
 
 	return models.AnalyticsResult{
-		CurrentCPU:   latest.CPU,
-		CurrentRPS:   latest.RPS,
-		AvgCPU:       ms.cpuRolling.GetAverage(),
-		AvgRPS:       ms.rpsRolling.GetAverage(),
-		PredictedCPU: ms.cpuRolling.GetPrediction(),
-		PredictedRPS: ms.rpsRolling.GetPrediction(),
-		CPUZScore:    cpuZScore,
-		RPSZScore:    rpsZScore,
-		CPUAnomaly:   cpuAnomaly,
-		RPSAnomaly:   rpsAnomaly,
+		DeviceID:     deviceID,
+		Labels:       labels,
+		Metrics:      state.snapshot(),
 		TotalMetrics: int(total),
-		WindowSize:   WindowSize,
+		WindowSize:   ms.cfg.WindowSize,
+		WindowSpan:   ms.cfg.windowSpan(),
 		LastUpdated:  time.Now(),
+	}, nil
+}
+
+// GetGroupedAnalytics returns analytics aggregated over the tenant's devices
+// whose labels satisfy the matchers, grouped by the values of the groupBy labels.
+// Without groupBy a single group covering all matching devices is returned.
+//
+// Within a group, current, average, predicted and z-score values are the mean
+// over devices reporting the metric, anomaly counts are summed, and the anomaly
+// flag is set if any device is currently anomalous.
+func (ms *MetricsService) GetGroupedAnalytics(tenantID string, matchers []models.LabelMatcher, groupBy []string) []models.AnalyticsResult {
+	groups := make(map[string]*deviceGroup)
+	for _, state := range ms.lookupTenant(tenantID).deviceStates() {
+		labels := state.labelSet()
+		if !models.MatchLabels(matchers, labels) {
+			continue
+		}
+
+		groupLabels := make(map[string]string, len(groupBy))
+		keyParts := make([]string, len(groupBy))
+		for i, name := range groupBy {
+			groupLabels[name] = labels[name]
+			keyParts[i] = labels[name]
+		}
+		key := strings.Join(keyParts, "\x00")
+
+		group, ok := groups[key]
+		if !ok {
+			group = &deviceGroup{cfg: &ms.cfg, labels: groupLabels}
+			groups[key] = group
+		}
+		group.add(state)
+	}
+
+	results := make([]models.AnalyticsResult, 0, len(groups))
+	for _, group := range groups {
+		results = append(results, group.result())
+	}
+	sort.Slice(results, func(i, j int) bool {
+		for _, name := range groupBy {
+			if a, b := results[i].Labels[name], results[j].Labels[name]; a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+	return results
+}
+
+// Forecast predicts a metric of a device (or the tenant's fleet if deviceID
+// is empty) for horizon steps of the given duration after the last sample,
+// with prediction intervals at the given confidence level
+func (ms *MetricsService) Forecast(tenantID, deviceID, metricName string, horizon int, step time.Duration, confidence float64) (models.ForecastResult, error) {
+	state, err := ms.lookupTenant(tenantID).lookupState(deviceID)
+	if err != nil {
+		return models.ForecastResult{}, err
+	}
+	metric, ok := state.lookupMetric(metricName)
+	if !ok {
+		return models.ForecastResult{}, ErrMetricNotFound
+	}
+
+	forecaster := metric.forecast()
+	origin := forecaster.LastUpdate()
+	points := make([]models.ForecastPoint, horizon)
+	for i := range points {
+		t := origin.Add(time.Duration(i+1) * step)
+		value, lower, upper := forecaster.ForecastInterval(t, confidence)
+		points[i] = models.ForecastPoint{
+			Timestamp: t,
+			Value:     value,
+			Lower:     lower,
+			Upper:     upper,
+		}
+	}
+
+	return models.ForecastResult{
+		DeviceID:   deviceID,
+		Metric:     metricName,
+		Model:      "holt_winters",
+		Origin:     origin,
+		Step:       step.String(),
+		Horizon:    horizon,
+		Confidence: confidence,
+		Points:     points,
+	}, nil
+}
+
+// Correlation returns the Pearson and Spearman correlation of metrics a and b
+// over the current window of a device of a tenant, or fleet-wide together
+// with each device's correlation if deviceID is empty
+func (ms *MetricsService) Correlation(tenantID, deviceID, a, b string) (models.CorrelationResult, error) {
+	if _, _, ok := ms.cfg.correlationPair(a, b); !ok {
+		return models.CorrelationResult{}, fmt.Errorf("%w: %s:%s", ErrPairNotTracked, a, b)
+	}
+	tenant := ms.lookupTenant(tenantID)
+	state, err := tenant.lookupState(deviceID)
+	if err != nil {
+		return models.CorrelationResult{}, err
+	}
+	for _, name := range []string{a, b} {
+		if _, ok := state.lookupMetric(name); !ok {
+			return models.CorrelationResult{}, fmt.Errorf("%w: %s", ErrMetricNotFound, name)
+		}
+	}
+
+	result := models.CorrelationResult{
+		A:           a,
+		B:           b,
+		DeviceID:    deviceID,
+		Correlation: state.correlation(a, b),
+		Calculated:  time.Now(),
+	}
+	if deviceID == "" {
+		result.Devices = make(map[string]models.Correlation)
+		for id, device := range tenant.deviceMap() {
+			if correlation := device.correlation(a, b); correlation.Samples > 0 {
+				result.Devices[id] = correlation
+			}
+		}
+	}
+	return result, nil
+}
+
+// publishPercentiles periodically reports the fleet-wide percentiles of the
+// exported metrics of every tenant; walking the sketches is left out of the
+// per-sample path
+func (ms *MetricsService) publishPercentiles() {
+	ticker := time.NewTicker(PercentileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.tenantsMu.RLock()
+			tenants := make(map[string]*tenantState, len(ms.tenants))
+			for id, tenant := range ms.tenants {
+				tenants[id] = tenant
+			}
+			ms.tenantsMu.RUnlock()
+
+			for id, tenant := range tenants {
+				for name, state := range tenant.fleet.metricStates(ms.cfg.Exported) {
+					ms.hooks.OnPercentiles(id, name, state.percentiles())
+				}
+			}
+		case <-ms.stopChan:
+			return
+		}
+	}
+}
+
+// publishCorrelations periodically reports the fleet-wide correlation of the
+// configured metric pairs of every tenant
+func (ms *MetricsService) publishCorrelations() {
+	ticker := time.NewTicker(CorrelationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.tenantsMu.RLock()
+			tenants := make(map[string]*tenantState, len(ms.tenants))
+			for id, tenant := range ms.tenants {
+				tenants[id] = tenant
+			}
+			ms.tenantsMu.RUnlock()
+
+			for id, tenant := range tenants {
+				for _, pair := range ms.cfg.CorrelationPairs {
+					correlation := tenant.fleet.correlation(pair[0], pair[1])
+					if correlation.Samples > 0 {
+						ms.hooks.OnCorrelation(id, pair[0], pair[1], correlation)
+					}
+				}
+			}
+		case <-ms.stopChan:
+			return
+		}
+	}
+}
+
+// evaluateRules periodically evaluates the alert rules of every tenant, and
+// reloads them when another replica announces a change
+func (ms *MetricsService) evaluateRules() {
+	ticker := time.NewTicker(ms.cfg.RuleEvalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			ms.rules.evaluate(now)
+		case <-ms.rules.changes:
+			ms.rules.sync(time.Now())
+		case <-ms.stopChan:
+			return
+		}
+	}
+}
+
+// evictIdle periodically evicts the metrics, devices and tenants that
+// received no value within the idle timeout
+func (ms *MetricsService) evictIdle() {
+	ticker := time.NewTicker(EvictionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			cutoff := now.Add(-ms.cfg.MetricIdleTimeout)
+			ms.tenantsMu.RLock()
+			tenants := make(map[string]*tenantState, len(ms.tenants))
+			for id, tenant := range ms.tenants {
+				tenants[id] = tenant
+			}
+			ms.tenantsMu.RUnlock()
+
+			for id, tenant := range tenants {
+				if !tenant.evictIdle(cutoff) {
+					continue
+				}
+				// Only drop the tenant if nothing arrived in the meantime
+				ms.tenantsMu.Lock()
+				if tenant.evict(cutoff) {
+					delete(ms.tenants, id)
+				}
+				ms.tenantsMu.Unlock()
+			}
+		case <-ms.stopChan:
+			return
+		}
+	}
+}
+
+// AlertRules returns the alert rules of a tenant sorted by name
+func (ms *MetricsService) AlertRules(tenantID string) []models.AlertRule {
+	return ms.rules.rules(tenantID)
+}
+
+// AlertRule returns an alert rule of a tenant
+func (ms *MetricsService) AlertRule(tenantID, id string) (models.AlertRule, error) {
+	return ms.rules.rule(tenantID, id)
+}
+
+// CreateAlertRule adds a validated alert rule to a tenant and returns it with
+// its assigned ID
+func (ms *MetricsService) CreateAlertRule(tenantID string, rule models.AlertRule) (models.AlertRule, error) {
+	return ms.rules.put(tenantID, "", rule)
+}
+
+// UpdateAlertRule replaces an alert rule of a tenant with a validated
+// definition. Alerts of the previous definition end.
+func (ms *MetricsService) UpdateAlertRule(tenantID, id string, rule models.AlertRule) (models.AlertRule, error) {
+	return ms.rules.put(tenantID, id, rule)
+}
+
+// DeleteAlertRule deletes an alert rule of a tenant, ending its alerts
+func (ms *MetricsService) DeleteAlertRule(tenantID, id string) error {
+	return ms.rules.delete(tenantID, id)
+}
+
+// Alerts returns the alerts of a tenant's rules matching the filter:
+// pending and firing ones, and recently resolved ones
+func (ms *MetricsService) Alerts(tenantID string, filter models.AlertFilter) ([]models.Alert, error) {
+	return ms.rules.alerts(tenantID, filter)
+}
+
+// GetAnomalyCounts returns anomaly counters keyed by metric name for a device
+// of a tenant, or the tenant's fleet-wide counters if deviceID is empty
+func (ms *MetricsService) GetAnomalyCounts(tenantID, deviceID string) (map[string]int64, error) {
+	state, err := ms.lookupTenant(tenantID).lookupState(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return state.anomalyCounts(), nil
+}
+
+// AnomalyEvents returns a page of a tenant's stored anomaly events matching the query
+func (ms *MetricsService) AnomalyEvents(tenantID string, query models.AnomalyEventQuery) (models.AnomalyEventPage, error) {
+	if ms.redis == nil {
+		return models.AnomalyEventPage{}, ErrHistoryUnavailable
+	}
+	return ms.redis.GetAnomalyEvents(tenantID, query)
+}
+
+// SubscribeAnomalies subscribes to a tenant's anomaly events matching the
+// filter as they are processed. The subscription must be closed when done.
+func (ms *MetricsService) SubscribeAnomalies(tenantID string, filter models.AnomalyEventFilter) *Subscription[models.AnomalyEvent] {
+	if tenantID == "" {
+		tenantID = models.DefaultTenantID
 	}
+	return ms.anomalySubscribers.subscribe(func(event models.AnomalyEvent) bool {
+		return event.TenantID == tenantID && filter.Matches(event)
+	})
+}
+
+// SubscribeLive subscribes to a tenant's ingested metrics matching the filter,
+// with the device analytics they updated, as they are processed. The
+// subscription must be closed when done.
+func (ms *MetricsService) SubscribeLive(tenantID string, filter models.LiveFilter) *Subscription[models.LiveUpdate] {
+	if tenantID == "" {
+		tenantID = models.DefaultTenantID
+	}
+	return ms.liveSubscribers.subscribe(func(update models.LiveUpdate) bool {
+		return update.TenantID == tenantID && filter.Matches(update)
+	})
+}
+
+// GetTotalMetrics returns total metrics processed for a device of a tenant,
+// or the tenant's fleet-wide total if deviceID is empty
+func (ms *MetricsService) GetTotalMetrics(tenantID, deviceID string) (int64, error) {
+	state, err := ms.lookupTenant(tenantID).lookupState(deviceID)
+	if err != nil {
+		return 0, err
+	}
+
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return state.totalMetrics, nil
 }
 
-// GetAnomalyCounts returns anomaly counters
-func (ms *MetricsService) GetAnomalyCounts() (cpu, rps int64) {
-	ms.anomalyMu.RLock()
-	defer ms.anomalyMu.RUnlock()
-	return ms.cpuAnomalyCount, ms.rpsAnomalyCount
+// GetDeviceCount returns the number of devices of a tenant that have reported metrics
+func (ms *MetricsService) GetDeviceCount(tenantID string) int {
+	return ms.lookupTenant(tenantID).deviceCount()
 }
 
-// GetTotalMetrics returns total metrics processed
-func (ms *MetricsService) GetTotalMetrics() int64 {
-	ms.totalMu.RLock()
-	defer ms.totalMu.RUnlock()
-	return ms.totalMetrics
+// Config returns the analytics configuration of the service
+func (ms *MetricsService) Config() Config {
+	return ms.cfg
 }
 
 // Stop gracefully stops the service
 func (ms *MetricsService) Stop() {
 	close(ms.stopChan)
+	ms.anomalySubscribers.closeAll()
+	ms.liveSubscribers.closeAll()
 }
@@ -0,0 +1,942 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"high-load-service/analytics"
+	"high-load-service/cache"
+	"high-load-service/models"
+)
+
+// Alert rule evaluation parameters
+const (
+	// DefaultRuleEvalInterval is how often alert rules are evaluated
+	DefaultRuleEvalInterval = 15 * time.Second
+
+	// RuleSeriesStaleAfter is how long a device may stop reporting a rule's
+	// metric before it no longer satisfies threshold and change rules
+	RuleSeriesStaleAfter = 5 * time.Minute
+
+	// ResolvedAlertRetention is how long resolved alerts remain listed
+	ResolvedAlertRetention = 15 * time.Minute
+
+	// MaxRulesPerTenant limits the number of alert rules of a tenant
+	MaxRulesPerTenant = 100
+)
+
+var (
+	// ErrRuleNotFound is returned when an alert rule does not exist
+	ErrRuleNotFound = errors.New("alert rule not found")
+
+	// ErrRuleNameTaken is returned when another rule of the tenant has the same name
+	ErrRuleNameTaken = errors.New("alert rule name already in use")
+
+	// ErrTooManyRules is returned when a tenant already has MaxRulesPerTenant rules
+	ErrTooManyRules = fmt.Errorf("at most %d alert rules per tenant are allowed", MaxRulesPerTenant)
+)
+
+// ruleSeries is what a rule has seen of one device, or one group of devices,
+// on this replica
+type ruleSeries struct {
+	labels  map[string]string
+	updated time.Time
+
+	// Latest value of threshold and change rules
+	value float64
+
+	// Mean over the window of change rules, kept in time buckets so memory
+	// does not grow with the device's ingest rate
+	avg *analytics.HorizonStats
+
+	// Arrival times of the anomalies counted by anomaly_rate rules, oldest first
+	anomalies []time.Time
+}
+
+// ruleState is an alert rule with its parsed parameters, series and alerts
+type ruleState struct {
+	rule     models.AlertRule
+	matchers []models.LabelMatcher
+	window   time.Duration
+	hold     time.Duration // the rule's for duration
+	minRank  int
+
+	// Series and their alerts, keyed by device ID or group label values
+	series map[string]*ruleSeries
+	alerts map[string]*models.Alert
+}
+
+// compileRule parses the parameters of a valid rule
+func compileRule(rule models.AlertRule) (*ruleState, error) {
+	if rule.Severity == "" {
+		rule.Severity = models.SeverityWarning
+	}
+	matchers, err := models.ParseLabelMatchers(rule.Match)
+	if err != nil {
+		return nil, err
+	}
+	state := &ruleState{
+		rule:     rule,
+		matchers: matchers,
+		minRank:  severityRank(rule.MinSeverity),
+		series:   make(map[string]*ruleSeries),
+		alerts:   make(map[string]*models.Alert),
+	}
+	if rule.Window != "" {
+		if state.window, err = time.ParseDuration(rule.Window); err != nil {
+			return nil, err
+		}
+	}
+	if rule.For != "" {
+		if state.hold, err = time.ParseDuration(rule.For); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// compare reports whether a value satisfies the rule's condition
+func (rs *ruleState) compare(value float64) bool {
+	switch rs.rule.Op {
+	case ">":
+		return value > rs.rule.Threshold
+	case ">=":
+		return value >= rs.rule.Threshold
+	case "<":
+		return value < rs.rule.Threshold
+	case "<=":
+		return value <= rs.rule.Threshold
+	}
+	return false
+}
+
+// seriesKey returns the key and labels of the series a device belongs to:
+// the device itself, or its group for grouped rules
+func (rs *ruleState) seriesKey(deviceID string, labels map[string]string) (string, map[string]string) {
+	if len(rs.rule.GroupBy) == 0 {
+		return deviceID, map[string]string{"device_id": deviceID}
+	}
+	groupLabels := make(map[string]string, len(rs.rule.GroupBy))
+	keyParts := make([]string, len(rs.rule.GroupBy))
+	for i, name := range rs.rule.GroupBy {
+		groupLabels[name] = labels[name]
+		keyParts[i] = labels[name]
+	}
+	return strings.Join(keyParts, "\x00"), groupLabels
+}
+
+// alertKey returns the key of the series an alert with the given labels belongs to
+func (rs *ruleState) alertKey(labels map[string]string) string {
+	key, _ := rs.seriesKey(labels["device_id"], labels)
+	return key
+}
+
+// observe updates the series of a device with its value of the rule's metric
+func (rs *ruleState) observe(now, t time.Time, deviceID string, value float64) {
+	s, ok := rs.series[deviceID]
+	if !ok {
+		s = &ruleSeries{labels: map[string]string{"device_id": deviceID}}
+		if rs.rule.Kind == models.RuleKindChange {
+			s.avg = analytics.NewHorizonStats(rs.window, 0)
+		}
+		rs.series[deviceID] = s
+	}
+	s.updated = now
+	s.value = value
+	if s.avg != nil {
+		s.avg.AddAt(t, value)
+	}
+}
+
+// recordAnomaly counts an anomaly in the series of its device or group
+func (rs *ruleState) recordAnomaly(now time.Time, event models.AnomalyEvent, labels map[string]string) {
+	key, seriesLabels := rs.seriesKey(event.DeviceID, labels)
+	s, ok := rs.series[key]
+	if !ok {
+		s = &ruleSeries{labels: seriesLabels}
+		rs.series[key] = s
+	}
+	s.anomalies = append(s.anomalies, now)
+	s.updated = now
+}
+
+// inputs returns what this replica has seen of each series at now; series
+// that went stale or counted no anomaly within the window are removed
+func (rs *ruleState) inputs(now time.Time) map[string]models.AlertSeriesInput {
+	inputs := make(map[string]models.AlertSeriesInput, len(rs.series))
+	cutoff := now.Add(-rs.window)
+	for key, s := range rs.series {
+		input := models.AlertSeriesInput{Labels: s.labels, Updated: s.updated}
+		if rs.rule.Kind == models.RuleKindAnomalyRate {
+			i := sort.Search(len(s.anomalies), func(i int) bool { return s.anomalies[i].After(cutoff) })
+			s.anomalies = s.anomalies[i:]
+			if len(s.anomalies) == 0 {
+				delete(rs.series, key)
+				continue
+			}
+			input.Anomalies = len(s.anomalies)
+		} else {
+			if now.Sub(s.updated) > RuleSeriesStaleAfter {
+				delete(rs.series, key)
+				continue
+			}
+			input.Value = s.value
+			if s.avg != nil {
+				input.Mean, _ = s.avg.Stats()
+				input.Count = s.avg.Count()
+			}
+		}
+		inputs[key] = input
+	}
+	return inputs
+}
+
+// value combines the inputs of a series from every replica into the rule's
+// value at now: the latest value for threshold rules, its percent change
+// from the mean of the values before it over every replica's window for
+// change rules, and the anomalies per minute counted by all replicas for
+// anomaly_rate rules. It reports false if the series has no usable value.
+func (rs *ruleState) value(now time.Time, inputs []models.AlertSeriesInput) (float64, bool) {
+	if rs.rule.Kind == models.RuleKindAnomalyRate {
+		anomalies := 0
+		for _, input := range inputs {
+			anomalies += input.Anomalies
+		}
+		return float64(anomalies) / rs.window.Minutes(), anomalies > 0
+	}
+
+	var latest *models.AlertSeriesInput
+	sum, count := 0.0, 0
+	for i := range inputs {
+		input := &inputs[i]
+		if now.Sub(input.Updated) > RuleSeriesStaleAfter {
+			continue
+		}
+		if latest == nil || input.Updated.After(latest.Updated) {
+			latest = input
+		}
+		sum += input.Mean * float64(input.Count)
+		count += input.Count
+	}
+	switch {
+	case latest == nil:
+		return 0, false
+	case rs.rule.Kind == models.RuleKindThreshold:
+		return latest.Value, true
+	case count < 2:
+		return 0, false
+	}
+	avg := (sum - latest.Value) / float64(count-1)
+	if avg == 0 {
+		return 0, false
+	}
+	return (latest.Value - avg) / math.Abs(avg) * 100, true
+}
+
+// alertTransition is a change of an alert's state, reported after evaluation
+type alertTransition struct {
+	alert    models.Alert
+	previous string
+}
+
+// evaluate updates the rule's alerts at now from the inputs of each series
+// from every replica, and returns their transitions
+func (rs *ruleState) evaluate(now time.Time, tenantID string, series map[string][]models.AlertSeriesInput) []alertTransition {
+	var transitions []alertTransition
+	transition := func(alert *models.Alert, state string) {
+		previous := alert.State
+		alert.State = state
+		transitions = append(transitions, alertTransition{copyAlert(*alert), previous})
+	}
+
+	active := make(map[string]bool, len(series))
+	for key, inputs := range series {
+		value, ok := rs.value(now, inputs)
+		if !ok {
+			continue
+		}
+		alert := rs.alerts[key]
+		if alert != nil {
+			alert.Value = value
+		}
+		if !rs.compare(value) {
+			continue
+		}
+		active[key] = true
+
+		if alert == nil || alert.State == models.AlertStateResolved {
+			alert = &models.Alert{
+				TenantID:    tenantID,
+				RuleID:      rs.rule.ID,
+				Rule:        rs.rule.Name,
+				Severity:    rs.rule.Severity,
+				Description: rs.rule.Description,
+				Labels:      inputs[0].Labels,
+				Value:       value,
+				Threshold:   rs.rule.Threshold,
+				ActiveAt:    now,
+			}
+			rs.alerts[key] = alert
+			transition(alert, models.AlertStatePending)
+		}
+		if alert.State == models.AlertStatePending && now.Sub(alert.ActiveAt) >= rs.hold {
+			firedAt := now
+			alert.FiredAt = &firedAt
+			transition(alert, models.AlertStateFiring)
+		}
+	}
+
+	for key, alert := range rs.alerts {
+		if active[key] {
+			continue
+		}
+		switch alert.State {
+		case models.AlertStatePending:
+			delete(rs.alerts, key)
+			transition(alert, models.AlertStateInactive)
+		case models.AlertStateFiring:
+			resolvedAt := now
+			alert.ResolvedAt = &resolvedAt
+			transition(alert, models.AlertStateResolved)
+		case models.AlertStateResolved:
+			if now.Sub(*alert.ResolvedAt) > ResolvedAlertRetention {
+				delete(rs.alerts, key)
+			}
+		}
+	}
+	return transitions
+}
+
+// clear ends every alert of the rule, when it is replaced or deleted, and
+// returns their transitions
+func (rs *ruleState) clear(now time.Time) []alertTransition {
+	var transitions []alertTransition
+	for key, alert := range rs.alerts {
+		previous := alert.State
+		switch previous {
+		case models.AlertStatePending:
+			alert.State = models.AlertStateInactive
+		case models.AlertStateFiring:
+			resolvedAt := now
+			alert.State, alert.ResolvedAt = models.AlertStateResolved, &resolvedAt
+		default:
+			continue
+		}
+		transitions = append(transitions, alertTransition{copyAlert(*alert), previous})
+		delete(rs.alerts, key)
+	}
+	return transitions
+}
+
+// copyAlert returns a copy of an alert that shares nothing with it
+func copyAlert(alert models.Alert) models.Alert {
+	labels := make(map[string]string, len(alert.Labels))
+	for k, v := range alert.Labels {
+		labels[k] = v
+	}
+	alert.Labels = labels
+	if alert.FiredAt != nil {
+		t := *alert.FiredAt
+		alert.FiredAt = &t
+	}
+	if alert.ResolvedAt != nil {
+		t := *alert.ResolvedAt
+		alert.ResolvedAt = &t
+	}
+	return alert
+}
+
+// tenantRules holds the alert rules of a tenant
+type tenantRules struct {
+	rules map[string]*ruleState // keyed by rule ID
+
+	// version counts the rule changes made through this replica, so a sync
+	// from Redis can tell whether it raced with one
+	version uint64
+
+	mu sync.Mutex
+}
+
+// ruleEvaluatorHold is how many evaluation intervals a replica holds the
+// evaluator role, and its published inputs live, without renewing them
+const ruleEvaluatorHold = 3
+
+// ruleEngine evaluates user-defined alert rules against the metric streams
+// and anomalies of every tenant. Threshold and change rules follow the values
+// of each matching device, anomaly_rate rules count the anomalies of each
+// matching device or group; every EvalInterval each rule's condition is
+// checked per device or group, moving its alerts between pending, firing and
+// resolved.
+//
+// With Redis, the replicas behind the load balancer each see part of the
+// traffic, so they share what they saw instead of evaluating on their own:
+// every interval each replica publishes its inputs, and a single replica,
+// elected through a Redis lock, evaluates the rules on the inputs of all of
+// them and stores the alerts, which every replica serves. Rules are stored in
+// Redis too and reloaded when their version changes, as announced through
+// pub/sub. Without Redis the replica evaluates its own inputs.
+type ruleEngine struct {
+	redis     *cache.RedisClient
+	replicaID string
+	interval  time.Duration
+
+	tenants map[string]*tenantRules
+	mu      sync.RWMutex
+
+	// Rule changes announced by other replicas, the version of the rules last
+	// read from Redis, and whether this replica evaluated the last round;
+	// used by the evaluation goroutine only
+	changes   <-chan struct{}
+	version   int64
+	evaluator bool
+
+	// Stored rules that failed to compile, by tenant, ID and update time, so
+	// each is only logged once
+	invalid map[string]bool
+
+	// Alert transition callback, called on the evaluating replica
+	onAlert func(alert models.Alert, previous string)
+
+	// Alerts callback, called after every evaluation round with the current
+	// alerts of every tenant, or none on replicas that do not evaluate
+	onAlerts func(alerts []models.Alert)
+}
+
+// newRuleEngine creates a rule engine evaluated every interval, loading the
+// rules stored in Redis and following their changes until stop is closed
+func newRuleEngine(redisClient *cache.RedisClient, interval time.Duration, stop <-chan struct{},
+	onAlert func(models.Alert, string), onAlerts func([]models.Alert)) *ruleEngine {
+	re := &ruleEngine{
+		redis:     redisClient,
+		replicaID: replicaID(),
+		interval:  interval,
+		tenants:   make(map[string]*tenantRules),
+		invalid:   make(map[string]bool),
+		onAlert:   onAlert,
+		onAlerts:  onAlerts,
+	}
+	if redisClient != nil {
+		re.changes = redisClient.SubscribeAlertRuleChanges(stop)
+		re.sync(time.Now())
+	}
+	return re
+}
+
+// replicaID returns an identifier of this replica: its host name, which is
+// the pod name on Kubernetes, and a random suffix
+func replicaID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "replica"
+	}
+	return host + "-" + randomID()[:8]
+}
+
+// syncIfChanged syncs the rules if their version in Redis changed since the
+// last sync, catching up on announcements missed while disconnected
+func (re *ruleEngine) syncIfChanged(now time.Time) {
+	version, err := re.redis.GetAlertRulesVersion()
+	if err != nil {
+		log.Printf("Warning: failed to read the alert rules version: %v", err)
+		return
+	}
+	if version != re.version {
+		re.sync(now)
+	}
+}
+
+// sync replaces the rules of every tenant with the rules stored in Redis, so
+// that rules created, replaced or deleted through another replica apply here
+// too. A stored rule whose update time differs from the rule in memory starts
+// over, like a rule replaced through the API; rules no longer stored end their
+// alerts. Tenants whose rules changed through this replica while Redis was
+// read are left for the next sync. If Redis fails, the rules in memory are kept.
+func (re *ruleEngine) sync(now time.Time) {
+	re.mu.RLock()
+	tenants := make(map[string]*tenantRules, len(re.tenants))
+	versions := make(map[string]uint64, len(re.tenants))
+	for id, tr := range re.tenants {
+		tr.mu.Lock()
+		tenants[id], versions[id] = tr, tr.version
+		tr.mu.Unlock()
+	}
+	re.mu.RUnlock()
+
+	// Read the version first, so that a change made while the rules are read
+	// triggers another sync
+	version, err := re.redis.GetAlertRulesVersion()
+	if err != nil {
+		log.Printf("Warning: failed to load alert rules from Redis: %v", err)
+		return
+	}
+	stored, err := re.redis.GetAlertRules()
+	if err != nil {
+		log.Printf("Warning: failed to load alert rules from Redis: %v", err)
+		return
+	}
+	re.version = version
+	for tenantID := range stored {
+		if _, ok := tenants[tenantID]; !ok {
+			tenants[tenantID] = re.tenant(tenantID)
+		}
+	}
+
+	for tenantID, tr := range tenants {
+		rules := make(map[string]models.AlertRule, len(stored[tenantID]))
+		for _, rule := range stored[tenantID] {
+			rules[rule.ID] = rule
+		}
+
+		var transitions []alertTransition
+		tr.mu.Lock()
+		if tr.version != versions[tenantID] {
+			tr.mu.Unlock()
+			continue
+		}
+		for id, rs := range tr.rules {
+			if rule, ok := rules[id]; !ok || !rule.UpdatedAt.Equal(rs.rule.UpdatedAt) {
+				transitions = append(transitions, rs.clear(now)...)
+				delete(tr.rules, id)
+			}
+		}
+		for id, rule := range rules {
+			if _, ok := tr.rules[id]; ok {
+				continue
+			}
+			if state, ok := re.compileStored(tenantID, rule); ok {
+				tr.rules[id] = state
+			}
+		}
+		tr.mu.Unlock()
+
+		re.report(transitions)
+	}
+}
+
+// compileStored compiles a rule read from Redis, logging invalid rules once
+func (re *ruleEngine) compileStored(tenantID string, rule models.AlertRule) (*ruleState, bool) {
+	err := rule.Validate()
+	var state *ruleState
+	if err == nil {
+		state, err = compileRule(rule)
+	}
+	if err == nil {
+		return state, true
+	}
+
+	key := tenantID + "/" + rule.ID + "/" + rule.UpdatedAt.String()
+	if !re.invalid[key] {
+		re.invalid[key] = true
+		log.Printf("Warning: skipping invalid alert rule %s of tenant %s: %v", rule.ID, tenantID, err)
+	}
+	return nil, false
+}
+
+// tenant returns the rules of a tenant, creating them if needed
+func (re *ruleEngine) tenant(tenantID string) *tenantRules {
+	if tenantID == "" {
+		tenantID = models.DefaultTenantID
+	}
+
+	re.mu.RLock()
+	tr, ok := re.tenants[tenantID]
+	re.mu.RUnlock()
+	if ok {
+		return tr
+	}
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if tr, ok = re.tenants[tenantID]; !ok {
+		tr = &tenantRules{rules: make(map[string]*ruleState)}
+		re.tenants[tenantID] = tr
+	}
+	return tr
+}
+
+// lookupTenant returns the rules of a tenant, or nil if it never had any
+func (re *ruleEngine) lookupTenant(tenantID string) *tenantRules {
+	if tenantID == "" {
+		tenantID = models.DefaultTenantID
+	}
+
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	return re.tenants[tenantID]
+}
+
+// observe feeds an ingested metric of a device with the given labels to the
+// tenant's threshold and change rules
+func (re *ruleEngine) observe(metric models.Metric, labels map[string]string) {
+	tr := re.lookupTenant(metric.TenantID)
+	if tr == nil {
+		return
+	}
+
+	now := time.Now()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, rs := range tr.rules {
+		if rs.rule.Kind == models.RuleKindAnomalyRate {
+			continue
+		}
+		value, ok := metric.Values[rs.rule.Metric]
+		if !ok || !models.MatchLabels(rs.matchers, labels) {
+			continue
+		}
+		rs.observe(now, metric.Timestamp, metric.DeviceID, value)
+	}
+}
+
+// recordAnomaly feeds an anomaly of a device with the given labels to the
+// tenant's anomaly_rate rules
+func (re *ruleEngine) recordAnomaly(event models.AnomalyEvent, labels map[string]string) {
+	tr := re.lookupTenant(event.TenantID)
+	if tr == nil {
+		return
+	}
+
+	now := time.Now()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, rs := range tr.rules {
+		if rs.rule.Kind != models.RuleKindAnomalyRate {
+			continue
+		}
+		if rs.rule.Metric != "" && rs.rule.Metric != event.MetricType {
+			continue
+		}
+		if severityRank(event.Severity) < rs.minRank || !models.MatchLabels(rs.matchers, labels) {
+			continue
+		}
+		rs.recordAnomaly(now, event, labels)
+	}
+}
+
+// evaluate runs an evaluation round at now. Without Redis this replica
+// evaluates its own inputs; with Redis it publishes its inputs and, if it
+// holds the evaluator role, evaluates the inputs of every replica and stores
+// the alerts. A replica taking over the role continues from the stored
+// alerts, so firing alerts do not fire again.
+func (re *ruleEngine) evaluate(now time.Time) {
+	if re.redis == nil {
+		re.evaluateInputs(now, []models.AlertInputs{re.inputs(now)})
+		return
+	}
+
+	re.syncIfChanged(now)
+	hold := ruleEvaluatorHold * re.interval
+	if err := re.redis.StoreAlertInputs(re.replicaID, re.inputs(now), hold); err != nil {
+		log.Printf("Warning: failed to publish alert rule inputs: %v", err)
+	}
+
+	evaluator, err := re.redis.AcquireAlertEvaluator(re.replicaID, hold)
+	if err != nil {
+		log.Printf("Warning: skipping alert rule evaluation: %v", err)
+		return
+	}
+	if !evaluator {
+		if re.evaluator {
+			log.Printf("Replica %s stopped evaluating alert rules", re.replicaID)
+			re.evaluator = false
+			re.dropAlerts()
+		}
+		if re.onAlerts != nil {
+			re.onAlerts(nil)
+		}
+		return
+	}
+	if !re.evaluator {
+		if err := re.loadAlerts(); err != nil {
+			log.Printf("Warning: failed to load alerts, skipping alert rule evaluation: %v", err)
+			return
+		}
+		log.Printf("Replica %s is evaluating alert rules", re.replicaID)
+		re.evaluator = true
+	}
+
+	inputs, err := re.redis.GetAlertInputs(hold)
+	if err != nil {
+		log.Printf("Warning: skipping alert rule evaluation: %v", err)
+		return
+	}
+	alerts := re.evaluateInputs(now, inputs)
+	if err := re.redis.StoreAlerts(alerts); err != nil {
+		log.Printf("Warning: failed to store alerts: %v", err)
+	}
+}
+
+// snapshot returns the tenants and their rules (must not hold locks)
+func (re *ruleEngine) snapshot() map[string]*tenantRules {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	tenants := make(map[string]*tenantRules, len(re.tenants))
+	for id, tr := range re.tenants {
+		tenants[id] = tr
+	}
+	return tenants
+}
+
+// inputs returns what this replica has seen of the series of every rule
+func (re *ruleEngine) inputs(now time.Time) models.AlertInputs {
+	inputs := make(models.AlertInputs)
+	for tenantID, tr := range re.snapshot() {
+		tr.mu.Lock()
+		for id, rs := range tr.rules {
+			series := rs.inputs(now)
+			if len(series) == 0 {
+				continue
+			}
+			if inputs[tenantID] == nil {
+				inputs[tenantID] = make(map[string]models.AlertRuleInputs)
+			}
+			inputs[tenantID][id] = models.AlertRuleInputs{UpdatedAt: rs.rule.UpdatedAt, Series: series}
+		}
+		tr.mu.Unlock()
+	}
+	return inputs
+}
+
+// evaluateInputs evaluates the rules of every tenant at now on the inputs of
+// the replicas, reports the alert transitions and returns the alerts of every
+// tenant by rule ID. Inputs collected for another definition of a rule are
+// ignored.
+func (re *ruleEngine) evaluateInputs(now time.Time, replicas []models.AlertInputs) map[string]map[string][]models.Alert {
+	alerts := make(map[string]map[string][]models.Alert)
+	var current []models.Alert
+	for tenantID, tr := range re.snapshot() {
+		var transitions []alertTransition
+		alerts[tenantID] = make(map[string][]models.Alert)
+
+		tr.mu.Lock()
+		for id, rs := range tr.rules {
+			series := make(map[string][]models.AlertSeriesInput)
+			for _, replica := range replicas {
+				ruleInputs, ok := replica[tenantID][id]
+				if !ok || !ruleInputs.UpdatedAt.Equal(rs.rule.UpdatedAt) {
+					continue
+				}
+				for key, input := range ruleInputs.Series {
+					series[key] = append(series[key], input)
+				}
+			}
+			transitions = append(transitions, rs.evaluate(now, tenantID, series)...)
+
+			for _, alert := range rs.alerts {
+				alerts[tenantID][id] = append(alerts[tenantID][id], copyAlert(*alert))
+			}
+			current = append(current, alerts[tenantID][id]...)
+		}
+		tr.mu.Unlock()
+
+		re.report(transitions)
+	}
+	if re.onAlerts != nil {
+		re.onAlerts(current)
+	}
+	return alerts
+}
+
+// loadAlerts replaces the alerts of every rule with the stored ones, when
+// this replica takes over the evaluator role
+func (re *ruleEngine) loadAlerts() error {
+	for tenantID, tr := range re.snapshot() {
+		stored, err := re.redis.GetAlerts(tenantID)
+		if err != nil {
+			return err
+		}
+		tr.mu.Lock()
+		for id, rs := range tr.rules {
+			clear(rs.alerts)
+			for _, alert := range stored[id] {
+				alert := alert
+				rs.alerts[rs.alertKey(alert.Labels)] = &alert
+			}
+		}
+		tr.mu.Unlock()
+	}
+	return nil
+}
+
+// dropAlerts forgets the alerts of every rule, when this replica loses the
+// evaluator role; the replica taking over continues them
+func (re *ruleEngine) dropAlerts() {
+	for _, tr := range re.snapshot() {
+		tr.mu.Lock()
+		for _, rs := range tr.rules {
+			clear(rs.alerts)
+		}
+		tr.mu.Unlock()
+	}
+}
+
+// report passes alert transitions to the callback
+func (re *ruleEngine) report(transitions []alertTransition) {
+	for _, t := range transitions {
+		log.Printf("ALERT %s: tenant=%s rule=%s severity=%s labels=%v value=%.2f threshold=%.2f",
+			strings.ToUpper(t.alert.State), t.alert.TenantID, t.alert.Rule, t.alert.Severity, t.alert.Labels, t.alert.Value, t.alert.Threshold)
+		if re.onAlert != nil {
+			re.onAlert(t.alert, t.previous)
+		}
+	}
+}
+
+// rules returns the rules of a tenant sorted by name
+func (re *ruleEngine) rules(tenantID string) []models.AlertRule {
+	rules := []models.AlertRule{}
+	tr := re.lookupTenant(tenantID)
+	if tr == nil {
+		return rules
+	}
+
+	tr.mu.Lock()
+	for _, rs := range tr.rules {
+		rules = append(rules, rs.rule)
+	}
+	tr.mu.Unlock()
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// rule returns a rule of a tenant
+func (re *ruleEngine) rule(tenantID, id string) (models.AlertRule, error) {
+	tr := re.lookupTenant(tenantID)
+	if tr == nil {
+		return models.AlertRule{}, ErrRuleNotFound
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	rs, ok := tr.rules[id]
+	if !ok {
+		return models.AlertRule{}, ErrRuleNotFound
+	}
+	return rs.rule, nil
+}
+
+// put creates a rule of a tenant, or replaces the rule with the given ID.
+// A replaced rule starts over: its alerts end and its series are relearned.
+func (re *ruleEngine) put(tenantID, id string, rule models.AlertRule) (models.AlertRule, error) {
+	tr := re.tenant(tenantID)
+	now := time.Now()
+
+	tr.mu.Lock()
+	previous, exists := tr.rules[id]
+	if id != "" && !exists {
+		tr.mu.Unlock()
+		return models.AlertRule{}, ErrRuleNotFound
+	}
+	if !exists && len(tr.rules) >= MaxRulesPerTenant {
+		tr.mu.Unlock()
+		return models.AlertRule{}, ErrTooManyRules
+	}
+	for otherID, rs := range tr.rules {
+		if otherID != id && rs.rule.Name == rule.Name {
+			tr.mu.Unlock()
+			return models.AlertRule{}, ErrRuleNameTaken
+		}
+	}
+
+	rule.CreatedAt, rule.UpdatedAt = now, now
+	if exists {
+		rule.ID, rule.CreatedAt = id, previous.rule.CreatedAt
+	} else {
+		rule.ID = randomID()
+	}
+	state, err := compileRule(rule)
+	if err != nil {
+		tr.mu.Unlock()
+		return models.AlertRule{}, err
+	}
+	if re.redis != nil {
+		if err := re.redis.StoreAlertRule(tenantID, state.rule); err != nil {
+			tr.mu.Unlock()
+			return models.AlertRule{}, err
+		}
+	}
+
+	var transitions []alertTransition
+	if exists {
+		transitions = previous.clear(now)
+	}
+	tr.rules[rule.ID] = state
+	tr.version++
+	tr.mu.Unlock()
+
+	re.report(transitions)
+	return state.rule, nil
+}
+
+// delete deletes a rule of a tenant, ending its alerts
+func (re *ruleEngine) delete(tenantID, id string) error {
+	tr := re.lookupTenant(tenantID)
+	if tr == nil {
+		return ErrRuleNotFound
+	}
+
+	tr.mu.Lock()
+	rs, ok := tr.rules[id]
+	if !ok {
+		tr.mu.Unlock()
+		return ErrRuleNotFound
+	}
+	if re.redis != nil {
+		if err := re.redis.DeleteAlertRule(tenantID, id); err != nil {
+			tr.mu.Unlock()
+			return err
+		}
+	}
+	delete(tr.rules, id)
+	tr.version++
+	transitions := rs.clear(time.Now())
+	tr.mu.Unlock()
+
+	re.report(transitions)
+	return nil
+}
+
+// alerts returns the alerts of a tenant matching the filter, sorted by rule
+// name and labels. With Redis these are the alerts stored by the evaluating
+// replica, whichever replica serves the request.
+func (re *ruleEngine) alerts(tenantID string, filter models.AlertFilter) ([]models.Alert, error) {
+	alerts := []models.Alert{}
+	if re.redis != nil {
+		stored, err := re.redis.GetAlerts(tenantID)
+		if err != nil {
+			return nil, err
+		}
+		for _, ruleAlerts := range stored {
+			for _, alert := range ruleAlerts {
+				if filter.Matches(alert) {
+					alerts = append(alerts, alert)
+				}
+			}
+		}
+	} else if tr := re.lookupTenant(tenantID); tr != nil {
+		tr.mu.Lock()
+		for _, rs := range tr.rules {
+			for _, alert := range rs.alerts {
+				if filter.Matches(*alert) {
+					alerts = append(alerts, copyAlert(*alert))
+				}
+			}
+		}
+		tr.mu.Unlock()
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return fmt.Sprint(alerts[i].Labels) < fmt.Sprint(alerts[j].Labels)
+	})
+	return alerts, nil
+}
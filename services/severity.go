@@ -0,0 +1,91 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"high-load-service/models"
+)
+
+// DefaultSeverityRatios are the severity thresholds of metrics without
+// configured ones, as multiples of their detector's anomaly threshold
+var DefaultSeverityRatios = SeverityThresholds{Warning: 1, Critical: 1.5, Emergency: 2}
+
+// SeverityThresholds are the absolute detector scores at which an anomaly
+// becomes a warning, critical or emergency
+type SeverityThresholds struct {
+	Warning   float64
+	Critical  float64
+	Emergency float64
+}
+
+// severityThresholds returns the severity thresholds of a metric: configured
+// ones, or DefaultSeverityRatios of the detector threshold if it is known
+func (c Config) severityThresholds(metricName string, detectorThreshold float64) SeverityThresholds {
+	if st, ok := c.Severities[metricName]; ok {
+		return st
+	}
+	return SeverityThresholds{
+		Warning:   DefaultSeverityRatios.Warning * detectorThreshold,
+		Critical:  DefaultSeverityRatios.Critical * detectorThreshold,
+		Emergency: DefaultSeverityRatios.Emergency * detectorThreshold,
+	}
+}
+
+// classify returns the severity of an anomaly score, or "" if it is under the
+// warning threshold. Zero thresholds are ignored, so with no thresholds at
+// all every anomaly is a warning.
+func (st SeverityThresholds) classify(score float64) string {
+	score = math.Abs(score)
+	switch {
+	case st.Emergency > 0 && score >= st.Emergency:
+		return models.SeverityEmergency
+	case st.Critical > 0 && score >= st.Critical:
+		return models.SeverityCritical
+	case score >= st.Warning:
+		return models.SeverityWarning
+	}
+	return ""
+}
+
+// severityRank orders severities from "" (none) to emergency
+func severityRank(severity string) int {
+	switch severity {
+	case models.SeverityWarning:
+		return 1
+	case models.SeverityCritical:
+		return 2
+	case models.SeverityEmergency:
+		return 3
+	}
+	return 0
+}
+
+// parseSeverities parses per-metric severity thresholds, e.g.
+// "cpu=2:3:4,temperature=3.5:5:7" (warning:critical:emergency)
+func parseSeverities(s string) (map[string]SeverityThresholds, error) {
+	pairs, err := parsePairs(s)
+	if err != nil {
+		return nil, err
+	}
+
+	severities := make(map[string]SeverityThresholds, len(pairs))
+	for metric, v := range pairs {
+		parts := strings.Split(v, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("expected warning:critical:emergency for metric %s, got %q", metric, v)
+		}
+		var levels [3]float64
+		for i, part := range parts {
+			level, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || level <= 0 || (i > 0 && level < levels[i-1]) {
+				return nil, fmt.Errorf("invalid thresholds %q for metric %s (must be positive and increasing)", v, metric)
+			}
+			levels[i] = level
+		}
+		severities[metric] = SeverityThresholds{Warning: levels[0], Critical: levels[1], Emergency: levels[2]}
+	}
+	return severities, nil
+}
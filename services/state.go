@@ -0,0 +1,942 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"high-load-service/analytics"
+	"high-load-service/models"
+)
+
+// metricState holds the analytics state of a single named metric. Only the
+// rolling window, the configured detector and the CUSUM level shift detector
+// are maintained from the first sample; the forecaster, the percentile sketch
+// and the horizons are created when first read and seeded from the rolling
+// window, so metrics nobody queries cost no more than their detector.
+type metricState struct {
+	cfg *Config
+
+	// Rolling window behind the average, z-score and warm-up of the metric,
+	// and the live trend of capacity planning
+	rolling *analytics.RollingAverage
+
+	// CUSUM change-point detector for sustained level shifts; it is the
+	// configured detector itself for metrics using "cusum"
+	cusum *analytics.CUSUMDetector
+
+	// Configured anomaly detector, created through the detector registry
+	detector     analytics.Detector
+	detectorName string
+
+	// Analytics created on first read; the mutex also orders
+	// their seeding from the rolling window with the values added to both
+	forecaster *analytics.HoltWinters
+	quantiles  *analytics.QuantileSketch
+	horizons   []*analytics.HorizonStats
+	lazyMu     sync.Mutex
+
+	// Set under lazyMu once the metric is evicted from its stream, after
+	// which no more values are added to it
+	evicted bool
+
+	// Anomaly episodes of the configured detector
+	episode *episode
+
+	// Samples the rolling window must hold before anomalies are reported
+	warmup int
+
+	// Latest value, when it was received and anomaly counters
+	latest          float64
+	updated         time.Time
+	anomalyCount    int64
+	severityCounts  map[string]int64
+	levelShiftCount int64
+}
+
+// newMetricState creates analytics state for a named metric
+func newMetricState(cfg *Config, name string) *metricState {
+	size, span := cfg.window()
+	state := &metricState{
+		cfg:          cfg,
+		rolling:      analytics.NewTimedRollingAverage(span, size),
+		detectorName: cfg.DetectorFor(name),
+		warmup:       cfg.warmupSamples(size),
+	}
+	// The CUSUM baseline is learned over the first WindowSize samples
+	cusumCfg := cfg.detectorConfig("cusum")
+	state.cusum = analytics.NewCUSUMDetector(cfg.WindowSize, cfg.CUSUMDrift, cusumCfg.Threshold)
+
+	if state.detectorName == "cusum" {
+		state.detector = state.cusum
+	} else {
+		detector, err := analytics.NewDetector(state.detectorName, cfg.detectorConfig(state.detectorName))
+		if err != nil {
+			log.Printf("Warning: %v, falling back to zscore for metric %s", err, name)
+			state.detectorName = "zscore"
+			detector, _ = analytics.NewDetector(state.detectorName, cfg.detectorConfig(state.detectorName))
+		}
+		state.detector = detector
+	}
+
+	state.episode = newEpisode(cfg, name, state.detector)
+	return state
+}
+
+// forecast returns the Holt-Winters forecaster of the metric, creating it
+// from the rolling window on first use
+func (m *metricState) forecast() *analytics.HoltWinters {
+	m.lazyMu.Lock()
+	defer m.lazyMu.Unlock()
+	if m.forecaster == nil {
+		m.forecaster = analytics.NewHoltWinters(m.cfg.HoltWinters)
+		m.rolling.Replay(func(t time.Time, value float64) { m.forecaster.AddAt(t, value) })
+	}
+	return m.forecaster
+}
+
+// sketch returns the percentile sketch of the metric over the window,
+// creating it from the rolling window on first use
+func (m *metricState) sketch() *analytics.QuantileSketch {
+	m.lazyMu.Lock()
+	defer m.lazyMu.Unlock()
+	if m.quantiles == nil {
+		size, span := m.cfg.window()
+		m.quantiles = analytics.NewTimedQuantileSketch(span, size)
+		m.rolling.Replay(func(t time.Time, value float64) { m.quantiles.AddAt(t, value) })
+	}
+	return m.quantiles
+}
+
+// horizonStats returns the statistics of the metric over each configured
+// horizon in config order, creating them from the rolling window on first
+// use; horizons longer than the window start out covering only the window
+func (m *metricState) horizonStats() []*analytics.HorizonStats {
+	m.lazyMu.Lock()
+	defer m.lazyMu.Unlock()
+	if m.horizons == nil {
+		threshold := m.cfg.detectorConfig("zscore").Threshold
+		m.horizons = make([]*analytics.HorizonStats, len(m.cfg.Horizons))
+		for i, h := range m.cfg.Horizons {
+			m.horizons[i] = analytics.NewHorizonStats(h.Span, threshold)
+		}
+		m.rolling.Replay(func(t time.Time, value float64) {
+			for _, h := range m.horizons {
+				h.AddAt(t, value)
+			}
+		})
+	}
+	return m.horizons
+}
+
+// observation is the outcome of adding a value to a metric's analytics
+type observation struct {
+	// Verdict and score of the configured detector
+	anomaly bool
+	score   float64
+
+	// Severity of the anomaly to report if an episode opened or escalated
+	// with this value, otherwise ""
+	severity string
+
+	// Z-score of the value, always computed
+	zscore float64
+
+	// Level shift detected by CUSUM, if any
+	shift   analytics.LevelShift
+	shifted bool
+
+	// The baseline was still learning, so nothing is reported
+	learning bool
+}
+
+// observe adds a value observed at t to the metric's analytics and returns
+// the verdict of the configured detector, the z-score and any level shift.
+// While the rolling window holds fewer than the warm-up samples the baseline
+// is learning and no anomaly or level shift is reported. It adds nothing and
+// returns false if the metric was evicted.
+func (m *metricState) observe(t time.Time, value float64) (observation, bool) {
+	var obs observation
+	obs.learning = m.rolling.Count() < m.warmup
+	obs.zscore = m.rolling.ZScore(value)
+
+	m.lazyMu.Lock()
+	if m.evicted {
+		m.lazyMu.Unlock()
+		return obs, false
+	}
+	m.rolling.AddAt(t, value)
+	if m.forecaster != nil {
+		m.forecaster.AddAt(t, value)
+	}
+	if m.quantiles != nil {
+		m.quantiles.AddAt(t, value)
+	}
+	for _, h := range m.horizons {
+		h.AddAt(t, value)
+	}
+	m.lazyMu.Unlock()
+	obs.shift, obs.shifted = m.cusum.Observe(t, value)
+
+	if m.detector == analytics.Detector(m.cusum) {
+		// Level shifts are reported as their own event type
+		obs.score = obs.shift.Statistic
+	} else {
+		obs.anomaly, obs.score = addToDetector(m.detector, t, value)
+	}
+	if obs.learning {
+		obs.anomaly, obs.shifted = false, false
+	}
+	obs.severity = m.episode.update(t, obs.anomaly, obs.score)
+	return obs, true
+}
+
+// warmupState returns the state of the metric's baseline and the progress of its warm-up
+func (m *metricState) warmupState() (state string, fill float64) {
+	return warmupState(m.rolling.Count(), m.warmup)
+}
+
+// warmupState returns the state of a baseline holding samples values out of
+// the required number, and the progress of its warm-up
+func warmupState(samples, required int) (state string, fill float64) {
+	if samples >= required {
+		return models.MetricStateReady, 1
+	}
+	return models.MetricStateLearning, float64(samples) / float64(required)
+}
+
+// percentiles returns the percentile estimates of the metric over the window
+func (m *metricState) percentiles() models.Percentiles {
+	q := m.sketch()
+	return models.Percentiles{
+		P50: q.Quantile(0.5),
+		P95: q.Quantile(0.95),
+		P99: q.Quantile(0.99),
+	}
+}
+
+// histogramPercentiles returns the percentile estimates of a histogram
+func histogramPercentiles(h *analytics.QuantileHistogram) models.Percentiles {
+	return models.Percentiles{
+		P50: h.Quantile(0.5),
+		P95: h.Quantile(0.95),
+		P99: h.Quantile(0.99),
+	}
+}
+
+// addToDetector adds a value to a detector, passing the timestamp to
+// detectors that weight samples by time
+func addToDetector(detector analytics.Detector, t time.Time, value float64) (bool, float64) {
+	if timed, ok := detector.(analytics.TimedDetector); ok {
+		return timed.AddAt(t, value)
+	}
+	return detector.Add(value)
+}
+
+// evaluate scores a value against the metric's baselines without adding it
+func (m *metricState) evaluate(value float64) (isAnomaly bool, score, zscore float64) {
+	isAnomaly, score = m.detector.IsAnomaly(value)
+	return isAnomaly, score, m.rolling.ZScore(value)
+}
+
+// horizonAnalytics returns the analytics of a value over each horizon
+func (m *metricState) horizonAnalytics(value float64) map[string]models.HorizonAnalytics {
+	if len(m.cfg.Horizons) == 0 {
+		return nil
+	}
+	horizons := m.horizonStats()
+	result := make(map[string]models.HorizonAnalytics, len(horizons))
+	for i, h := range horizons {
+		anomaly, zscore := h.IsAnomaly(value)
+		mean, _ := h.Stats()
+		result[m.cfg.Horizons[i].Name] = models.HorizonAnalytics{
+			Avg:     mean,
+			ZScore:  zscore,
+			Anomaly: anomaly,
+			Samples: h.Count(),
+			Covered: h.Covered().Seconds(),
+		}
+	}
+	return result
+}
+
+// jointState holds the joint analytics of CPU and RPS: CPU is regressed on
+// RPS so that CPU which is high for the current request rate stands out
+type jointState struct {
+	regression *analytics.RollingRegression
+	episode    *episode
+	warmup     int
+
+	// Latest pair and anomaly counters
+	latestRPS      float64
+	latestCPU      float64
+	anomalyCount   int64
+	severityCounts map[string]int64
+}
+
+// streamState holds the analytics state of a single metric stream
+// (one device, or the whole fleet)
+type streamState struct {
+	cfg *Config
+
+	// Per-metric analytics, created lazily on first value, at most limit
+	metrics map[string]*metricState
+	limit   int
+
+	// Joint CPU/RPS analytics, created lazily on the first pair
+	joint *jointState
+
+	// Recent values of each configured correlation pair, created lazily on
+	// the first sample reporting both metrics
+	pairs map[[2]string]*pairWindow
+
+	// Latest labels reported by the device
+	labels map[string]string
+
+	// Latest timestamp, when it was received and total counter
+	lastSeen     time.Time
+	updated      time.Time
+	totalMetrics int64
+	mu           sync.RWMutex
+
+	// Set once the stream is evicted, after which nothing is recorded in it
+	evicted bool
+}
+
+// newStreamState creates analytics state for a metric stream tracking at
+// most limit distinct metrics
+func newStreamState(cfg *Config, limit int) *streamState {
+	return &streamState{
+		cfg:     cfg,
+		metrics: make(map[string]*metricState),
+		limit:   limit,
+	}
+}
+
+// admit reports whether the stream can track all named values without
+// exceeding its limit of distinct metrics
+func (s *streamState) admit(values map[string]float64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	added := 0
+	for name := range values {
+		if _, ok := s.metrics[name]; !ok {
+			added++
+		}
+	}
+	return len(s.metrics)+added <= s.limit
+}
+
+// record updates the latest values and total counter. Values of metrics
+// beyond the stream's limit are not tracked. It records nothing and returns
+// false if the stream was evicted.
+func (s *streamState) record(metric models.Metric) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.evicted {
+		return false
+	}
+	now := time.Now()
+	s.lastSeen = metric.Timestamp
+	s.updated = now
+	s.totalMetrics++
+	if metric.Labels != nil {
+		s.labels = metric.Labels
+	}
+	for name, value := range metric.Values {
+		if state := s.metricLocked(name); state != nil {
+			state.latest, state.updated = value, now
+		}
+	}
+
+	for _, pair := range s.cfg.CorrelationPairs {
+		va, okA := metric.Values[pair[0]]
+		vb, okB := metric.Values[pair[1]]
+		if !okA || !okB {
+			continue
+		}
+		if s.pairs == nil {
+			s.pairs = make(map[[2]string]*pairWindow, len(s.cfg.CorrelationPairs))
+		}
+		window, ok := s.pairs[pair]
+		if !ok {
+			size, _ := s.cfg.window()
+			window = &pairWindow{size: size}
+			s.pairs[pair] = window
+		}
+		window.push(metric.Timestamp, va, vb)
+	}
+	return true
+}
+
+// pairSample is a sample reporting both metrics of a correlation pair
+type pairSample struct {
+	t    time.Time
+	a, b float64
+}
+
+// pairWindow holds the recent samples of a correlation pair in arrival
+// order; a ring once it holds size samples
+type pairWindow struct {
+	samples []pairSample
+	head    int
+	size    int
+}
+
+// push adds a sample, replacing the oldest one if the window is full
+func (w *pairWindow) push(t time.Time, a, b float64) {
+	if len(w.samples) < w.size {
+		w.samples = append(w.samples, pairSample{t, a, b})
+		return
+	}
+	w.samples[w.head] = pairSample{t, a, b}
+	w.head = (w.head + 1) % w.size
+}
+
+// correlation returns the correlation of metrics a and b over the recent
+// samples; the pair must be one of the configured correlation pairs
+func (s *streamState) correlation(a, b string) models.Correlation {
+	as, bs := s.pairValues(a, b)
+	result := models.Correlation{Samples: len(as)}
+	if r, ok := analytics.Pearson(as, bs); ok {
+		result.Pearson = &r
+	}
+	if rho, ok := analytics.Spearman(as, bs); ok {
+		result.Spearman = &rho
+	}
+	return result
+}
+
+// pairValues returns the values of metrics a and b from the recent samples
+// that report both, oldest first. Time-based windows only include samples
+// within the window span of the latest one.
+func (s *streamState) pairValues(a, b string) (as, bs []float64) {
+	pair, swapped, ok := s.cfg.correlationPair(a, b)
+	if !ok {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	window, ok := s.pairs[pair]
+	if !ok {
+		return nil, nil
+	}
+	var cutoff time.Time
+	if s.cfg.WindowDuration > 0 {
+		cutoff = s.lastSeen.Add(-s.cfg.WindowDuration)
+	}
+	for i := range window.samples {
+		sample := window.samples[(window.head+i)%len(window.samples)]
+		if sample.t.After(cutoff) {
+			as = append(as, sample.a)
+			bs = append(bs, sample.b)
+		}
+	}
+	if swapped {
+		as, bs = bs, as
+	}
+	return as, bs
+}
+
+// metric returns the state of a named metric, creating it if needed,
+// or nil if the stream already tracks its limit of metrics or was evicted
+func (s *streamState) metric(name string) *metricState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metricLocked(name)
+}
+
+// metricLocked returns the state of a named metric, creating it if needed,
+// or nil if the stream already tracks its limit of metrics or was evicted
+// (must hold write lock)
+func (s *streamState) metricLocked(name string) *metricState {
+	if s.evicted {
+		return nil
+	}
+	state, ok := s.metrics[name]
+	if !ok {
+		if len(s.metrics) >= s.limit {
+			return nil
+		}
+		state = newMetricState(s.cfg, name)
+		s.metrics[name] = state
+	}
+	return state
+}
+
+// observe adds a value observed at t to the analytics of a named metric,
+// creating its state if needed, and returns the state and the observation;
+// the state is nil if the stream already tracks its limit of metrics or was
+// evicted. A metric evicted after it was looked up is created again.
+func (s *streamState) observe(name string, t time.Time, value float64) (*metricState, observation) {
+	for {
+		state := s.metric(name)
+		if state == nil {
+			return nil, observation{}
+		}
+		if obs, ok := state.observe(t, value); ok {
+			return state, obs
+		}
+	}
+}
+
+// evictIdle removes the metrics that received no value since cutoff and
+// reports whether the stream is idle itself
+func (s *streamState) evictIdle(cutoff time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, state := range s.metrics {
+		if state.updated.Before(cutoff) {
+			state.lazyMu.Lock()
+			state.evicted = true
+			state.lazyMu.Unlock()
+			delete(s.metrics, name)
+		}
+	}
+	return s.updated.Before(cutoff)
+}
+
+// evict marks the stream evicted if it received no value since cutoff and
+// reports whether it did; checking and marking under one lock keeps a
+// value recorded in the meantime from being lost with the stream
+func (s *streamState) evict(cutoff time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.updated.Before(cutoff) {
+		return false
+	}
+	s.evicted = true
+	return true
+}
+
+// metricStates returns the states of the metrics of the stream whose names
+// are accepted by keep
+func (s *streamState) metricStates(keep func(string) bool) map[string]*metricState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make(map[string]*metricState, len(s.metrics))
+	for name, state := range s.metrics {
+		if keep(name) {
+			states[name] = state
+		}
+	}
+	return states
+}
+
+// lookupMetric returns the state of a named metric if it exists
+func (s *streamState) lookupMetric(name string) (*metricState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, ok := s.metrics[name]
+	return state, ok
+}
+
+// observeJoint adds a CPU/RPS pair observed at t to the joint analytics and
+// returns the severity to report if an anomaly episode opened or escalated
+// because the CPU is anomalous for the RPS (otherwise "", always while the
+// regression is learning), the standardized residual, and the CPU expected
+// for the RPS with its prediction standard error
+func (s *streamState) observeJoint(t time.Time, cpu, rps float64) (severity string, score, expected, stderr float64) {
+	s.mu.Lock()
+	if s.joint == nil {
+		regressionCfg := s.cfg.detectorConfig(RegressionDetector)
+		size, span := s.cfg.window()
+		regression := analytics.NewTimedRollingRegression(span, size, regressionCfg.Threshold)
+		s.joint = &jointState{
+			regression: regression,
+			episode:    newEpisode(s.cfg, CPUPerRPSMetric, regression),
+			warmup:     s.cfg.warmupSamples(size),
+		}
+	}
+	joint := s.joint
+	joint.latestCPU, joint.latestRPS = cpu, rps
+	s.mu.Unlock()
+
+	learning := joint.regression.Count() < joint.warmup
+	_, stderr = joint.regression.Predict(rps)
+	isAnomaly, score, expected := joint.regression.AddAt(t, rps, cpu)
+	severity = joint.episode.update(t, isAnomaly && !learning, score)
+	return severity, score, expected, stderr
+}
+
+// incrementAnomaly increments the counters of an anomaly event type and
+// severity for a metric
+func (s *streamState) incrementAnomaly(name, eventType, severity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == CPUPerRPSMetric && s.joint != nil {
+		s.joint.anomalyCount++
+		s.joint.severityCounts = incrementCount(s.joint.severityCounts, severity)
+		return
+	}
+	state := s.metricLocked(name)
+	if state == nil {
+		return
+	}
+	if eventType == models.EventTypeLevelShift {
+		state.levelShiftCount++
+		return
+	}
+	state.anomalyCount++
+	state.severityCounts = incrementCount(state.severityCounts, severity)
+}
+
+// incrementCount increments a counter of a lazily created map
+func incrementCount(counts map[string]int64, key string) map[string]int64 {
+	if counts == nil {
+		counts = make(map[string]int64)
+	}
+	counts[key]++
+	return counts
+}
+
+// addCounts adds counters to a lazily created map
+func addCounts(counts, add map[string]int64) map[string]int64 {
+	for k, v := range add {
+		if counts == nil {
+			counts = make(map[string]int64, len(add))
+		}
+		counts[k] += v
+	}
+	return counts
+}
+
+// copyCounts returns a copy of a counter map, or nil if it is empty
+func copyCounts(counts map[string]int64) map[string]int64 {
+	return addCounts(nil, counts)
+}
+
+// snapshot returns analytics for every known metric of the stream
+func (s *streamState) snapshot() map[string]models.MetricAnalytics {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]models.MetricAnalytics, len(s.metrics))
+	for name, state := range s.metrics {
+		anomaly, score, zscore := state.evaluate(state.latest)
+		var madScore, ewma float64
+		switch detector := state.detector.(type) {
+		case *analytics.MADDetector:
+			madScore = score
+		case *analytics.EWMA:
+			ewma = detector.Value()
+		}
+		warmup, fill := state.warmupState()
+		result[name] = models.MetricAnalytics{
+			Current:     state.latest,
+			Avg:         state.rolling.GetAverage(),
+			Percentiles: state.percentiles(),
+			Predicted:   state.forecast().Forecast(1),
+			EWMA:        ewma,
+			Detector:    state.detectorName,
+			State:       warmup,
+			FillRatio:   fill,
+			Score:       score,
+			ZScore:      zscore,
+			MADScore:    madScore,
+			Anomaly:     anomaly && warmup == models.MetricStateReady,
+			EpisodeOpen: state.episode.open(),
+			Anomalies:   state.anomalyCount,
+			Severities:  copyCounts(state.severityCounts),
+			LevelShifts: state.levelShiftCount,
+			Horizons:    state.horizonAnalytics(state.latest),
+		}
+	}
+
+	if s.joint != nil {
+		anomaly, score, expected := s.joint.regression.IsAnomaly(s.joint.latestRPS, s.joint.latestCPU)
+		warmup, fill := warmupState(s.joint.regression.Count(), s.joint.warmup)
+		result[CPUPerRPSMetric] = models.MetricAnalytics{
+			Current:     s.joint.latestCPU,
+			Predicted:   expected,
+			Detector:    RegressionDetector,
+			State:       warmup,
+			FillRatio:   fill,
+			Score:       score,
+			Anomaly:     anomaly && warmup == models.MetricStateReady,
+			EpisodeOpen: s.joint.episode.open(),
+			Anomalies:   s.joint.anomalyCount,
+			Severities:  copyCounts(s.joint.severityCounts),
+		}
+	}
+	return result
+}
+
+// labelSet returns the latest labels of the stream
+func (s *streamState) labelSet() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.labels
+}
+
+// anomalyCounts returns anomaly counters keyed by metric name
+func (s *streamState) anomalyCounts() map[string]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int64, len(s.metrics)+1)
+	for name, state := range s.metrics {
+		counts[name] = state.anomalyCount
+	}
+	if s.joint != nil {
+		counts[CPUPerRPSMetric] = s.joint.anomalyCount
+	}
+	return counts
+}
+
+// tenantState holds the isolated analytics state of a single tenant
+type tenantState struct {
+	cfg *Config
+
+	// Fleet-wide analytics over all devices of the tenant
+	fleet *streamState
+
+	// Per-device analytics, keyed by device ID
+	devices   map[string]*streamState
+	devicesMu sync.RWMutex
+
+	// Set under devicesMu once the tenant is evicted, after which no devices
+	// are added to it
+	evicted bool
+}
+
+// newTenantState creates analytics state for a tenant
+func newTenantState(cfg *Config) *tenantState {
+	return &tenantState{
+		cfg:     cfg,
+		fleet:   newStreamState(cfg, cfg.MaxMetricsPerTenant),
+		devices: make(map[string]*streamState),
+	}
+}
+
+// deviceState returns the analytics state of a device, creating it if
+// needed, or nil if the tenant was evicted
+func (t *tenantState) deviceState(deviceID string) *streamState {
+	t.devicesMu.RLock()
+	state, ok := t.devices[deviceID]
+	t.devicesMu.RUnlock()
+	if ok {
+		return state
+	}
+
+	t.devicesMu.Lock()
+	defer t.devicesMu.Unlock()
+	if t.evicted {
+		return nil
+	}
+	if state, ok = t.devices[deviceID]; !ok {
+		state = newStreamState(t.cfg, t.cfg.MaxMetricsPerDevice)
+		t.devices[deviceID] = state
+	}
+	return state
+}
+
+// evictIdle removes the metrics and devices that received no value since
+// cutoff and reports whether the tenant is idle itself
+func (t *tenantState) evictIdle(cutoff time.Time) bool {
+	t.devicesMu.Lock()
+	defer t.devicesMu.Unlock()
+
+	for id, state := range t.devices {
+		if state.evictIdle(cutoff) && state.evict(cutoff) {
+			delete(t.devices, id)
+		}
+	}
+	return t.fleet.evictIdle(cutoff) && len(t.devices) == 0
+}
+
+// evict marks the tenant evicted if it has no devices and received no value
+// since cutoff, and reports whether it did
+func (t *tenantState) evict(cutoff time.Time) bool {
+	t.devicesMu.Lock()
+	defer t.devicesMu.Unlock()
+	if len(t.devices) > 0 || !t.fleet.evict(cutoff) {
+		return false
+	}
+	t.evicted = true
+	return true
+}
+
+// lookupState returns the state for a device, or the fleet state if deviceID is empty
+func (t *tenantState) lookupState(deviceID string) (*streamState, error) {
+	if deviceID == "" {
+		return t.fleet, nil
+	}
+
+	t.devicesMu.RLock()
+	defer t.devicesMu.RUnlock()
+	state, ok := t.devices[deviceID]
+	if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	return state, nil
+}
+
+// deviceStates returns the states of all devices of the tenant
+func (t *tenantState) deviceStates() []*streamState {
+	t.devicesMu.RLock()
+	defer t.devicesMu.RUnlock()
+
+	states := make([]*streamState, 0, len(t.devices))
+	for _, state := range t.devices {
+		states = append(states, state)
+	}
+	return states
+}
+
+// deviceMap returns a copy of the tenant's device states keyed by device ID
+func (t *tenantState) deviceMap() map[string]*streamState {
+	t.devicesMu.RLock()
+	defer t.devicesMu.RUnlock()
+
+	states := make(map[string]*streamState, len(t.devices))
+	for id, state := range t.devices {
+		states[id] = state
+	}
+	return states
+}
+
+// deviceCount returns the number of devices of the tenant
+func (t *tenantState) deviceCount() int {
+	t.devicesMu.RLock()
+	defer t.devicesMu.RUnlock()
+	return len(t.devices)
+}
+
+// deviceGroup accumulates analytics of devices sharing group label values
+type deviceGroup struct {
+	cfg     *Config
+	labels  map[string]string
+	devices int
+	total   int64
+	sums    map[string]*models.MetricAnalytics
+	counts  map[string]int
+
+	// Merged values of the devices, for group percentiles
+	quantiles map[string]*analytics.QuantileHistogram
+}
+
+// add accumulates the analytics of a device into the group; a metric is
+// learning in the group while it is learning on any of its devices
+func (g *deviceGroup) add(state *streamState) {
+	if g.sums == nil {
+		g.sums = make(map[string]*models.MetricAnalytics)
+		g.counts = make(map[string]int)
+		g.quantiles = make(map[string]*analytics.QuantileHistogram)
+	}
+
+	state.mu.RLock()
+	g.total += state.totalMetrics
+	for name, metric := range state.metrics {
+		h, ok := g.quantiles[name]
+		if !ok {
+			h = &analytics.QuantileHistogram{}
+			g.quantiles[name] = h
+		}
+		metric.sketch().MergeInto(h)
+	}
+	state.mu.RUnlock()
+	g.devices++
+
+	for name, m := range state.snapshot() {
+		sum, ok := g.sums[name]
+		if !ok {
+			sum = &models.MetricAnalytics{}
+			g.sums[name] = sum
+		}
+		sum.Current += m.Current
+		sum.Avg += m.Avg
+		sum.Predicted += m.Predicted
+		sum.EWMA += m.EWMA
+		sum.Detector = m.Detector
+		if sum.State != models.MetricStateLearning {
+			sum.State = m.State
+		}
+		sum.FillRatio += m.FillRatio
+		sum.Score += m.Score
+		sum.ZScore += m.ZScore
+		sum.MADScore += m.MADScore
+		sum.Anomaly = sum.Anomaly || m.Anomaly
+		sum.EpisodeOpen = sum.EpisodeOpen || m.EpisodeOpen
+		sum.Anomalies += m.Anomalies
+		sum.Severities = addCounts(sum.Severities, m.Severities)
+		sum.LevelShifts += m.LevelShifts
+		for h, ha := range m.Horizons {
+			if sum.Horizons == nil {
+				sum.Horizons = make(map[string]models.HorizonAnalytics, len(m.Horizons))
+			}
+			hs := sum.Horizons[h]
+			hs.Avg += ha.Avg
+			hs.ZScore += ha.ZScore
+			hs.Anomaly = hs.Anomaly || ha.Anomaly
+			hs.Samples += ha.Samples
+			hs.Covered = max(hs.Covered, ha.Covered)
+			sum.Horizons[h] = hs
+		}
+		g.counts[name]++
+	}
+}
+
+// result returns the aggregated analytics of the group
+func (g *deviceGroup) result() models.AnalyticsResult {
+	metrics := make(map[string]models.MetricAnalytics, len(g.sums))
+	for name, sum := range g.sums {
+		n := float64(g.counts[name])
+		var percentiles models.Percentiles
+		if h, ok := g.quantiles[name]; ok {
+			percentiles = histogramPercentiles(h)
+		}
+		metrics[name] = models.MetricAnalytics{
+			Current:     sum.Current / n,
+			Avg:         sum.Avg / n,
+			Percentiles: percentiles,
+			Predicted:   sum.Predicted / n,
+			EWMA:        sum.EWMA / n,
+			Detector:    sum.Detector,
+			State:       sum.State,
+			FillRatio:   sum.FillRatio / n,
+			Score:       sum.Score / n,
+			ZScore:      sum.ZScore / n,
+			MADScore:    sum.MADScore / n,
+			Anomaly:     sum.Anomaly,
+			EpisodeOpen: sum.EpisodeOpen,
+			Anomalies:   sum.Anomalies,
+			Severities:  sum.Severities,
+			LevelShifts: sum.LevelShifts,
+			Horizons:    averageHorizons(sum.Horizons, n),
+		}
+	}
+	return models.AnalyticsResult{
+		Labels:       g.labels,
+		Devices:      g.devices,
+		Metrics:      metrics,
+		TotalMetrics: int(g.total),
+		WindowSize:   g.cfg.WindowSize,
+		WindowSpan:   g.cfg.windowSpan(),
+		LastUpdated:  time.Now(),
+	}
+}
+
+// averageHorizons averages summed horizon analytics over n devices;
+// anomaly flags, sample counts and the longest covered span are kept as accumulated
+func averageHorizons(sums map[string]models.HorizonAnalytics, n float64) map[string]models.HorizonAnalytics {
+	if sums == nil {
+		return nil
+	}
+	result := make(map[string]models.HorizonAnalytics, len(sums))
+	for name, sum := range sums {
+		result[name] = models.HorizonAnalytics{
+			Avg:     sum.Avg / n,
+			ZScore:  sum.ZScore / n,
+			Anomaly: sum.Anomaly,
+			Samples: sum.Samples,
+			Covered: sum.Covered,
+		}
+	}
+	return result
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"sync"
+)
+
+// Number of events buffered per subscriber; subscribers that fall further
+// behind are disconnected. Live metric updates arrive at the ingest rate, so
+// live subscribers get more room for bursts.
+const (
+	SubscriberBuffer     = 256
+	LiveSubscriberBuffer = 4096
+)
+
+// Subscription delivers the events of a hub that match its filter as they
+// are published
+type Subscription[T any] struct {
+	match  func(T) bool
+	events chan T
+
+	hub     *hub[T]
+	dropped bool // closed because the subscriber fell behind
+	once    sync.Once
+}
+
+// Events returns the channel of events. It is closed when the subscription
+// is closed, by Close, by the service stopping, or because the subscriber
+// did not keep up (see Dropped).
+func (s *Subscription[T]) Events() <-chan T {
+	return s.events
+}
+
+// Dropped reports whether the subscription was closed because its buffer was full
+func (s *Subscription[T]) Dropped() bool {
+	s.hub.mu.RLock()
+	defer s.hub.mu.RUnlock()
+	return s.dropped
+}
+
+// Close stops the delivery of events
+func (s *Subscription[T]) Close() {
+	s.hub.remove(s, false)
+}
+
+// hub fans events out to subscribers
+type hub[T any] struct {
+	buffer      int
+	subscribers map[*Subscription[T]]struct{}
+	mu          sync.RWMutex
+}
+
+// newHub creates a hub without subscribers, buffering buffer events per subscriber
+func newHub[T any](buffer int) *hub[T] {
+	return &hub[T]{
+		buffer:      buffer,
+		subscribers: make(map[*Subscription[T]]struct{}),
+	}
+}
+
+// subscribe registers a subscriber for the events accepted by match
+func (h *hub[T]) subscribe(match func(T) bool) *Subscription[T] {
+	s := &Subscription[T]{
+		match:  match,
+		events: make(chan T, h.buffer),
+		hub:    h,
+	}
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// active reports whether the hub has subscribers, so that publishers can
+// skip building events nobody receives
+func (h *hub[T]) active() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers) > 0
+}
+
+// publish delivers an event to every matching subscriber without blocking;
+// subscribers whose buffer is full are dropped
+func (h *hub[T]) publish(event T) {
+	var slow []*Subscription[T]
+
+	h.mu.RLock()
+	for s := range h.subscribers {
+		if !s.match(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, s := range slow {
+		h.remove(s, true)
+	}
+}
+
+// remove unregisters a subscriber and closes its channel
+func (h *hub[T]) remove(s *Subscription[T], dropped bool) {
+	s.once.Do(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers, s)
+		s.dropped = dropped
+		close(s.events)
+	})
+}
+
+// closeAll closes every subscription
+func (h *hub[T]) closeAll() {
+	h.mu.RLock()
+	subscribers := make([]*Subscription[T], 0, len(h.subscribers))
+	for s := range h.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	h.mu.RUnlock()
+
+	for _, s := range subscribers {
+		h.remove(s, false)
+	}
+}
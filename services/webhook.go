@@ -0,0 +1,599 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"high-load-service/cache"
+	"high-load-service/models"
+)
+
+// Default webhook delivery parameters
+const (
+	DefaultWebhookMaxAttempts = 5
+	DefaultWebhookBackoff     = time.Second
+	DefaultWebhookMaxBackoff  = time.Minute
+	DefaultWebhookConcurrency = 4
+	DefaultWebhookTimeout     = 10 * time.Second
+
+	// WebhookQueueSize is the number of deliveries queued per endpoint;
+	// deliveries that do not fit are dead-lettered right away
+	WebhookQueueSize = 1000
+
+	// WebhookFailedQueueSize is the number of deliveries waiting to be
+	// dead-lettered off the dispatching goroutine; beyond it they are dropped
+	WebhookFailedQueueSize = 1000
+)
+
+// Webhook request headers
+const (
+	WebhookIDHeader        = "X-Webhook-ID"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Webhook delivery results, as reported to the delivery callback
+const (
+	WebhookDelivered    = "delivered"
+	WebhookRetried      = "retried"
+	WebhookDeadLettered = "dead_lettered"
+	WebhookDropped      = "dropped"
+)
+
+var (
+	// ErrDeadLettersUnavailable is returned when dead letters are requested
+	// but Redis is not configured
+	ErrDeadLettersUnavailable = errors.New("webhook dead-letter queue requires Redis")
+
+	// ErrDeadLetterNotFound is returned when redriving an unknown dead letter
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+	// ErrWebhookEndpointRemoved is returned when redriving a dead letter whose
+	// endpoint is no longer configured; the dead letter is kept
+	ErrWebhookEndpointRemoved = errors.New("webhook endpoint no longer configured")
+)
+
+// WebhookEndpointConfig is a webhook endpoint of a tenant
+type WebhookEndpointConfig struct {
+	TenantID string
+	Name     string // unique per tenant
+	URL      string
+}
+
+// WebhookConfig holds the webhook delivery configuration
+type WebhookConfig struct {
+	// Endpoints are the endpoints the anomaly events and alerts of each
+	// tenant are POSTed to; a tenant's payloads only go to its own endpoints
+	Endpoints []WebhookEndpointConfig
+
+	// Secrets are the HMAC-SHA256 keys signing the requests of each tenant,
+	// keyed by tenant ID; tenants without a secret get unsigned requests
+	Secrets map[string]string
+
+	// MaxAttempts is the number of attempts per delivery before it is dead-lettered
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, doubled for each further
+	// retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Concurrency is the number of concurrent deliveries per endpoint
+	Concurrency int
+
+	// Timeout bounds each delivery attempt
+	Timeout time.Duration
+
+	// DeadLetterRetention bounds the dead-letter queue of each tenant
+	DeadLetterRetention cache.Retention
+}
+
+// DefaultWebhookConfig returns the built-in webhook configuration, without endpoints
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		MaxAttempts: DefaultWebhookMaxAttempts,
+		Backoff:     DefaultWebhookBackoff,
+		MaxBackoff:  DefaultWebhookMaxBackoff,
+		Concurrency: DefaultWebhookConcurrency,
+		Timeout:     DefaultWebhookTimeout,
+		DeadLetterRetention: cache.Retention{
+			MaxAge:     cache.DefaultDeadLetterRetention,
+			MaxEntries: cache.MaxDeadLettersStored,
+		},
+	}
+}
+
+// LoadWebhookConfig reads webhook configuration from environment variables:
+//
+//	WEBHOOK_ENDPOINTS    comma-separated tenant/name=url endpoints (empty disables webhooks)
+//	WEBHOOK_SECRETS      comma-separated tenant=key HMAC-SHA256 signing keys
+//	WEBHOOK_MAX_ATTEMPTS attempts per delivery before dead-lettering
+//	WEBHOOK_BACKOFF      delay before the first retry, e.g. "1s"
+//	WEBHOOK_MAX_BACKOFF  maximum delay between retries, e.g. "1m"
+//	WEBHOOK_CONCURRENCY  concurrent deliveries per endpoint
+//	WEBHOOK_TIMEOUT      timeout of each attempt, e.g. "10s"
+func LoadWebhookConfig() (WebhookConfig, error) {
+	cfg := DefaultWebhookConfig()
+
+	if os.Getenv("WEBHOOK_URLS") != "" || os.Getenv("WEBHOOK_SECRET") != "" {
+		return cfg, fmt.Errorf("WEBHOOK_URLS and WEBHOOK_SECRET were replaced by the per-tenant WEBHOOK_ENDPOINTS and WEBHOOK_SECRETS")
+	}
+
+	endpoints, err := parseWebhookEndpoints(os.Getenv("WEBHOOK_ENDPOINTS"))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid WEBHOOK_ENDPOINTS: %w", err)
+	}
+	cfg.Endpoints = endpoints
+
+	if v := os.Getenv("WEBHOOK_SECRETS"); v != "" {
+		secrets, err := parsePairs(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid WEBHOOK_SECRETS: %w", err)
+		}
+		for tenantID, secret := range secrets {
+			if !models.ValidTenantID(tenantID) || secret == "" {
+				return cfg, fmt.Errorf("invalid WEBHOOK_SECRETS: expected tenant=key with a valid tenant ID, got an entry for %q", tenantID)
+			}
+		}
+		cfg.Secrets = secrets
+	}
+
+	for name, param := range map[string]*int{
+		"WEBHOOK_MAX_ATTEMPTS": &cfg.MaxAttempts,
+		"WEBHOOK_CONCURRENCY":  &cfg.Concurrency,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return cfg, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*param = n
+		}
+	}
+
+	for name, param := range map[string]*time.Duration{
+		"WEBHOOK_BACKOFF":     &cfg.Backoff,
+		"WEBHOOK_MAX_BACKOFF": &cfg.MaxBackoff,
+		"WEBHOOK_TIMEOUT":     &cfg.Timeout,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*param = d
+		}
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		return cfg, fmt.Errorf("WEBHOOK_MAX_BACKOFF must not be less than WEBHOOK_BACKOFF")
+	}
+
+	return cfg, nil
+}
+
+// parseWebhookEndpoints parses a comma-separated list of tenant/name=url
+// endpoints. Names follow the tenant ID character set.
+func parseWebhookEndpoints(s string) ([]WebhookEndpointConfig, error) {
+	var endpoints []WebhookEndpointConfig
+	seen := make(map[[2]string]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, u, ok := strings.Cut(part, "=")
+		tenantID, name, okName := strings.Cut(strings.TrimSpace(id), "/")
+		if !ok || !okName || !models.ValidTenantID(tenantID) || !models.ValidTenantID(name) {
+			return nil, fmt.Errorf("expected tenant/name=url, got an entry for %q", id)
+		}
+		u = strings.TrimSpace(u)
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid URL of endpoint %s/%s", tenantID, name)
+		}
+		if seen[[2]string{tenantID, name}] {
+			return nil, fmt.Errorf("duplicate endpoint %s/%s", tenantID, name)
+		}
+		seen[[2]string{tenantID, name}] = true
+		endpoints = append(endpoints, WebhookEndpointConfig{TenantID: tenantID, Name: name, URL: u})
+	}
+	return endpoints, nil
+}
+
+// webhookDelivery is a payload on its way to a named endpoint of a tenant
+type webhookDelivery struct {
+	tenantID string
+	endpoint string
+	payload  models.WebhookPayload
+}
+
+// failedDelivery is a delivery waiting to be dead-lettered
+type failedDelivery struct {
+	delivery webhookDelivery
+	attempts int
+	cause    error
+}
+
+// webhookEndpoint is a configured endpoint with its delivery queue. The URL
+// may carry credentials, so it is only used for requests; logs, metrics and
+// dead letters refer to the endpoint by name.
+type webhookEndpoint struct {
+	name   string
+	url    string
+	secret string
+	queue  chan webhookDelivery
+}
+
+// WebhookDispatcher POSTs the anomaly events and alerts of each tenant to the
+// tenant's webhook endpoints. Each endpoint has a bounded queue served by
+// Concurrency workers, which retry failed deliveries with exponential backoff
+// and dead-letter them in Redis once MaxAttempts is exhausted.
+type WebhookDispatcher struct {
+	redis  *cache.RedisClient
+	cfg    WebhookConfig
+	client *http.Client
+
+	// Endpoints of each tenant, keyed by tenant ID and endpoint name
+	endpoints map[string]map[string]*webhookEndpoint
+
+	// Deliveries rejected by full queues, dead-lettered by a worker of their
+	// own so that dispatching never waits on Redis
+	failed chan failedDelivery
+
+	// Delivery callback for Prometheus metrics
+	onDelivery func(tenantID, endpoint, result string)
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewWebhookDispatcher creates a dispatcher and starts its workers
+func NewWebhookDispatcher(redisClient *cache.RedisClient, cfg WebhookConfig, onDelivery func(tenantID, endpoint, result string)) *WebhookDispatcher {
+	wd := &WebhookDispatcher{
+		redis:      redisClient,
+		cfg:        cfg,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		endpoints:  make(map[string]map[string]*webhookEndpoint),
+		failed:     make(chan failedDelivery, WebhookFailedQueueSize),
+		onDelivery: onDelivery,
+		stopChan:   make(chan struct{}),
+	}
+
+	wd.wg.Add(1)
+	go wd.storeFailed()
+
+	for _, e := range cfg.Endpoints {
+		if wd.endpoints[e.TenantID] == nil {
+			wd.endpoints[e.TenantID] = make(map[string]*webhookEndpoint)
+		}
+		if _, ok := wd.endpoints[e.TenantID][e.Name]; ok {
+			continue
+		}
+		endpoint := &webhookEndpoint{
+			name:   e.Name,
+			url:    e.URL,
+			secret: cfg.Secrets[e.TenantID],
+			queue:  make(chan webhookDelivery, WebhookQueueSize),
+		}
+		wd.endpoints[e.TenantID][e.Name] = endpoint
+		for i := 0; i < cfg.Concurrency; i++ {
+			wd.wg.Add(1)
+			go wd.work(endpoint)
+		}
+	}
+
+	return wd
+}
+
+// Dispatch queues an anomaly event for delivery to every endpoint of its tenant
+func (wd *WebhookDispatcher) Dispatch(event models.AnomalyEvent) {
+	wd.dispatch(event.TenantID, models.WebhookPayload{Type: models.WebhookEventAnomaly, Event: &event})
+}
+
+// DispatchAlert queues an alert that fired or resolved for delivery to every
+// endpoint of its tenant
+func (wd *WebhookDispatcher) DispatchAlert(alert models.Alert) {
+	wd.dispatch(alert.TenantID, models.WebhookPayload{Type: models.WebhookEventAlert, Alert: &alert})
+}
+
+// dispatch queues a payload of a tenant for delivery to every endpoint of
+// the tenant, with a delivery ID of its own per endpoint
+func (wd *WebhookDispatcher) dispatch(tenantID string, payload models.WebhookPayload) {
+	payload.CreatedAt = time.Now()
+	for _, endpoint := range wd.endpoints[tenantID] {
+		payload.ID = randomID()
+		wd.enqueue(endpoint, webhookDelivery{
+			tenantID: tenantID,
+			endpoint: endpoint.name,
+			payload:  payload,
+		})
+	}
+}
+
+// enqueue queues a delivery without blocking. If the endpoint's queue is
+// full the delivery is handed to the dead-letter worker, or dropped if that
+// is backed up too; once the dispatcher is stopped it is dead-lettered directly.
+func (wd *WebhookDispatcher) enqueue(endpoint *webhookEndpoint, d webhookDelivery) {
+	select {
+	case <-wd.stopChan:
+		wd.deadLetter(d, 0, errors.New("dispatcher stopped"))
+		return
+	default:
+	}
+
+	select {
+	case endpoint.queue <- d:
+		return
+	default:
+	}
+
+	select {
+	case wd.failed <- failedDelivery{delivery: d, cause: errors.New("delivery queue full")}:
+	default:
+		wd.report(d, WebhookDropped)
+		log.Printf("Warning: webhook delivery %s to endpoint %s/%s dropped: delivery and dead-letter queues full", d.payload.ID, d.tenantID, d.endpoint)
+	}
+}
+
+// storeFailed dead-letters the deliveries rejected by full queues until stopped
+func (wd *WebhookDispatcher) storeFailed() {
+	defer wd.wg.Done()
+	for {
+		select {
+		case f := <-wd.failed:
+			wd.deadLetter(f.delivery, f.attempts, f.cause)
+		case <-wd.stopChan:
+			return
+		}
+	}
+}
+
+// work delivers the queued deliveries of an endpoint until stopped
+func (wd *WebhookDispatcher) work(endpoint *webhookEndpoint) {
+	defer wd.wg.Done()
+	for {
+		select {
+		case d := <-endpoint.queue:
+			wd.deliver(endpoint, d)
+		case <-wd.stopChan:
+			return
+		}
+	}
+}
+
+// deliver POSTs a delivery, retrying with exponential backoff, and
+// dead-letters it when the attempts are exhausted or the failure is permanent
+func (wd *WebhookDispatcher) deliver(endpoint *webhookEndpoint, d webhookDelivery) {
+	body, err := json.Marshal(d.payload)
+	if err != nil {
+		wd.deadLetter(d, 0, fmt.Errorf("failed to marshal payload: %w", err))
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		retry, err := wd.post(endpoint, d.payload.ID, body)
+		if err == nil {
+			wd.report(d, WebhookDelivered)
+			return
+		}
+		if !retry || attempt >= wd.cfg.MaxAttempts {
+			wd.deadLetter(d, attempt, err)
+			return
+		}
+
+		wd.report(d, WebhookRetried)
+		select {
+		case <-time.After(wd.backoff(attempt)):
+		case <-wd.stopChan:
+			wd.deadLetter(d, attempt, err)
+			return
+		}
+	}
+}
+
+// post makes a single delivery attempt, signed with the endpoint's tenant
+// secret. retry reports whether a failure is worth retrying: network errors,
+// 429 and 5xx responses.
+func (wd *WebhookDispatcher) post(endpoint *webhookEndpoint, id string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.New("invalid endpoint URL")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, id)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	if endpoint.secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(endpoint.secret, timestamp, body))
+	}
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return true, redactURL(err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+}
+
+// redactURL strips the request URL from a client error, keeping the
+// operation and the underlying cause
+func redactURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// SignWebhook returns the hex HMAC-SHA256 signature of a webhook request:
+// the MAC of "<timestamp>.<body>" keyed with the secret. Receivers recompute
+// it from the X-Webhook-Timestamp header and the raw body, and should reject
+// stale timestamps to prevent replays.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the delay after a failed attempt: Backoff doubled for
+// each previous retry, capped at MaxBackoff, with up to 50% random jitter
+// subtracted so that endpoints recovering from an outage are not hit in lockstep
+func (wd *WebhookDispatcher) backoff(attempt int) time.Duration {
+	d := wd.cfg.Backoff
+	for i := 1; i < attempt && d < wd.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, wd.cfg.MaxBackoff)
+	return d - time.Duration(mathrand.Int63n(int64(d)/2+1))
+}
+
+// deadLetter stores a failed delivery in the tenant's dead-letter queue
+func (wd *WebhookDispatcher) deadLetter(d webhookDelivery, attempts int, cause error) {
+	wd.report(d, WebhookDeadLettered)
+	log.Printf("Warning: webhook delivery %s to endpoint %s/%s failed after %d attempts: %v", d.payload.ID, d.tenantID, d.endpoint, attempts, cause)
+
+	if wd.redis == nil {
+		return
+	}
+	dl := models.DeadLetter{
+		ID:        d.payload.ID,
+		Endpoint:  d.endpoint,
+		Payload:   d.payload,
+		Attempts:  attempts,
+		LastError: cause.Error(),
+		FailedAt:  time.Now(),
+	}
+	if err := wd.redis.StoreDeadLetter(d.tenantID, dl, wd.cfg.DeadLetterRetention); err != nil {
+		log.Printf("Warning: failed to store dead letter in Redis: %v", err)
+	}
+}
+
+// report calls the delivery callback if set
+func (wd *WebhookDispatcher) report(d webhookDelivery, result string) {
+	if wd.onDelivery != nil {
+		wd.onDelivery(d.tenantID, d.endpoint, result)
+	}
+}
+
+// DeadLetters returns up to limit dead letters of a tenant, newest first,
+// skipping the first offset, and the total number of dead letters
+func (wd *WebhookDispatcher) DeadLetters(tenantID string, limit, offset int64) ([]models.DeadLetter, int64, error) {
+	if wd.redis == nil {
+		return nil, 0, ErrDeadLettersUnavailable
+	}
+	return wd.redis.GetDeadLetters(tenantID, limit, offset)
+}
+
+// Redrive removes a dead letter of a tenant and queues it for delivery again,
+// with its original delivery ID and a fresh set of attempts
+func (wd *WebhookDispatcher) Redrive(tenantID, id string) error {
+	if wd.redis == nil {
+		return ErrDeadLettersUnavailable
+	}
+	dl, ok, err := wd.redis.TakeDeadLetter(tenantID, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+
+	endpoint, ok := wd.endpoints[tenantID][dl.Endpoint]
+	if !ok {
+		if err := wd.redis.StoreDeadLetter(tenantID, dl, wd.cfg.DeadLetterRetention); err != nil {
+			return err
+		}
+		return ErrWebhookEndpointRemoved
+	}
+	wd.enqueue(endpoint, webhookDelivery{tenantID: tenantID, endpoint: dl.Endpoint, payload: dl.Payload})
+	return nil
+}
+
+// RedriveAll redrives every dead letter of a tenant whose endpoint is still
+// configured and returns how many were queued
+func (wd *WebhookDispatcher) RedriveAll(tenantID string) (int, error) {
+	if wd.redis == nil {
+		return 0, ErrDeadLettersUnavailable
+	}
+	ids, err := wd.redis.GetDeadLetterIDs(tenantID)
+	if err != nil {
+		return 0, err
+	}
+
+	redriven := 0
+	for _, id := range ids {
+		err := wd.Redrive(tenantID, id)
+		if errors.Is(err, ErrDeadLetterNotFound) || errors.Is(err, ErrWebhookEndpointRemoved) {
+			continue // Redriven concurrently, or kept
+		}
+		if err != nil {
+			return redriven, err
+		}
+		redriven++
+	}
+	return redriven, nil
+}
+
+// Endpoints returns the number of configured endpoints of all tenants
+func (wd *WebhookDispatcher) Endpoints() int {
+	n := 0
+	for _, endpoints := range wd.endpoints {
+		n += len(endpoints)
+	}
+	return n
+}
+
+// Stop stops the workers; deliveries still queued or waiting for a retry
+// are dead-lettered so they can be redriven after a restart
+func (wd *WebhookDispatcher) Stop() {
+	close(wd.stopChan)
+	wd.wg.Wait()
+
+	for _, endpoints := range wd.endpoints {
+		for _, endpoint := range endpoints {
+			for len(endpoint.queue) > 0 {
+				wd.deadLetter(<-endpoint.queue, 0, errors.New("dispatcher stopped"))
+			}
+		}
+	}
+	for len(wd.failed) > 0 {
+		f := <-wd.failed
+		wd.deadLetter(f.delivery, f.attempts, f.cause)
+	}
+}
+
+// randomID returns a random hex identifier for webhook deliveries and alert rules
+func randomID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b[:])
+}
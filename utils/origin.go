@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may open WebSocket connections.
+// Requests without an Origin header (non-browser clients) and same-origin
+// requests are always allowed; other origins must be listed.
+type OriginPolicy struct {
+	origins map[string]bool
+	any     bool
+}
+
+// LoadOriginPolicy reads the allowed origins from the LIVE_ALLOWED_ORIGINS
+// environment variable, a comma-separated list of origins such as
+// "https://dashboard.example.com", or "*" to allow any origin
+func LoadOriginPolicy() (*OriginPolicy, error) {
+	return ParseOriginPolicy(os.Getenv("LIVE_ALLOWED_ORIGINS"))
+}
+
+// ParseOriginPolicy parses a comma-separated list of allowed origins
+func ParseOriginPolicy(s string) (*OriginPolicy, error) {
+	p := &OriginPolicy{origins: make(map[string]bool)}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+			continue
+		case part == "*":
+			p.any = true
+			continue
+		}
+		u, err := url.Parse(part)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("expected an origin like https://host[:port], got %q", part)
+		}
+		p.origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	return p, nil
+}
+
+// Check reports whether the origin of a request is allowed
+func (p *OriginPolicy) Check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return p.origins[strings.ToLower(u.Scheme+"://"+u.Host)]
+}
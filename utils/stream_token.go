@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"high-load-service/models"
+)
+
+// Browsers cannot set headers on EventSource or WebSocket requests, so
+// streaming routes also accept a short-lived stream token in this query
+// parameter or cookie, or offered as the WebSocket subprotocol
+// "access_token.<token>"
+const (
+	StreamTokenParam       = "access_token"
+	StreamTokenCookie      = "stream_token"
+	StreamTokenSubprotocol = "access_token."
+)
+
+// DefaultStreamTokenTTL is how long a stream token is accepted after it is issued
+const DefaultStreamTokenTTL = time.Hour
+
+// streamTokenScope is signed into every token so that the signature cannot
+// be mistaken for another use of the secret
+const streamTokenScope = "stream"
+
+// StreamTokens issues and verifies stream tokens: "<tenant>.<expiry>.<mac>",
+// with the expiry in Unix seconds and mac an HMAC-SHA256 of the rest. A
+// token only authenticates its tenant on the streaming paths, so one that
+// leaks through a URL cannot be used to write metrics or change rules.
+type StreamTokens struct {
+	secret []byte
+	ttl    time.Duration
+	paths  []string
+}
+
+// LoadStreamTokens configures stream tokens for the given paths from the
+// STREAM_TOKEN_SECRET and STREAM_TOKEN_TTL environment variables. Without a
+// secret a random one is generated, and tokens are only accepted by the
+// replica that issued them.
+func LoadStreamTokens(paths ...string) (*StreamTokens, error) {
+	ttl := DefaultStreamTokenTTL
+	if v := os.Getenv("STREAM_TOKEN_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid STREAM_TOKEN_TTL %q", v)
+		}
+		ttl = d
+	}
+
+	secret := []byte(os.Getenv("STREAM_TOKEN_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, sha256.Size)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generating stream token secret: %w", err)
+		}
+	}
+	return NewStreamTokens(secret, ttl, paths...), nil
+}
+
+// NewStreamTokens creates stream tokens signed with secret, valid for ttl on
+// the given paths
+func NewStreamTokens(secret []byte, ttl time.Duration, paths ...string) *StreamTokens {
+	return &StreamTokens{secret: secret, ttl: ttl, paths: paths}
+}
+
+// Issue returns a token for the tenant and its expiry time
+func (s *StreamTokens) Issue(tenantID string, now time.Time) (string, time.Time) {
+	expires := now.Add(s.ttl).Truncate(time.Second)
+	payload := tenantID + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + s.sign(payload), expires
+}
+
+// Tenant returns the tenant a token authenticates, if it is valid at now
+func (s *StreamTokens) Tenant(token string, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(s.sign(token[:i]))) {
+		return "", false
+	}
+	tenantID, expiry, ok := strings.Cut(token[:i], ".")
+	if !ok || !models.ValidTenantID(tenantID) {
+		return "", false
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || !now.Before(time.Unix(seconds, 0)) {
+		return "", false
+	}
+	return tenantID, true
+}
+
+// sign returns the encoded MAC of a token payload
+func (s *StreamTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(streamTokenScope + ":" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestTenant returns the tenant of the stream token of a request on a
+// streaming path, taken from the query parameter, the WebSocket subprotocols
+// or else the cookie
+func (s *StreamTokens) requestTenant(r *http.Request) (string, bool) {
+	if s == nil || !containsPath(s.paths, r.URL.Path) {
+		return "", false
+	}
+	token := r.URL.Query().Get(StreamTokenParam)
+	if token == "" {
+		token = subprotocolToken(r)
+	}
+	if token == "" {
+		if cookie, err := r.Cookie(StreamTokenCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return "", false
+	}
+	return s.Tenant(token, time.Now())
+}
+
+// subprotocolToken returns the token offered as a WebSocket subprotocol, if any
+func subprotocolToken(r *http.Request) string {
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), StreamTokenSubprotocol); ok {
+				return token
+			}
+		}
+	}
+	return ""
+}
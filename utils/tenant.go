@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"high-load-service/models"
+)
+
+// APIKeyHeader is the request header carrying the API key, as an
+// alternative to an "Authorization: Bearer <key>" header
+const APIKeyHeader = "X-API-Key"
+
+type tenantContextKey struct{}
+
+// TenantKeys maps API keys to the tenants they authenticate. Keys are held
+// as SHA-256 digests so that lookups do not compare secrets byte by byte.
+type TenantKeys struct {
+	tenants map[[sha256.Size]byte]string
+}
+
+// LoadTenantKeys reads the API keys of each tenant from the TENANT_API_KEYS
+// environment variable, a comma-separated list of tenant=key pairs, e.g.
+// "acme=s3cr3t,globex=t0k3n". A tenant may have several keys to allow
+// rotation. It returns nil if no keys are configured.
+func LoadTenantKeys() (*TenantKeys, error) {
+	return ParseTenantKeys(os.Getenv("TENANT_API_KEYS"))
+}
+
+// ParseTenantKeys parses a comma-separated list of tenant=key pairs,
+// returning nil if the list is empty
+func ParseTenantKeys(s string) (*TenantKeys, error) {
+	keys := &TenantKeys{tenants: make(map[[sha256.Size]byte]string)}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tenantID, key, ok := strings.Cut(part, "=")
+		if !ok || !models.ValidTenantID(tenantID) || key == "" {
+			return nil, fmt.Errorf("expected tenant=key with a valid tenant ID, got an entry for %q", tenantID)
+		}
+		digest := sha256.Sum256([]byte(key))
+		if other, ok := keys.tenants[digest]; ok && other != tenantID {
+			return nil, fmt.Errorf("API key of tenant %s is also used by tenant %s", tenantID, other)
+		}
+		keys.tenants[digest] = tenantID
+	}
+	if len(keys.tenants) == 0 {
+		return nil, nil
+	}
+	return keys, nil
+}
+
+// Tenant returns the tenant an API key authenticates
+func (k *TenantKeys) Tenant(key string) (string, bool) {
+	tenantID, ok := k.tenants[sha256.Sum256([]byte(key))]
+	return tenantID, ok
+}
+
+// TenantMiddleware resolves the tenant of each request from its API key and
+// stores it in the request context. Requests without a valid key are
+// rejected, except for the public paths (health checks and scraping); on
+// the streaming paths of tokens a valid stream token is accepted instead of
+// a key. Without configured keys the service is single-tenant and every
+// request belongs to the default tenant.
+func TenantMiddleware(keys *TenantKeys, tokens *StreamTokens, public ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenantID := models.DefaultTenantID
+			if keys != nil && !containsPath(public, r.URL.Path) {
+				var ok bool
+				if tenantID, ok = keys.Tenant(requestAPIKey(r)); !ok {
+					tenantID, ok = tokens.requestTenant(r)
+				}
+				if !ok {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					http.Error(w, "Missing or invalid API key", http.StatusUnauthorized)
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), tenantID)))
+		})
+	}
+}
+
+// requestAPIKey returns the API key of a request, from the Authorization
+// bearer token or the X-API-Key header
+func requestAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get(APIKeyHeader)
+}
+
+// containsPath reports whether path is one of paths
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTenant returns a copy of ctx carrying the tenant ID
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant ID stored in ctx, or the default tenant
+func TenantFromContext(ctx context.Context) string {
+	if tenantID, ok := ctx.Value(tenantContextKey{}).(string); ok {
+		return tenantID
+	}
+	return models.DefaultTenantID
+}